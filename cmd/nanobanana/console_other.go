@@ -0,0 +1,9 @@
+//go:build !windows
+
+package main
+
+// enableVirtualTerminal reports whether the terminal understands ANSI
+// escapes, which every supported non-Windows terminal does.
+func enableVirtualTerminal() bool {
+	return true
+}
@@ -0,0 +1,31 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// cpUTF8 is the UTF-8 code page identifier.
+const cpUTF8 = 65001
+
+// enableVirtualTerminal turns on ANSI escape handling for the stderr
+// console and switches its output to UTF-8 so ✓, ⚠ and the spinner frames
+// render. It reports false on consoles that predate virtual terminal
+// support (before Windows 10), where escapes would print as garbage.
+func enableVirtualTerminal() bool {
+	h := windows.Handle(os.Stderr.Fd())
+	var mode uint32
+	if err := windows.GetConsoleMode(h, &mode); err != nil {
+		return false
+	}
+	if mode&windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING == 0 {
+		if err := windows.SetConsoleMode(h, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+			return false
+		}
+	}
+	windows.SetConsoleOutputCP(cpUTF8)
+	return true
+}
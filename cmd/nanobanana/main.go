@@ -4,25 +4,54 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
+	"cmp"
 	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
 	_ "embed"
 	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"hash/crc32"
 	"image"
+	"image/color"
+	"image/color/palette"
+	"image/draw"
+	"image/gif"
 	"image/jpeg"
 	"image/png"
 	"io"
+	"log/slog"
+	"math"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/BurntSushi/toml"
 	"golang.org/x/term"
@@ -117,8 +146,8 @@ func showUpdateMessage(latestVersion string) {
 	}
 }
 
-// ANSI color codes
-const (
+// ANSI color codes, blanked by disableColor
+var (
 	colorReset  = "\033[0m"
 	colorRed    = "\033[31m"
 	colorGreen  = "\033[32m"
@@ -129,15 +158,175 @@ const (
 	colorBold   = "\033[1m"
 )
 
+// useColor reports whether output should be colored: not with --no-color,
+// not when NO_COLOR is set (https://no-color.org), and only when stderr is
+// a terminal that understands ANSI escapes.
+func useColor(noColor bool) bool {
+	if noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	return ansiTerminal()
+}
+
+// ansiTerminal reports whether stderr is a terminal that handles ANSI
+// escapes, enabling them first on Windows consoles. Color and the spinner
+// both depend on it.
+var ansiTerminal = sync.OnceValue(func() bool {
+	return term.IsTerminal(int(os.Stderr.Fd())) && enableVirtualTerminal()
+})
+
+// disableColor turns every color code into an empty string.
+func disableColor() {
+	for _, c := range []*string{&colorReset, &colorRed, &colorGreen, &colorYellow, &colorBlue, &colorPurple, &colorCyan, &colorBold} {
+		*c = ""
+	}
+}
+
+// stripBoolFlag removes a global boolean flag, such as --no-color, from
+// args. It may appear anywhere before a "--" terminator.
+func stripBoolFlag(args []string, flagName string) ([]string, bool) {
+	var out []string
+	found := false
+	for i, a := range args {
+		if a == "--" {
+			out = append(out, args[i:]...)
+			break
+		}
+		if a == "--"+flagName || a == "-"+flagName {
+			found = true
+			continue
+		}
+		out = append(out, a)
+	}
+	return out, found
+}
+
+// stripValueFlag removes a global flag that takes a value, such as
+// --config, from args. It may appear anywhere before a "--" terminator;
+// the last one wins. want names the value in the error when it's missing,
+// e.g. "a file path".
+func stripValueFlag(args []string, flagName, want string) ([]string, string, error) {
+	var out []string
+	value := ""
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			out = append(out, args[i:]...)
+			break
+		}
+		name, v, hasValue := strings.Cut(a, "=")
+		if name != "--"+flagName && name != "-"+flagName {
+			out = append(out, a)
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(args) {
+				return nil, "", fmt.Errorf("--%s needs %s", flagName, want)
+			}
+			i++
+			v = args[i]
+		}
+		if v == "" {
+			return nil, "", fmt.Errorf("--%s needs %s", flagName, want)
+		}
+		value = v
+	}
+	return out, value, nil
+}
+
+// envFileVars are the variables --env-file sets besides NANOBANANA_*
+// ones; anything else in the file, such as a database URL, is ignored.
+var envFileVars = []string{"GEMINI_API_KEY", "GOOGLE_APPLICATION_CREDENTIALS", "GOOGLE_CLOUD_QUOTA_PROJECT", "NO_COLOR", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy"}
+
+// loadEnvFile reads a dotenv file of KEY=VALUE lines and sets the
+// variables nanobanana uses. A variable that is already set keeps its
+// value unless override is true.
+func loadEnvFile(path string, override bool) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return classify(exitIO, fmt.Errorf("reading env file: %w", err))
+	}
+	vars, err := parseEnvFile(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	for _, kv := range vars {
+		if !strings.HasPrefix(kv[0], "NANOBANANA_") && !slices.Contains(envFileVars, kv[0]) {
+			continue
+		}
+		if _, set := os.LookupEnv(kv[0]); set && !override {
+			continue
+		}
+		os.Setenv(kv[0], kv[1])
+	}
+	return nil
+}
+
+// parseEnvFile parses dotenv lines: KEY=VALUE, optionally after "export".
+// Blank lines and lines starting with # are skipped. A value in double
+// quotes may use Go escapes such as \n, one in single quotes is taken
+// literally, and an unquoted value ends at " #".
+func parseEnvFile(text string) ([][2]string, error) {
+	var vars [][2]string
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || !validEnvKey(key) {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", i+1)
+		}
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			v, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quoted value for %s", i+1, key)
+			}
+			value = v
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			if j := strings.Index(value, " #"); j >= 0 {
+				value = strings.TrimSpace(value[:j])
+			}
+		}
+		vars = append(vars, [2]string{key, value})
+	}
+	return vars, nil
+}
+
+// validEnvKey reports whether key is a usable variable name: letters,
+// digits and underscores, not starting with a digit.
+func validEnvKey(key string) bool {
+	if key == "" || (key[0] >= '0' && key[0] <= '9') {
+		return false
+	}
+	for _, r := range key {
+		if r != '_' && !('A' <= r && r <= 'Z') && !('a' <= r && r <= 'z') && !('0' <= r && r <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
 // Model aliases
 const (
 	modelFlash  = "gemini-3.1-flash-image-preview"
 	modelPro    = "gemini-3-pro-image-preview"
 	modelLegacy = "gemini-2.5-flash-image"
-	apiBaseURL  = "https://generativelanguage.googleapis.com/v1beta/models"
 	httpTimeout = 120 * time.Second
+
+	defaultAPIBaseURL = "https://generativelanguage.googleapis.com"
 )
 
+// apiBaseURL is the API root; requests go to apiBaseURL + "/v1beta/models".
+// Overridden by NANOBANANA_API_BASE_URL or base_url in config.
+var apiBaseURL = defaultAPIBaseURL
+
 // Model alias map
 var modelAliases = map[string]string{
 	"flash":  modelFlash,
@@ -163,6 +352,31 @@ var validAspectRatios = map[string]bool{
 	"21:9": true,
 }
 
+// Approximate USD cost per generated image, by model and size. Sizes not
+// listed use the model's "" entry.
+var modelCosts = map[string]map[string]float64{
+	modelFlash:  {"": 0.04},
+	modelPro:    {"": 0.13, "4K": 0.24},
+	modelLegacy: {"": 0.039},
+}
+
+// estimateCost returns the approximate cost of n images, and false if the
+// model's pricing is unknown.
+func estimateCost(model, size string, n int) (float64, bool) {
+	costs, ok := modelCosts[model]
+	if !ok {
+		return 0, false
+	}
+	perImage, ok := costs[size]
+	if !ok {
+		perImage = costs[""]
+	}
+	return perImage * float64(n), true
+}
+
+// aspectRatioOrder lists every known aspect ratio in display order.
+var aspectRatioOrder = []string{"1:1", "1:4", "1:8", "2:3", "3:2", "3:4", "4:1", "4:3", "4:5", "5:4", "8:1", "9:16", "16:9", "21:9"}
+
 // Pro and legacy models support a narrower aspect ratio set.
 var validAspectRatiosProLegacy = map[string]bool{
 	"1:1":  true,
@@ -185,14 +399,82 @@ var validSizes = map[string][2]int{
 	"4K":    {3840, 2160},
 }
 
+// sizeOrder lists every known image size in display order.
+var sizeOrder = []string{"512px", "1K", "2K", "4K"}
+
 // quiet suppresses info/spinner output when true
 var quiet bool
 
+// Retry settings for 429/5xx responses, set from --retries and --retry-max-wait
+var (
+	maxRetries   = 3
+	retryMaxWait = 30 * time.Second
+)
+
+// verbose logs API requests and responses to stderr (--verbose/--debug)
+var verbose bool
+
+// streamResponses uses the streamGenerateContent endpoint and reports
+// download progress (--stream)
+var streamResponses bool
+
+// jsonOutput reports errors as {"error": "..."} on stdout when true
+var jsonOutput bool
+
 // --- Config ---
 
 type Config struct {
-	APIKey string `toml:"api_key"`
-	Model  string `toml:"model"`
+	APIKey           string             `toml:"api_key"`
+	APIKeyFile       string             `toml:"api_key_file,omitempty"`
+	Model            string             `toml:"model,omitempty"`
+	OutputDir        string             `toml:"output_dir,omitempty"`
+	OutputTemplate   string             `toml:"output_template,omitempty"`
+	Aspect           string             `toml:"aspect,omitempty"`
+	Size             string             `toml:"size,omitempty"`
+	BaseURL          string             `toml:"base_url,omitempty"`
+	Auth             string             `toml:"auth,omitempty"`
+	System           string             `toml:"system,omitempty"`
+	PromptPrefix     string             `toml:"prompt_prefix,omitempty"`
+	PromptSuffix     string             `toml:"prompt_suffix,omitempty"`
+	Styles           map[string]string  `toml:"styles,omitempty"`
+	PromptWarn       int                `toml:"prompt_warn_length,omitempty"`
+	ConfirmExpensive bool               `toml:"confirm_expensive,omitempty"`
+	AutoFix          []autoFixRule      `toml:"auto_fix,omitempty"`
+	Profiles         map[string]Profile `toml:"profiles,omitempty"`
+
+	// profile is the active profile name, chosen by --profile or
+	// NANOBANANA_PROFILE. It is never saved.
+	profile string
+}
+
+// Profile overrides top-level config values, e.g. [profiles.work].
+type Profile struct {
+	APIKey string `toml:"api_key,omitempty"`
+	Model  string `toml:"model,omitempty"`
+}
+
+// selectProfile activates a named profile; an empty name falls back to
+// NANOBANANA_PROFILE, and no name at all means the top-level config.
+func (c *Config) selectProfile(name string) error {
+	if name == "" {
+		name = os.Getenv("NANOBANANA_PROFILE")
+	}
+	if name == "" {
+		return nil
+	}
+	if _, ok := c.Profiles[name]; !ok {
+		return fmt.Errorf("unknown profile %q in %s", name, configPath())
+	}
+	c.profile = name
+	return nil
+}
+
+// activeProfile returns the selected profile, or an empty one.
+func (c *Config) activeProfile() Profile {
+	if c.profile == "" {
+		return Profile{}
+	}
+	return c.Profiles[c.profile]
 }
 
 func configDir() string {
@@ -207,29 +489,109 @@ func configDir() string {
 	return filepath.Join(home, ".config", "nanobanana")
 }
 
+// configOverride is the config file chosen with the global --config flag.
+var configOverride string
+
+// configPath returns the config file to read and write: --config, then
+// NANOBANANA_CONFIG, then config.toml in configDir. History and other state
+// stay in configDir either way.
 func configPath() string {
+	if configOverride != "" {
+		return configOverride
+	}
+	if env := os.Getenv("NANOBANANA_CONFIG"); env != "" {
+		return expandPath(env)
+	}
 	return filepath.Join(configDir(), "config.toml")
 }
 
+// baseConfigPaths returns the read-only system-wide configs found under
+// XDG_CONFIG_DIRS (default /etc/xdg), most important first.
+func baseConfigPaths() []string {
+	dirs := os.Getenv("XDG_CONFIG_DIRS")
+	if dirs == "" {
+		if runtime.GOOS == "windows" {
+			return nil
+		}
+		dirs = "/etc/xdg"
+	}
+	var paths []string
+	for _, dir := range filepath.SplitList(dirs) {
+		if !filepath.IsAbs(dir) {
+			continue // the spec says to ignore relative entries
+		}
+		if path := filepath.Join(dir, "nanobanana", "config.toml"); fileExists(path) {
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+// loadConfig reads the user config over any base configs, so an admin can
+// ship org-wide defaults such as base_url while users keep their own key.
+// A value in a more important file replaces the same value in a less
+// important one; [profiles.*] tables are replaced whole.
 func loadConfig() (*Config, error) {
 	cfg := &Config{
 		Model: "flash",
 	}
-	data, err := os.ReadFile(configPath())
+	base := baseConfigPaths()
+	for i := len(base) - 1; i >= 0; i-- {
+		if err := readConfigFile(base[i], cfg); err != nil {
+			return nil, err
+		}
+	}
+	if err := readConfigFile(configPath(), cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadUserConfig reads the user config alone, without defaults. Commands
+// that save the config use it, so neither base config values nor the
+// default model are copied into the user's file to shadow a base config.
+func loadUserConfig() (*Config, error) {
+	cfg := &Config{}
+	if err := readConfigFile(configPath(), cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// readConfigFile decodes the config at path over cfg. A missing file
+// leaves cfg as it is.
+func readConfigFile(path string, cfg *Config) error {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return cfg, nil
+			return nil
 		}
-		return nil, fmt.Errorf("reading config: %w", err)
+		return fmt.Errorf("reading config: %w", err)
 	}
 	if err := toml.Unmarshal(data, cfg); err != nil {
-		return nil, fmt.Errorf("parsing config: %w", err)
+		return fmt.Errorf("parsing config %s: %w", path, err)
 	}
-	return cfg, nil
+	if err := cfg.validateDefaults(); err != nil {
+		return fmt.Errorf("config %s: %w", path, err)
+	}
+	return nil
+}
+
+// validateDefaults checks the default aspect ratio and size against every
+// known value. Whether the chosen model supports them is only known once
+// a command resolves its model.
+func (c *Config) validateDefaults() error {
+	if c.Aspect != "" && !validAspectRatios[c.Aspect] {
+		return fmt.Errorf("invalid aspect %q (valid: %s)", c.Aspect, strings.Join(aspectRatioOrder, ", "))
+	}
+	if _, ok := validSizes[c.Size]; c.Size != "" && !ok {
+		return fmt.Errorf("invalid size %q (valid: %s)", c.Size, strings.Join(sizeOrder, ", "))
+	}
+	return nil
 }
 
 func saveConfig(cfg *Config) error {
-	dir := configDir()
+	dir := filepath.Dir(configPath())
 	if err := os.MkdirAll(dir, 0700); err != nil {
 		return fmt.Errorf("creating config dir: %w", err)
 	}
@@ -245,24 +607,360 @@ func saveConfig(cfg *Config) error {
 }
 
 func resolveAPIKey(cfg *Config) (string, error) {
-	// Match the official nanobanana Gemini extension env var precedence
+	if mockAPI {
+		return "mock", nil
+	}
+	method, err := authMethod(cfg)
+	if err != nil {
+		return "", err
+	}
+	if method == "adc" {
+		if adc == nil {
+			if adc, err = loadADC(rootCtx); err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+	}
+	// A selected profile is an explicit choice, so its key wins over the
+	// environment; otherwise match the official nanobanana Gemini extension
+	// env var precedence
+	if key := cfg.activeProfile().APIKey; key != "" {
+		return key, nil
+	}
 	for _, env := range []string{"NANOBANANA_GEMINI_API_KEY", "GEMINI_API_KEY"} {
 		if key := os.Getenv(env); key != "" {
 			return key, nil
 		}
 	}
+	if ref := os.Getenv("NANOBANANA_GEMINI_API_KEY_FILE"); ref != "" {
+		return readAPIKeyRef(ref)
+	}
+	if cfg.APIKeyFile != "" {
+		return readAPIKeyRef(cfg.APIKeyFile)
+	}
 	if cfg.APIKey != "" {
 		return cfg.APIKey, nil
 	}
 	return "", fmt.Errorf("no API key found. Set NANOBANANA_GEMINI_API_KEY or run: nanobanana setup")
 }
 
+// readAPIKeyRef reads an API key from a file path, or from the macOS
+// keychain for "keychain:<service>" references.
+func readAPIKeyRef(ref string) (string, error) {
+	var key string
+	if service, ok := strings.CutPrefix(ref, "keychain:"); ok {
+		if runtime.GOOS != "darwin" {
+			return "", fmt.Errorf("keychain API key references are only supported on macOS")
+		}
+		out, err := keychainCommand(service).Output()
+		if err != nil {
+			return "", fmt.Errorf("reading API key from keychain item %q: %w", service, err)
+		}
+		key = string(out)
+	} else {
+		data, err := os.ReadFile(expandPath(ref))
+		if err != nil {
+			return "", fmt.Errorf("reading API key file: %w", err)
+		}
+		key = string(data)
+	}
+	key = strings.TrimSpace(key)
+	if key == "" {
+		return "", fmt.Errorf("API key from %s is empty", ref)
+	}
+	return key, nil
+}
+
+// keychainCommand returns the command that prints a generic password
+// stored with: security add-generic-password -s <service> -a $USER -w
+func keychainCommand(service string) *exec.Cmd {
+	return exec.Command("security", "find-generic-password", "-s", service, "-w")
+}
+
+// authOverride is the auth method chosen with the global --auth flag.
+var authOverride string
+
+// authMethods are the values --auth, NANOBANANA_AUTH and auth in the
+// config accept.
+var authMethods = []string{"api-key", "adc"}
+
+// authMethod returns how to authenticate: --auth, then NANOBANANA_AUTH,
+// then auth in the config, then an API key.
+func authMethod(cfg *Config) (string, error) {
+	method := cmp.Or(authOverride, os.Getenv("NANOBANANA_AUTH"), cfg.Auth, "api-key")
+	if !slices.Contains(authMethods, method) {
+		return "", fmt.Errorf("unknown auth method %q (valid: %s)", method, strings.Join(authMethods, ", "))
+	}
+	return method, nil
+}
+
+// adc holds the Application Default Credentials in use under --auth adc,
+// or nil when requests carry an API key.
+var adc *adcCredentials
+
+// adcScopes are the OAuth scopes requested for Gemini API calls.
+const adcScopes = "https://www.googleapis.com/auth/cloud-platform https://www.googleapis.com/auth/generative-language"
+
+const defaultTokenURI = "https://oauth2.googleapis.com/token"
+
+// adcCredentials are Google Application Default Credentials: the file
+// written by gcloud auth application-default login (authorized_user), a
+// service account key (service_account), or, with neither, the metadata
+// server of a Google Cloud VM. Access tokens are fetched with them and
+// reused until shortly before they expire.
+type adcCredentials struct {
+	Type           string `json:"type"`
+	ClientID       string `json:"client_id"`
+	ClientSecret   string `json:"client_secret"`
+	RefreshToken   string `json:"refresh_token"`
+	ClientEmail    string `json:"client_email"`
+	PrivateKey     string `json:"private_key"`
+	TokenURI       string `json:"token_uri"`
+	QuotaProjectID string `json:"quota_project_id"`
+
+	source string // the credentials file, or "metadata server"
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+// adcPath returns the credentials file ADC would use: the
+// GOOGLE_APPLICATION_CREDENTIALS file, or gcloud's well-known file if it
+// exists. An empty path means the metadata server.
+func adcPath() string {
+	if path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); path != "" {
+		return expandPath(path)
+	}
+	dir := os.Getenv("CLOUDSDK_CONFIG")
+	if dir == "" {
+		if runtime.GOOS == "windows" {
+			dir = filepath.Join(os.Getenv("APPDATA"), "gcloud")
+		} else {
+			home, _ := os.UserHomeDir()
+			dir = filepath.Join(home, ".config", "gcloud")
+		}
+	}
+	if path := filepath.Join(dir, "application_default_credentials.json"); fileExists(path) {
+		return path
+	}
+	return ""
+}
+
+// loadADC finds the Application Default Credentials and fetches a first
+// access token, so bad or missing credentials fail before any work starts.
+func loadADC(ctx context.Context) (*adcCredentials, error) {
+	creds := &adcCredentials{source: "metadata server"}
+	if path := adcPath(); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading Application Default Credentials: %w", err)
+		}
+		if err := json.Unmarshal(data, creds); err != nil {
+			return nil, fmt.Errorf("parsing Application Default Credentials %s: %w", path, err)
+		}
+		creds.source = path
+		switch creds.Type {
+		case "authorized_user", "service_account":
+		default:
+			return nil, fmt.Errorf("%s holds %q credentials; --auth adc supports authorized_user (gcloud auth application-default login) and service_account keys", path, creds.Type)
+		}
+	}
+	creds.QuotaProjectID = cmp.Or(os.Getenv("GOOGLE_CLOUD_QUOTA_PROJECT"), creds.QuotaProjectID)
+	if _, err := creds.accessToken(ctx); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// accessToken returns a valid access token, fetching a new one when there
+// is none or it expires within a minute.
+func (c *adcCredentials) accessToken(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.token != "" && time.Until(c.expiry) > time.Minute {
+		return c.token, nil
+	}
+	var req *http.Request
+	var err error
+	switch c.Type {
+	case "authorized_user":
+		req, err = tokenRequest(ctx, cmp.Or(c.TokenURI, defaultTokenURI), url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {c.ClientID},
+			"client_secret": {c.ClientSecret},
+			"refresh_token": {c.RefreshToken},
+		})
+	case "service_account":
+		var assertion string
+		if assertion, err = c.jwtAssertion(); err == nil {
+			req, err = tokenRequest(ctx, cmp.Or(c.TokenURI, defaultTokenURI), url.Values{
+				"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+				"assertion":  {assertion},
+			})
+		}
+	default:
+		host := cmp.Or(os.Getenv("GCE_METADATA_HOST"), "metadata.google.internal")
+		req, err = http.NewRequestWithContext(ctx, "GET", "http://"+host+"/computeMetadata/v1/instance/service-accounts/default/token?scopes="+url.QueryEscape(strings.ReplaceAll(adcScopes, " ", ",")), nil)
+		if req != nil {
+			req.Header.Set("Metadata-Flavor", "Google")
+		}
+	}
+	if err != nil {
+		return "", classify(exitAuth, fmt.Errorf("Application Default Credentials: %w", err))
+	}
+
+	client := newHTTPClient(httpTimeout)
+	if c.Type == "" {
+		// The metadata server is link-local: never send it through a proxy,
+		// and don't hang off Google Cloud
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.Proxy = nil
+		client = &http.Client{Timeout: 5 * time.Second, Transport: transport}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if c.Type == "" {
+			return "", classify(exitAuth, fmt.Errorf("no Application Default Credentials found: run gcloud auth application-default login or set GOOGLE_APPLICATION_CREDENTIALS (metadata server: %v)", err))
+		}
+		return "", classify(exitNetwork, connectionError(req, err))
+	}
+	defer resp.Body.Close()
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+		Error       string `json:"error"`
+		Description string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil || resp.StatusCode != http.StatusOK || tok.AccessToken == "" {
+		detail := cmp.Or(tok.Description, tok.Error, resp.Status)
+		return "", classify(exitAuth, fmt.Errorf("getting an access token from %s: %s", c.source, detail))
+	}
+	c.token = tok.AccessToken
+	c.expiry = time.Now().Add(time.Duration(tok.ExpiresIn) * time.Second)
+	return c.token, nil
+}
+
+func tokenRequest(ctx context.Context, uri string, form url.Values) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", uri, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return req, nil
+}
+
+// jwtAssertion returns the signed JWT a service account exchanges for an
+// access token.
+func (c *adcCredentials) jwtAssertion() (string, error) {
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return "", errors.New("service account private_key is not PEM")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if err != nil || !ok {
+		return "", errors.New("service account private_key is not an RSA key")
+	}
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]any{
+		"iss":   c.ClientEmail,
+		"scope": adcScopes,
+		"aud":   cmp.Or(c.TokenURI, defaultTokenURI),
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	sum := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, sum[:])
+	if err != nil {
+		return "", fmt.Errorf("signing service account token: %w", err)
+	}
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// setAuth authenticates an API request: with the API key by default, or
+// with an OAuth bearer token (and the quota project, if any) under --auth
+// adc.
+func setAuth(req *http.Request, apiKey string) error {
+	if adc == nil {
+		req.Header.Set("x-goog-api-key", apiKey)
+		return nil
+	}
+	token, err := adc.accessToken(req.Context())
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if adc.QuotaProjectID != "" {
+		req.Header.Set("x-goog-user-project", adc.QuotaProjectID)
+	}
+	return nil
+}
+
+// loadCommandConfig loads the config, selects the profile and applies the
+// API base URL for commands that talk to the API.
+func loadCommandConfig(profile string) (*Config, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.selectProfile(profile); err != nil {
+		return nil, err
+	}
+	if err := setAPIBaseURL(cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// resolveBaseURL returns the API base URL, applying precedence:
+// NANOBANANA_API_BASE_URL env > config file > default
+func resolveBaseURL(cfg *Config) (string, error) {
+	raw := os.Getenv("NANOBANANA_API_BASE_URL")
+	if raw == "" {
+		raw = cfg.BaseURL
+	}
+	if raw == "" {
+		return defaultAPIBaseURL, nil
+	}
+	return parseBaseURL(raw)
+}
+
+// parseBaseURL validates an API root and strips any trailing slash.
+func parseBaseURL(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid API base URL %q (must be an http:// or https:// URL)", raw)
+	}
+	return strings.TrimRight(raw, "/"), nil
+}
+
+// setAPIBaseURL resolves and applies the API base URL for this invocation.
+func setAPIBaseURL(cfg *Config) error {
+	base, err := resolveBaseURL(cfg)
+	if err != nil {
+		return err
+	}
+	apiBaseURL = base
+	return nil
+}
+
 // resolveModelFlag returns the model flag value, applying precedence:
-// CLI flag > NANOBANANA_MODEL env > config file > default
+// CLI flag > NANOBANANA_MODEL env > active profile > config file > default
 func resolveModelFlag(flagVal string, cfg *Config) string {
 	if flagVal != "" {
 		return flagVal
 	}
+	if model := cfg.activeProfile().Model; model != "" {
+		return model // a selected profile wins over NANOBANANA_MODEL
+	}
 	if envModel := os.Getenv("NANOBANANA_MODEL"); envModel != "" {
 		return envModel
 	}
@@ -280,8 +978,10 @@ type apiContent struct {
 }
 
 type apiPart struct {
-	Text       string   `json:"text,omitempty"`
-	InlineData *apiBlob `json:"inlineData,omitempty"`
+	Text             string   `json:"text,omitempty"`
+	InlineData       *apiBlob `json:"inlineData,omitempty"`
+	Thought          bool     `json:"thought,omitempty"`
+	ThoughtSignature string   `json:"thoughtSignature,omitempty"`
 }
 
 type apiBlob struct {
@@ -293,6 +993,7 @@ type apiGenerationConfig struct {
 	ResponseMIMEType   string          `json:"responseMimeType,omitempty"`
 	ResponseModalities []string        `json:"responseModalities,omitempty"`
 	ImageConfig        *apiImageConfig `json:"imageConfig,omitempty"`
+	Seed               *int64          `json:"seed,omitempty"`
 }
 
 type apiImageConfig struct {
@@ -300,24 +1001,109 @@ type apiImageConfig struct {
 	ImageSize   string `json:"imageSize,omitempty"`
 }
 
+type apiSafetySetting struct {
+	Category  string `json:"category"`
+	Threshold string `json:"threshold"`
+}
+
 type apiRequest struct {
-	Contents         []apiContent         `json:"contents"`
-	GenerationConfig *apiGenerationConfig `json:"generationConfig,omitempty"`
+	SystemInstruction *apiContent          `json:"systemInstruction,omitempty"`
+	Contents          []apiContent         `json:"contents"`
+	GenerationConfig  *apiGenerationConfig `json:"generationConfig,omitempty"`
+	SafetySettings    []apiSafetySetting   `json:"safetySettings,omitempty"`
+
+	// Raw, from --raw-request, is sent verbatim in place of the fields above.
+	Raw json.RawMessage `json:"-"`
+}
+
+// body returns the JSON sent for the request.
+func (r apiRequest) body() ([]byte, error) {
+	if r.Raw != nil {
+		return r.Raw, nil
+	}
+	return json.Marshal(r)
 }
 
 type apiResponse struct {
-	Candidates []apiCandidate `json:"candidates"`
-	Error      *apiError      `json:"error,omitempty"`
+	Candidates     []apiCandidate     `json:"candidates"`
+	PromptFeedback *apiPromptFeedback `json:"promptFeedback,omitempty"`
+	UsageMetadata  *apiUsage          `json:"usageMetadata,omitempty"`
+	Error          *apiError          `json:"error,omitempty"`
+}
+
+// apiUsage is a response's usageMetadata: the tokens the call was billed for.
+type apiUsage struct {
+	PromptTokens     int `json:"promptTokenCount,omitempty"`
+	CandidatesTokens int `json:"candidatesTokenCount,omitempty"`
+	TotalTokens      int `json:"totalTokenCount,omitempty"`
+}
+
+// add folds another call's counts into u, so a retried prompt reports
+// everything it cost.
+func (u *apiUsage) add(o apiUsage) {
+	u.PromptTokens += o.PromptTokens
+	u.CandidatesTokens += o.CandidatesTokens
+	u.TotalTokens += o.TotalTokens
+}
+
+// tokenUsage is the usage object in --json output.
+type tokenUsage struct {
+	PromptTokens    int `json:"prompt_tokens"`
+	CandidateTokens int `json:"candidate_tokens"`
+	TotalTokens     int `json:"total_tokens"`
+}
+
+// tokens returns u for --json, or nil if the API reported no usage.
+func (u *apiUsage) tokens() *tokenUsage {
+	if u == nil || *u == (apiUsage{}) {
+		return nil
+	}
+	return &tokenUsage{PromptTokens: u.PromptTokens, CandidateTokens: u.CandidatesTokens, TotalTokens: u.TotalTokens}
+}
+
+type apiPromptFeedback struct {
+	BlockReason   string            `json:"blockReason,omitempty"`
+	SafetyRatings []apiSafetyRating `json:"safetyRatings,omitempty"`
 }
 
 type apiCandidate struct {
-	Content apiContent `json:"content"`
+	Content       apiContent        `json:"content"`
+	FinishReason  string            `json:"finishReason,omitempty"`
+	SafetyRatings []apiSafetyRating `json:"safetyRatings,omitempty"`
+}
+
+type apiSafetyRating struct {
+	Category    string `json:"category"`
+	Probability string `json:"probability,omitempty"`
+	Blocked     bool   `json:"blocked,omitempty"`
 }
 
 type apiError struct {
-	Code    int    `json:"code"`
-	Message string `json:"message"`
-	Status  string `json:"status"`
+	Code    int              `json:"code"`
+	Message string           `json:"message"`
+	Status  string           `json:"status"`
+	Details []apiErrorDetail `json:"details,omitempty"`
+}
+
+// apiErrorDetail is one entry of an error's details. Only google.rpc
+// BadRequest entries, which carry field violations, are used.
+type apiErrorDetail struct {
+	Type            string              `json:"@type"`
+	FieldViolations []apiFieldViolation `json:"fieldViolations,omitempty"`
+}
+
+type apiFieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// fieldViolations collects the field violations from an error's details.
+func (e *apiError) fieldViolations() []apiFieldViolation {
+	var out []apiFieldViolation
+	for _, d := range e.Details {
+		out = append(out, d.FieldViolations...)
+	}
+	return out
 }
 
 // --- API client ---
@@ -328,6 +1114,9 @@ func buildGenerationConfig(model, aspect, size string) (*apiGenerationConfig, er
 	}
 
 	if modelSupportsImageSize(model) {
+		if size == "512px" && !modelSupports512Size(model) {
+			return nil, fmt.Errorf("size 512px is only supported by %s", modelFlash)
+		}
 		if size != "1K" {
 			imgCfg.ImageSize = size
 		}
@@ -340,1021 +1129,8080 @@ func buildGenerationConfig(model, aspect, size string) (*apiGenerationConfig, er
 	}, nil
 }
 
-func generateImage(apiKey, model, prompt, aspect, size string) ([]byte, string, error) {
-	genCfg, err := buildGenerationConfig(model, aspect, size)
-	if err != nil {
-		return nil, "", err
-	}
+// genOptions holds per-request generation settings.
+type genOptions struct {
+	Aspect string
+	Size   string
+	Seed   *int64
+	Safety string // --safety level; "" or "default" sends no safetySettings
+	System string // system instruction applied to the prompt
+	// ResponseMIME asks the API for this image type (--response-format)
+	ResponseMIME string
+	// WithText asks for text alongside the image (--with-text); the text
+	// arrives in Reply.
+	WithText bool
+	// TextOnly asks for text and no image (describe); the text arrives in
+	// Reply.
+	TextOnly bool
+
+	History []apiContent  // earlier turns from a --session file
+	Reply   *apiCandidate // if set, receives the candidate that held the image
+	Usage   *apiUsage     // if set, accumulates the token usage of each call
+
+	// Ctx cancels the call early, e.g. when a batch stops; nil means rootCtx
+	Ctx context.Context
+}
 
-	reqBody := apiRequest{
-		Contents: []apiContent{
-			{
-				Parts: []apiPart{
-					{Text: prompt},
-				},
-			},
-		},
-		GenerationConfig: genCfg,
+// context returns the context the call derives from.
+func (o genOptions) context() context.Context {
+	if o.Ctx != nil {
+		return o.Ctx
 	}
+	return rootCtx
+}
 
-	return doAPICall(apiKey, model, reqBody)
+// harmCategories are the categories --safety adjusts.
+var harmCategories = []string{
+	"HARM_CATEGORY_HARASSMENT",
+	"HARM_CATEGORY_HATE_SPEECH",
+	"HARM_CATEGORY_SEXUALLY_EXPLICIT",
+	"HARM_CATEGORY_DANGEROUS_CONTENT",
 }
 
-func editImage(apiKey, model, prompt string, imgData []byte, mimeType, aspect, size string) ([]byte, string, error) {
-	genCfg, err := buildGenerationConfig(model, aspect, size)
-	if err != nil {
-		return nil, "", err
+// safetyThresholds maps --safety levels to a blocking threshold applied to
+// every harm category. "default" leaves the API's own thresholds in place.
+var safetyThresholds = map[string]string{
+	"default": "",
+	"relaxed": "BLOCK_ONLY_HIGH",
+	"strict":  "BLOCK_LOW_AND_ABOVE",
+}
+
+// safetySettings returns the safetySettings block for a --safety level.
+func safetySettings(level string) ([]apiSafetySetting, error) {
+	if level == "" {
+		return nil, nil
 	}
-	b64 := base64.StdEncoding.EncodeToString(imgData)
-
-	reqBody := apiRequest{
-		Contents: []apiContent{
-			{
-				Parts: []apiPart{
-					{Text: prompt},
-					{
-						InlineData: &apiBlob{
-							MIMEType: mimeType,
-							Data:     b64,
-						},
-					},
-				},
-			},
-		},
-		GenerationConfig: genCfg,
+	threshold, ok := safetyThresholds[level]
+	if !ok {
+		return nil, fmt.Errorf("invalid safety level %q (valid: default, relaxed, strict)", level)
+	}
+	if threshold == "" {
+		return nil, nil
+	}
+	settings := make([]apiSafetySetting, len(harmCategories))
+	for i, c := range harmCategories {
+		settings[i] = apiSafetySetting{Category: c, Threshold: threshold}
 	}
+	return settings, nil
+}
 
-	return doAPICall(apiKey, model, reqBody)
+// safetyFinishReasons are candidate finish reasons that mean the output
+// was withheld by a content filter.
+var safetyFinishReasons = map[string]bool{
+	"SAFETY":             true,
+	"IMAGE_SAFETY":       true,
+	"PROHIBITED_CONTENT": true,
+	"BLOCKLIST":          true,
+	"SPII":               true,
 }
 
-func doAPICall(apiKey, model string, reqBody apiRequest) ([]byte, string, error) {
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return nil, "", fmt.Errorf("marshaling request: %w", err)
+// blockedCategories names the harm categories behind a block: those the
+// API flagged as blocked, else any rated HIGH or MEDIUM.
+func blockedCategories(ratings []apiSafetyRating) []string {
+	var blocked, likely []string
+	for _, r := range ratings {
+		switch {
+		case r.Blocked:
+			blocked = append(blocked, r.Category)
+		case r.Probability == "HIGH" || r.Probability == "MEDIUM":
+			likely = append(likely, r.Category)
+		}
 	}
+	if len(blocked) > 0 {
+		return blocked
+	}
+	return likely
+}
 
-	url := fmt.Sprintf("%s/%s:generateContent", apiBaseURL, model)
-	req, err := http.NewRequest("POST", url, bytes.NewReader(jsonData))
-	if err != nil {
-		return nil, "", fmt.Errorf("creating request: %w", err)
+// blockReason formats a block or finish reason with its harm categories,
+// e.g. "SAFETY (category HARM_CATEGORY_DANGEROUS_CONTENT)".
+func blockReason(reason string, ratings []apiSafetyRating) string {
+	if cats := blockedCategories(ratings); len(cats) > 0 {
+		return fmt.Sprintf("%s (category %s)", reason, strings.Join(cats, ", "))
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("x-goog-api-key", apiKey)
+	return reason
+}
 
-	client := &http.Client{Timeout: httpTimeout}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, "", fmt.Errorf("could not reach API. Check your internet connection")
-	}
-	defer resp.Body.Close()
+// blockedError marks a reply withheld by a content filter, so batches can
+// count blocks apart from other failures.
+type blockedError struct {
+	Err error
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, "", fmt.Errorf("reading response: %w", err)
-	}
+func (e *blockedError) Error() string { return e.Err.Error() }
+func (e *blockedError) Unwrap() error { return e.Err }
 
-	// Handle HTTP error codes
-	switch {
-	case resp.StatusCode == 401 || resp.StatusCode == 403:
-		return nil, "", fmt.Errorf("authentication failed. Check your API key: nanobanana setup")
-	case resp.StatusCode == 429:
-		return nil, "", fmt.Errorf("rate limit exceeded. Wait and try again")
-	case resp.StatusCode == 400:
-		var apiResp apiResponse
-		if err := json.Unmarshal(body, &apiResp); err == nil && apiResp.Error != nil {
-			return nil, "", fmt.Errorf("API error: %s", apiResp.Error.Message)
+// isBlocked reports whether err is a safety or recitation block.
+func isBlocked(err error) bool {
+	var be *blockedError
+	return errors.As(err, &be)
+}
+
+// noOutputError explains why a response carried no image (or, for
+// describe, no text): a blocked prompt, a blocked or cut-short candidate,
+// or (as a last resort) the generic "no image" message with any text the
+// model returned.
+func noOutputError(resp apiResponse, want string) error {
+	if fb := resp.PromptFeedback; fb != nil && fb.BlockReason != "" {
+		return &blockedError{fmt.Errorf("prompt blocked: %s. Try rephrasing, or --safety relaxed", blockReason(fb.BlockReason, fb.SafetyRatings))}
+	}
+	if len(resp.Candidates) == 0 {
+		return fmt.Errorf("no %s in API response: it held no candidates", want)
+	}
+	var text string
+	for _, c := range resp.Candidates {
+		switch {
+		case safetyFinishReasons[c.FinishReason]:
+			return &blockedError{fmt.Errorf("blocked: %s. Try rephrasing, or --safety relaxed", blockReason(c.FinishReason, c.SafetyRatings))}
+		case c.FinishReason == "RECITATION":
+			return &blockedError{fmt.Errorf("blocked: RECITATION (output too close to existing content). Try rephrasing")}
+		case c.FinishReason != "" && c.FinishReason != "STOP":
+			return fmt.Errorf("generation stopped: %s", c.FinishReason)
 		}
-		return nil, "", fmt.Errorf("bad request (400)")
-	case resp.StatusCode != 200:
-		var apiResp apiResponse
-		if err := json.Unmarshal(body, &apiResp); err == nil && apiResp.Error != nil {
-			return nil, "", fmt.Errorf("API error (%d): %s", resp.StatusCode, apiResp.Error.Message)
+		for _, p := range c.Content.Parts {
+			if text == "" && p.InlineData == nil {
+				text = strings.TrimSpace(p.Text)
+			}
 		}
-		return nil, "", fmt.Errorf("API error (%d)", resp.StatusCode)
 	}
-
-	var apiResp apiResponse
-	if err := json.Unmarshal(body, &apiResp); err != nil {
-		return nil, "", fmt.Errorf("parsing response: %w", err)
+	if text != "" {
+		if r := []rune(text); len(r) > 200 {
+			text = string(r[:200]) + "..."
+		}
+		return fmt.Errorf("no %s in API response (model replied: %q)", want, text)
 	}
+	return fmt.Errorf("no %s in API response", want)
+}
 
-	if apiResp.Error != nil {
-		return nil, "", fmt.Errorf("API error: %s", apiResp.Error.Message)
+// generationConfig builds the API generationConfig for opts.
+func (o genOptions) generationConfig(model string) (*apiGenerationConfig, error) {
+	if o.TextOnly {
+		return &apiGenerationConfig{ResponseModalities: []string{"TEXT"}}, nil
 	}
+	genCfg, err := buildGenerationConfig(model, o.Aspect, o.Size)
+	if err != nil {
+		return nil, err
+	}
+	genCfg.Seed = o.Seed
+	genCfg.ResponseMIMEType = o.ResponseMIME
+	if o.WithText {
+		genCfg.ResponseModalities = []string{"IMAGE", "TEXT"}
+	}
+	return genCfg, nil
+}
 
-	// Extract image from response (matches official extension logic)
-	for _, candidate := range apiResp.Candidates {
-		for _, part := range candidate.Content.Parts {
-			// Primary: image in inlineData
-			if part.InlineData != nil && part.InlineData.Data != "" {
-				imgBytes, err := base64.StdEncoding.DecodeString(part.InlineData.Data)
-				if err != nil {
-					return nil, "", fmt.Errorf("decoding image: %w", err)
-				}
-				mime := part.InlineData.MIMEType
-				if mime == "" {
-					mime = "image/png"
-				}
-				return imgBytes, mime, nil
-			}
-			// Fallback: base64 image data in text field
-			if part.Text != "" && len(part.Text) >= 1000 && isBase64Image(part.Text) {
-				imgBytes, err := base64.StdEncoding.DecodeString(part.Text)
-				if err != nil {
-					continue
-				}
-				return imgBytes, "image/png", nil
-			}
+// replyText joins the text parts of a reply, leaving out thoughts.
+func replyText(reply *apiCandidate) string {
+	if reply == nil {
+		return ""
+	}
+	var texts []string
+	for _, p := range reply.Content.Parts {
+		if t := strings.TrimSpace(p.Text); t != "" && !p.Thought && p.InlineData == nil {
+			texts = append(texts, t)
 		}
 	}
-
-	return nil, "", fmt.Errorf("no image in API response")
+	return strings.Join(texts, "\n")
 }
 
-var base64Re = regexp.MustCompile(`^[A-Za-z0-9+/]*={0,2}$`)
-
-func isBase64Image(s string) bool {
-	return base64Re.MatchString(s)
+func generateImage(apiKey, model, prompt string, opts genOptions) ([]byte, string, error) {
+	reqBody, err := buildRequest(model, prompt, nil, opts)
+	if err != nil {
+		return nil, "", err
+	}
+	return doAPICall(opts.context(), apiKey, model, reqBody, opts.Reply, opts.Usage)
 }
 
-// --- Image I/O ---
+// inputImage is a source image sent alongside the prompt in edit requests.
+type inputImage struct {
+	Data     []byte
+	MIMEType string
+}
 
-func readImage(path string) ([]byte, string, error) {
-	var data []byte
-	var err error
-	if path == "-" {
-		data, err = io.ReadAll(os.Stdin)
-		if err != nil {
-			return nil, "", fmt.Errorf("reading stdin: %w", err)
-		}
-	} else {
-		data, err = os.ReadFile(path)
-		if err != nil {
-			return nil, "", fmt.Errorf("reading image: %w", err)
-		}
+func editImage(apiKey, model, prompt string, images []inputImage, opts genOptions) ([]byte, string, error) {
+	reqBody, err := buildRequest(model, prompt, images, opts)
+	if err != nil {
+		return nil, "", err
 	}
-
-	mimeType := detectMIMEType(path, data)
-	return data, mimeType, nil
+	return doAPICall(opts.context(), apiKey, model, reqBody, opts.Reply, opts.Usage)
 }
 
-func detectMIMEType(path string, data []byte) string {
-	if path != "-" {
-		ext := strings.ToLower(filepath.Ext(path))
-		switch ext {
-		case ".png":
-			return "image/png"
-		case ".jpg", ".jpeg":
-			return "image/jpeg"
-		case ".gif":
-			return "image/gif"
-		case ".webp":
-			return "image/webp"
-		}
+// maskInstruction is appended to the prompt when edit sends a --mask.
+const maskInstruction = "The last image is a mask for the first image. Edit only the region that is white in the mask and keep everything under the black region exactly as it is."
+
+// readMask reads a --mask image and checks that it matches the size of
+// the image it masks. Sources Go can't decode (WebP) skip the check.
+func readMask(path string, source inputImage) (inputImage, error) {
+	data, mimeType, err := readImage(path)
+	if err != nil {
+		return inputImage{}, err
 	}
-	// Fallback to content detection (always used for stdin)
-	ct := http.DetectContentType(data)
-	if strings.HasPrefix(ct, "image/") {
-		return ct
+	mask, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return inputImage{}, fmt.Errorf("reading mask %s: %w", path, err)
 	}
-	return "image/png"
+	src, _, err := image.DecodeConfig(bytes.NewReader(source.Data))
+	if err != nil {
+		warn("could not read the source image size; not checking the mask against it")
+	} else if mask.Width != src.Width || mask.Height != src.Height {
+		return inputImage{}, fmt.Errorf("mask %s is %dx%d but the image is %dx%d", path, mask.Width, mask.Height, src.Width, src.Height)
+	}
+	return inputImage{Data: data, MIMEType: mimeType}, nil
 }
 
-func writeImage(path string, data []byte, sourceMIME string) error {
-	ext := strings.ToLower(filepath.Ext(path))
-
-	// If the output extension matches the source MIME, write raw bytes
-	if (ext == ".png" && sourceMIME == "image/png") ||
-		(ext == ".jpg" && sourceMIME == "image/jpeg") ||
-		(ext == ".jpeg" && sourceMIME == "image/jpeg") {
-		return os.WriteFile(path, data, 0644)
+// userContent is the prompt text followed by any input images.
+func userContent(prompt string, images []inputImage) apiContent {
+	parts := []apiPart{{Text: prompt}}
+	for _, img := range images {
+		parts = append(parts, apiPart{
+			InlineData: &apiBlob{
+				MIMEType: img.MIMEType,
+				Data:     base64.StdEncoding.EncodeToString(img.Data),
+			},
+		})
 	}
+	return apiContent{Parts: parts}
+}
 
-	// Need to transcode
-	img, _, err := image.Decode(bytes.NewReader(data))
+// buildRequest assembles a generateContent request: the prompt text, any
+// input images as inline data, and image controls in generationConfig.
+func buildRequest(model, prompt string, images []inputImage, opts genOptions) (apiRequest, error) {
+	genCfg, err := opts.generationConfig(model)
 	if err != nil {
-		// If we can't decode, just write raw bytes
-		return os.WriteFile(path, data, 0644)
+		return apiRequest{}, err
 	}
 
-	f, err := os.Create(path)
+	safety, err := safetySettings(opts.Safety)
 	if err != nil {
-		return err
+		return apiRequest{}, err
 	}
-	defer f.Close()
 
-	switch ext {
-	case ".jpg", ".jpeg":
-		return jpeg.Encode(f, img, &jpeg.Options{Quality: 95})
-	case ".png":
-		return png.Encode(f, img)
-	default:
-		// Default to PNG
-		return png.Encode(f, img)
+	turn := userContent(prompt, images)
+	contents := []apiContent{turn}
+	if len(opts.History) > 0 {
+		turn.Role = "user"
+		contents = append(slices.Clone(opts.History), turn)
 	}
-}
 
-func extForMIME(mime string) string {
-	switch mime {
-	case "image/jpeg":
-		return ".jpg"
-	case "image/gif":
-		return ".gif"
-	case "image/webp":
-		return ".webp"
-	default:
-		return ".png"
+	req := apiRequest{
+		Contents:         contents,
+		GenerationConfig: genCfg,
+		SafetySettings:   safety,
+	}
+	if opts.System != "" {
+		req.SystemInstruction = &apiContent{Parts: []apiPart{{Text: opts.System}}}
 	}
+	return req, nil
 }
 
-func autoName(prefix, mime string) string {
-	ts := time.Now().Format("20060102_150405")
-	return fmt.Sprintf("%s_%s%s", prefix, ts, extForMIME(mime))
+// badRequestError is a 400 response; Status is the API's error status,
+// e.g. INVALID_ARGUMENT, and Violations names the fields it objected to.
+type badRequestError struct {
+	Status     string
+	Message    string
+	Violations []apiFieldViolation
 }
 
-// --- Output helpers ---
-
-func success(format string, args ...any) {
-	if !quiet {
-		fmt.Fprintf(os.Stderr, colorGreen+"✓ "+colorReset+format+"\n", args...)
+func (e *badRequestError) Error() string {
+	msg := "bad request (400)"
+	if e.Message != "" {
+		msg = "API error: " + e.Message
 	}
+	for _, v := range e.Violations {
+		line := cmp.Or(v.Field, "request")
+		if v.Description != "" {
+			line += ": " + v.Description
+		}
+		if hint := fieldHint(v.Field); hint != "" {
+			line += " (" + hint + ")"
+		}
+		msg += "\n  " + line
+	}
+	return msg
 }
 
-func info(format string, args ...any) {
-	if !quiet {
-		fmt.Fprintf(os.Stderr, colorBlue+"→ "+colorReset+format+"\n", args...)
-	}
+// fieldHints maps request fields the API may reject to the flag that sets
+// them, matched case-insensitively against the violation's field path with
+// underscores removed.
+var fieldHints = []struct {
+	field, hint string
+}{
+	{"aspectratio", "check --aspect; nanobanana models lists each model's ratios"},
+	{"imagesize", "check --size; nanobanana models lists each model's sizes"},
+	{"responsemimetype", "check --response-format"},
+	{"responsemodalities", "--with-text may not be supported by this model"},
+	{"seed", "check --seed"},
+	{"safetysettings", "check --safety"},
+	{"systeminstruction", "check --system or system in config"},
+	{"inlinedata", "check the input images"},
+	{"contents", "check the prompt and input images"},
 }
 
-func warn(format string, args ...any) {
-	if !quiet {
-		fmt.Fprintf(os.Stderr, colorYellow+"⚠ "+colorReset+format+"\n", args...)
+// fieldHint suggests the flag behind a rejected request field.
+func fieldHint(field string) string {
+	key := strings.ToLower(strings.ReplaceAll(field, "_", ""))
+	for _, h := range fieldHints {
+		if strings.Contains(key, h.field) {
+			return h.hint
+		}
 	}
+	return ""
 }
 
-func errorf(format string, args ...any) {
-	fmt.Fprintf(os.Stderr, colorRed+"✗ "+colorReset+format+"\n", args...)
+// isInvalidArgument reports whether err is a 400 INVALID_ARGUMENT rejection.
+func isInvalidArgument(err error) bool {
+	var bad *badRequestError
+	return errors.As(err, &bad) && bad.Status == "INVALID_ARGUMENT"
 }
 
-// --- Spinner ---
-
-func startSpinner(msg string) func() {
-	if quiet || !term.IsTerminal(int(os.Stderr.Fd())) {
-		if !quiet {
-			fmt.Fprintf(os.Stderr, "%s...\n", msg)
-		}
-		return func() {}
-	}
+// Exit codes by failure class, so scripts can tell a bad key from a rate
+// limit. Anything unclassified (usage, validation) exits with 1.
+const (
+	exitError      = 1
+	exitAuth       = 2
+	exitRateLimit  = 3
+	exitBadRequest = 4
+	exitNetwork    = 5
+	exitIO         = 6
+	exitBlocked    = 7
+	exitHook       = 8
+)
 
-	frames := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
-	var mu sync.Mutex
-	done := false
+// classifiedError tags an error with the exit code it should produce.
+type classifiedError struct {
+	Code int
+	Err  error
+}
 
-	go func() {
-		i := 0
-		for {
-			mu.Lock()
-			if done {
-				mu.Unlock()
-				return
-			}
-			mu.Unlock()
+func (e *classifiedError) Error() string { return e.Err.Error() }
+func (e *classifiedError) Unwrap() error { return e.Err }
 
-			fmt.Fprintf(os.Stderr, "\r%s%s%s %s", colorCyan, frames[i%len(frames)], colorReset, msg)
-			i++
-			time.Sleep(80 * time.Millisecond)
-		}
-	}()
+// classify wraps err so exitCode maps it to code.
+func classify(code int, err error) error {
+	return &classifiedError{Code: code, Err: err}
+}
 
-	return func() {
-		mu.Lock()
-		done = true
-		mu.Unlock()
-		fmt.Fprintf(os.Stderr, "\r\033[K") // Clear line
+// exitCode returns the exit status for a command that failed with err.
+func exitCode(err error) int {
+	var ce *classifiedError
+	var bre *badRequestError
+	switch {
+	case errors.Is(err, errCanceled):
+		return exitCanceled
+	case errors.As(err, &ce):
+		return ce.Code
+	case errors.As(err, &bre):
+		return exitBadRequest
+	case isBlocked(err):
+		return exitBlocked
 	}
+	return exitError
 }
 
-// --- JSON output ---
+// errStreamUnavailable marks a --stream request the server turned away
+// without running it (no streaming endpoint), so the non-streaming endpoint
+// can be tried without generating, or billing, the image twice.
+var errStreamUnavailable = errors.New("streaming unavailable")
 
-type jsonResult struct {
-	File   string `json:"file"`
-	Model  string `json:"model"`
-	Prompt string `json:"prompt"`
-	Bytes  int    `json:"bytes"`
-}
+// rootCtx is canceled by Ctrl-C; every API call derives its context from it.
+var rootCtx = context.Background()
 
-// --- Preview ---
+// apiTimeout caps each API call including retries and backoff (--timeout).
+// Zero leaves only the HTTP client's per-request timeout.
+var apiTimeout time.Duration
 
-func openFile(path string) error {
-	var cmd string
-	switch runtime.GOOS {
-	case "darwin":
-		cmd = "open"
-	case "windows":
-		cmd = "start"
-	default:
-		cmd = "xdg-open"
+// attemptTimeout caps each attempt of an API call (--timeout-per-retry);
+// an attempt that runs out is retried like a server error. Zero leaves
+// only the HTTP client's per-request timeout.
+var attemptTimeout time.Duration
+
+// apiCalls counts API calls in flight; Ctrl-C with none running exits
+// straight away instead of waiting for a call to notice.
+var apiCalls atomic.Int32
+
+// errCanceled is returned by API calls interrupted with Ctrl-C.
+var errCanceled = errors.New("canceled")
+
+// exitCanceled is the exit status after Ctrl-C, matching shells' 128+SIGINT.
+const exitCanceled = 130
+
+// ctxError explains why an API call's context ended.
+func ctxError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return classify(exitNetwork, fmt.Errorf("request timed out after %s (raise --timeout)", apiTimeout))
 	}
-	return exec.Command(cmd, path).Start()
+	return errCanceled
 }
 
-// --- Validation ---
+func doAPICall(parent context.Context, apiKey, model string, reqBody apiRequest, reply *apiCandidate, usage *apiUsage) ([]byte, string, error) {
+	if mockAPI {
+		return mockAPICall(reqBody, reply)
+	}
+	apiCalls.Add(1)
+	defer apiCalls.Add(-1)
 
-func validateAspectRatio(ar, model string) error {
-	validSet := validAspectRatios
-	if isProModel(model) || isLegacyModel(model) {
-		validSet = validAspectRatiosProLegacy
+	ctx, cancel := context.WithCancel(parent)
+	if apiTimeout > 0 {
+		ctx, cancel = context.WithTimeout(parent, apiTimeout)
 	}
+	defer cancel()
 
-	if !validSet[ar] {
-		valid := make([]string, 0, len(validSet))
-		for k := range validSet {
-			valid = append(valid, k)
+	if streamResponses {
+		data, mime, err := callAPI(ctx, apiKey, model, reqBody, reply, usage, true)
+		if !errors.Is(err, errStreamUnavailable) {
+			return data, mime, err
 		}
-		return fmt.Errorf("invalid aspect ratio %q (valid: %s)", ar, strings.Join(valid, ", "))
+		debugf("%v; falling back to generateContent", err)
+		updateSpinner("Streaming unavailable, retrying without --stream...")
 	}
-	return nil
+	return callAPI(ctx, apiKey, model, reqBody, reply, usage, false)
 }
 
-func validateImageSize(size, model string) error {
-	if _, ok := validSizes[size]; !ok {
-		valid := make([]string, 0, len(validSizes))
-		for k := range validSizes {
-			valid = append(valid, k)
-		}
-		return fmt.Errorf("invalid size %q (valid: %s)", size, strings.Join(valid, ", "))
-	}
-	if !modelSupportsImageSize(model) && size != "1K" {
-		return fmt.Errorf("model %q supports only --size 1K", model)
-	}
-	if size == "512px" && !modelSupports512Size(model) {
-		return fmt.Errorf("size 512px is only supported by %s", modelFlash)
+func callAPI(ctx context.Context, apiKey, model string, reqBody apiRequest, reply *apiCandidate, usage *apiUsage, stream bool) ([]byte, string, error) {
+	jsonData, err := reqBody.body()
+	if err != nil {
+		return nil, "", fmt.Errorf("marshaling request: %w", err)
 	}
-	return nil
-}
 
-// isProModel returns true if the model string refers to the pro model,
-// whether by alias or full model name.
-func isProModel(model string) bool {
-	return model == "pro" || model == modelPro
-}
+	url := fmt.Sprintf("%s/v1beta/models/%s:generateContent", apiBaseURL, model)
+	if stream {
+		url = fmt.Sprintf("%s/v1beta/models/%s:streamGenerateContent?alt=sse", apiBaseURL, model)
+	}
+	client := sharedHTTPClient()
 
-func isLegacyModel(model string) bool {
-	return model == "legacy" || model == modelLegacy
-}
+	var resp *http.Response
+	var body []byte
+	attempts := 0
+	for {
+		attempts++
+		// Queueing behind --rps or a 429 hold isn't part of the attempt
+		if err := waitForRateLimit(ctx); err != nil {
+			return nil, "", ctxError(ctx)
+		}
+		if err := throttle(ctx); err != nil {
+			return nil, "", ctxError(ctx)
+		}
 
-func modelSupportsImageSize(model string) bool {
-	return !isLegacyModel(model)
-}
+		// --timeout-per-retry abandons one slow attempt; ctx, from --timeout,
+		// still caps the run as a whole
+		attemptCtx, cancelAttempt := ctx, context.CancelFunc(func() {})
+		if attemptTimeout > 0 {
+			attemptCtx, cancelAttempt = context.WithTimeout(ctx, attemptTimeout)
+		}
+		req, err := http.NewRequestWithContext(attemptCtx, "POST", url, bytes.NewReader(jsonData))
+		if err != nil {
+			cancelAttempt()
+			return nil, "", fmt.Errorf("creating request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if err := setAuth(req, apiKey); err != nil {
+			cancelAttempt()
+			return nil, "", err
+		}
+		if attempts == 1 {
+			logRequest(req, reqBody)
+			saveRequest(reqBody)
+		}
+		resp, err = client.Do(req)
+		if err == nil {
+			var r io.Reader = resp.Body
+			if stream && resp.StatusCode == 200 {
+				r = &progressReader{r: resp.Body}
+			}
+			body, err = io.ReadAll(r)
+			resp.Body.Close()
+			if err != nil {
+				err = fmt.Errorf("reading response: %w", err)
+			}
+		}
+		attemptTimedOut := attemptCtx.Err() != nil && ctx.Err() == nil
+		cancelAttempt()
+		if err != nil {
+			debugf("Request failed: %v", err)
+			switch {
+			case ctx.Err() != nil:
+				return nil, "", ctxError(ctx)
+			case attemptTimedOut && attempts > maxRetries:
+				return nil, "", classify(exitNetwork, fmt.Errorf("request timed out: %d attempts of %s each (raise --timeout-per-retry or --retries)", attempts, attemptTimeout))
+			case attemptTimedOut:
+				if err := pauseBeforeRetry(ctx, attempts, retryDelay(attempts-1, "", retryMaxWait), fmt.Sprintf("attempt timed out after %s", attemptTimeout)); err != nil {
+					return nil, "", err
+				}
+				continue
+			case resp != nil:
+				return nil, "", classify(exitNetwork, err)
+			}
+			return nil, "", classify(exitNetwork, connectionError(req, err))
+		}
+		logResponse(resp, body)
+		saveResponse(body)
 
-func modelSupports512Size(model string) bool {
-	return model == "flash" || model == modelFlash
-}
+		// A 200 whose body doesn't parse was usually cut off in transit
+		corrupt := resp.StatusCode == 200 && !validBody(body, stream)
+		if (!isRetryableStatus(resp.StatusCode) && !corrupt) || attempts > maxRetries {
+			break
+		}
+		reason := "rate limit"
+		switch {
+		case corrupt:
+			reason = "corrupt response"
+			debugf("Response does not parse (%d bytes); retrying", len(body))
+		case resp.StatusCode != 429:
+			reason = fmt.Sprintf("server error %d", resp.StatusCode)
+		}
+		wait := retryDelay(attempts-1, resp.Header.Get("Retry-After"), retryMaxWait)
+		if resp.StatusCode == 429 {
+			holdRequests(wait)
+		}
+		if err := pauseBeforeRetry(ctx, attempts, wait, reason); err != nil {
+			return nil, "", err
+		}
+	}
 
-// resolveModel maps an alias to a full model name, or passes through
-// a full model name directly.
-func resolveModel(alias string) (string, error) {
-	if full, ok := modelAliases[alias]; ok {
-		return full, nil
+	// Only a missing endpoint falls back; anything else, such as a server
+	// error, already had its retries and would be a second, billed request
+	if stream {
+		switch resp.StatusCode {
+		case 404, 405, 501:
+			return nil, "", fmt.Errorf("%w: streamGenerateContent returned %d", errStreamUnavailable, resp.StatusCode)
+		}
 	}
-	// Accept full model names (anything containing a hyphen)
-	if strings.Contains(alias, "-") {
-		return alias, nil
+
+	attemptNote := ""
+	if attempts > 1 {
+		attemptNote = fmt.Sprintf(" after %d attempts", attempts)
 	}
-	return "", fmt.Errorf("unknown model %q (valid: flash, pro, legacy, or a full model name)", alias)
-}
+
+	// Handle HTTP error codes
+	switch {
+	case resp.StatusCode == 401 || resp.StatusCode == 403:
+		return nil, "", classify(exitAuth, fmt.Errorf("authentication failed. Check your API key: nanobanana setup"))
+	case resp.StatusCode == 429:
+		return nil, "", classify(exitRateLimit, fmt.Errorf("rate limit exceeded%s. Wait and try again", attemptNote))
+	case resp.StatusCode == 400:
+		var apiResp apiResponse
+		if err := json.Unmarshal(body, &apiResp); err == nil && apiResp.Error != nil {
+			return nil, "", &badRequestError{Status: apiResp.Error.Status, Message: apiResp.Error.Message, Violations: apiResp.Error.fieldViolations()}
+		}
+		return nil, "", &badRequestError{}
+	case resp.StatusCode != 200:
+		var apiResp apiResponse
+		if err := json.Unmarshal(body, &apiResp); err == nil && apiResp.Error != nil {
+			return nil, "", fmt.Errorf("API error (%d)%s: %s", resp.StatusCode, attemptNote, apiResp.Error.Message)
+		}
+		return nil, "", fmt.Errorf("API error (%d)%s", resp.StatusCode, attemptNote)
+	}
+
+	var apiResp apiResponse
+	if stream {
+		if apiResp, err = parseStream(body); err != nil {
+			return nil, "", fmt.Errorf("parsing stream%s: %w (%d bytes, starting %q)", attemptNote, err, len(body), bodyExcerpt(body))
+		}
+	} else if !json.Valid(body) {
+		return nil, "", fmt.Errorf("parsing response%s: malformed or truncated JSON (%d bytes, starting %q)", attemptNote, len(body), bodyExcerpt(body))
+	} else if err := json.Unmarshal(body, &apiResp); err != nil {
+		return nil, "", fmt.Errorf("unexpected API response shape: %w (starting %q)", err, bodyExcerpt(body))
+	}
+
+	if apiResp.Error != nil {
+		return nil, "", fmt.Errorf("API error: %s", apiResp.Error.Message)
+	}
+	if usage != nil && apiResp.UsageMetadata != nil {
+		usage.add(*apiResp.UsageMetadata)
+	}
+
+	// A text-only request (describe) wants the first candidate with text
+	if gc := reqBody.GenerationConfig; gc != nil && slices.Equal(gc.ResponseModalities, []string{"TEXT"}) {
+		for _, candidate := range apiResp.Candidates {
+			if replyText(&candidate) == "" {
+				continue
+			}
+			if reply != nil {
+				*reply = candidate
+			}
+			return nil, "", nil
+		}
+		return nil, "", noOutputError(apiResp, "text")
+	}
+
+	// The first candidate holding an image wins
+	for _, candidate := range apiResp.Candidates {
+		images, err := candidateImages(candidate)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(images) == 0 {
+			continue
+		}
+		if len(images) > 1 {
+			debugf("Reply holds %d images; only the first is saved without --all-parts", len(images))
+		}
+		if reply != nil {
+			*reply = candidate
+			reply.Content.Role = "model"
+		}
+		return images[0].Data, images[0].MIMEType, nil
+	}
+
+	return nil, "", noOutputError(apiResp, "image")
+}
+
+// validBody reports whether a 200 response body parses: one JSON document,
+// or for --stream a server-sent event stream of them.
+func validBody(body []byte, stream bool) bool {
+	if stream {
+		_, err := parseStream(body)
+		return err == nil
+	}
+	return json.Valid(body)
+}
+
+// mockAPI is set by --mock or NANOBANANA_MOCK: API calls are answered
+// locally by mockAPICall, so scripts can be tested without a key or cost.
+var mockAPI bool
+
+// envMock reads NANOBANANA_MOCK as a boolean, so NANOBANANA_MOCK=0 leaves
+// mock mode off. Unset counts as false.
+func envMock() (bool, error) {
+	v := os.Getenv("NANOBANANA_MOCK")
+	if v == "" {
+		return false, nil
+	}
+	on, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("invalid NANOBANANA_MOCK %q (want true or false)", v)
+	}
+	return on, nil
+}
+
+// mockSize is the long side of a --mock image in pixels.
+const mockSize = 64
+
+// mockAPICall stands in for the API under --mock. It returns a small
+// image in the requested aspect ratio, filled with a color derived from
+// the prompt so the same prompt always gives the same bytes, or a fixed
+// description for a text-only request. Nothing goes over the network.
+func mockAPICall(reqBody apiRequest, reply *apiCandidate) ([]byte, string, error) {
+	if reqBody.Raw != nil {
+		json.Unmarshal(reqBody.Raw, &reqBody)
+	}
+	prompt := requestText(reqBody)
+	gc := reqBody.GenerationConfig
+	if gc == nil {
+		gc = &apiGenerationConfig{}
+	}
+	text := "Mock reply from nanobanana --mock; the API was not called."
+	if slices.Equal(gc.ResponseModalities, []string{"TEXT"}) {
+		if reply != nil {
+			*reply = apiCandidate{Content: apiContent{Role: "model", Parts: []apiPart{{Text: text}}}, FinishReason: "STOP"}
+		}
+		return nil, "", nil
+	}
+
+	w, h := mockSize, mockSize
+	if gc.ImageConfig != nil {
+		if rw, rh, ok := parseRatio(gc.ImageConfig.AspectRatio); ok {
+			if rw >= rh {
+				h = max(1, int(math.Round(mockSize*rh/rw)))
+			} else {
+				w = max(1, int(math.Round(mockSize*rw/rh)))
+			}
+		}
+	}
+	sum := sha256.Sum256([]byte(prompt))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{sum[0], sum[1], sum[2], 255}}, image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+	mimeType := "image/png"
+	var err error
+	if gc.ResponseMIMEType == "image/jpeg" {
+		mimeType = "image/jpeg"
+		err = jpeg.Encode(&buf, img, nil)
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, "", fmt.Errorf("--mock: encoding image: %w", err)
+	}
+	debugf("--mock: returning a %dx%d %s instead of calling the API", w, h, mimeType)
+	if reply != nil {
+		parts := []apiPart{{InlineData: &apiBlob{MIMEType: mimeType, Data: base64.StdEncoding.EncodeToString(buf.Bytes())}}}
+		if slices.Contains(gc.ResponseModalities, "TEXT") {
+			parts = append(parts, apiPart{Text: text})
+		}
+		*reply = apiCandidate{Content: apiContent{Role: "model", Parts: parts}, FinishReason: "STOP"}
+	}
+	return buf.Bytes(), mimeType, nil
+}
+
+// pauseBeforeRetry shows why an API call is being retried and waits out
+// the backoff, unless ctx ends first.
+func pauseBeforeRetry(ctx context.Context, attempts int, wait time.Duration, reason string) error {
+	updateSpinner(fmt.Sprintf("Retrying (%d/%d) after %s...", attempts, maxRetries, reason))
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctxError(ctx)
+	}
+}
+
+// maxBodyExcerpt is how much of an unparseable response errors quote.
+const maxBodyExcerpt = 120
+
+// bodyExcerpt returns the start of a response body for an error message.
+func bodyExcerpt(body []byte) string {
+	if len(body) > maxBodyExcerpt {
+		return string(body[:maxBodyExcerpt]) + "..."
+	}
+	return string(body)
+}
+
+// outputImage is one image returned by the API.
+type outputImage struct {
+	Data     []byte
+	MIMEType string
+}
+
+// candidateImages returns every image in a candidate, in order (matches
+// the official extension's extraction logic).
+func candidateImages(candidate apiCandidate) ([]outputImage, error) {
+	var images []outputImage
+	for _, part := range candidate.Content.Parts {
+		// Primary: image in inlineData
+		if part.InlineData != nil && part.InlineData.Data != "" {
+			imgBytes, err := base64.StdEncoding.DecodeString(part.InlineData.Data)
+			if err != nil {
+				return nil, fmt.Errorf("decoding image: %w", err)
+			}
+			images = append(images, outputImage{imgBytes, cmp.Or(part.InlineData.MIMEType, "image/png")})
+			continue
+		}
+		// Fallback: base64 image data in text field. Long base64 text
+		// that doesn't decode to an image is skipped.
+		if part.Text != "" && len(part.Text) >= 1000 && isBase64Image(part.Text) {
+			imgBytes, err := base64.StdEncoding.DecodeString(part.Text)
+			if err != nil {
+				continue
+			}
+			if mime := sniffImageType(imgBytes); strings.HasPrefix(mime, "image/") {
+				images = append(images, outputImage{imgBytes, mime})
+			}
+		}
+	}
+	return images, nil
+}
+
+// parseStream merges the server-sent events of a streamGenerateContent
+// response into a single response, appending each candidate's parts.
+func parseStream(body []byte) (apiResponse, error) {
+	var merged apiResponse
+	events := 0
+	for line := range strings.Lines(string(body)) {
+		data, ok := strings.CutPrefix(strings.TrimSpace(line), "data:")
+		if !ok {
+			continue
+		}
+		var chunk apiResponse
+		if err := json.Unmarshal([]byte(strings.TrimSpace(data)), &chunk); err != nil {
+			return apiResponse{}, fmt.Errorf("parsing stream event: %w", err)
+		}
+		events++
+		if chunk.Error != nil {
+			merged.Error = chunk.Error
+		}
+		for i, c := range chunk.Candidates {
+			if i >= len(merged.Candidates) {
+				merged.Candidates = append(merged.Candidates, apiCandidate{})
+			}
+			merged.Candidates[i].Content.Parts = append(merged.Candidates[i].Content.Parts, c.Content.Parts...)
+			if c.FinishReason != "" {
+				merged.Candidates[i].FinishReason = c.FinishReason
+				merged.Candidates[i].SafetyRatings = c.SafetyRatings
+			}
+		}
+		if chunk.PromptFeedback != nil {
+			merged.PromptFeedback = chunk.PromptFeedback
+		}
+		if chunk.UsageMetadata != nil {
+			merged.UsageMetadata = chunk.UsageMetadata // running totals; the last is final
+		}
+	}
+	if events == 0 {
+		return apiResponse{}, fmt.Errorf("no events in stream")
+	}
+	return merged, nil
+}
+
+// progressReader reports bytes received through the spinner.
+type progressReader struct {
+	r    io.Reader
+	n    int64
+	last time.Time
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.n += int64(n)
+	if n > 0 && time.Since(p.last) >= 100*time.Millisecond {
+		p.last = time.Now()
+		setSpinnerMsg(fmt.Sprintf("Receiving image... %s", formatBytes(p.n)))
+	}
+	return n, err
+}
+
+// parseByteSize reads a size such as 500000, 800KB or 15MB. Units are
+// powers of 1024, as in formatBytes.
+func parseByteSize(s string) (int64, error) {
+	num := strings.ToUpper(strings.TrimSpace(s))
+	mult := int64(1)
+	for _, u := range []struct {
+		suffix string
+		mult   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(num, u.suffix) {
+			num, mult = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n <= 0 || math.IsInf(n, 0) {
+		return 0, fmt.Errorf("invalid size %q (use bytes or a KB, MB or GB suffix)", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// formatBytes renders a byte count as B, KB or MB.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+// --- Debug logging ---
+
+// maxLoggedData is how much of inline base64 data and error bodies to log.
+const maxLoggedData = 64
+
+func debugf(format string, args ...any) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, colorPurple+"[debug] "+colorReset+format+"\n", args...)
+	}
+}
+
+// maskKey hides all but the ends of an API key.
+func maskKey(key string) string {
+	if len(key) < 12 {
+		return "****"
+	}
+	return key[:4] + "..." + key[len(key)-4:]
+}
+
+// truncateInlineData returns a copy of reqBody with image data shortened
+// for logging.
+func truncateInlineData(reqBody apiRequest) apiRequest {
+	out := reqBody
+	out.Contents = make([]apiContent, len(reqBody.Contents))
+	for i, c := range reqBody.Contents {
+		parts := make([]apiPart, len(c.Parts))
+		for j, p := range c.Parts {
+			if p.InlineData != nil && len(p.InlineData.Data) > maxLoggedData {
+				blob := *p.InlineData
+				blob.Data = fmt.Sprintf("%s...(%d bytes base64)", blob.Data[:maxLoggedData], len(blob.Data))
+				p.InlineData = &blob
+			}
+			parts[j] = p
+		}
+		c.Parts = parts
+		out.Contents[i] = c
+	}
+	return out
+}
+
+func logHeaders(h http.Header) {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := strings.Join(h[k], ", ")
+		if strings.EqualFold(k, "x-goog-api-key") {
+			v = maskKey(v)
+		}
+		if token, ok := strings.CutPrefix(v, "Bearer "); ok && strings.EqualFold(k, "Authorization") {
+			v = "Bearer " + maskKey(token)
+		}
+		debugf("  %s: %s", k, v)
+	}
+}
+
+func logRequest(req *http.Request, reqBody apiRequest) {
+	if !verbose {
+		return
+	}
+	debugf("%s %s", req.Method, req.URL)
+	if proxy, _ := proxyFor(req); proxy != nil {
+		debugf("Proxy: %s", proxy.Redacted())
+	}
+	logHeaders(req.Header)
+	if raw := reqBody.Raw; raw != nil {
+		if len(raw) > 4096 {
+			raw = raw[:4096]
+		}
+		debugf("Request body (raw):\n%s", raw)
+	} else if data, err := json.MarshalIndent(truncateInlineData(reqBody), "", "  "); err == nil {
+		debugf("Request body:\n%s", data)
+	}
+}
+
+func logResponse(resp *http.Response, body []byte) {
+	if !verbose {
+		return
+	}
+	debugf("Response: %s (%d bytes)", resp.Status, len(body))
+	logHeaders(resp.Header)
+	if resp.StatusCode != 200 {
+		if len(body) > 4096 {
+			body = body[:4096]
+		}
+		debugf("Response body:\n%s", body)
+	}
+}
+
+// saveRequestPath and saveResponsePath are the --save-request and
+// --save-response files. With several requests, the last one wins.
+var (
+	saveRequestPath  string
+	saveResponsePath string
+	saveMu           sync.Mutex
+)
+
+// saveRequest writes the request body to --save-request with image data
+// truncated, as --verbose shows it. A --raw-request body is saved as is.
+func saveRequest(reqBody apiRequest) {
+	if saveRequestPath == "" {
+		return
+	}
+	data, err := json.MarshalIndent(truncateInlineData(reqBody), "", "  ")
+	if reqBody.Raw != nil {
+		data, err = reqBody.Raw, nil
+	}
+	if err == nil {
+		err = writeDebugFile(saveRequestPath, append(data, '\n'))
+	}
+	if err != nil {
+		warn("saving request: %v", err)
+	}
+}
+
+// saveResponse writes the raw response body to --save-response.
+func saveResponse(body []byte) {
+	if saveResponsePath == "" {
+		return
+	}
+	if err := writeDebugFile(saveResponsePath, body); err != nil {
+		warn("saving response: %v", err)
+	}
+}
+
+func writeDebugFile(path string, data []byte) error {
+	saveMu.Lock()
+	defer saveMu.Unlock()
+	return os.WriteFile(path, data, 0644)
+}
+
+// proxyOverride replaces the HTTP(S)_PROXY environment settings when set
+// (from --proxy).
+var proxyOverride *url.URL
+
+func proxyFor(req *http.Request) (*url.URL, error) {
+	if proxyOverride != nil {
+		return proxyOverride, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+// newHTTPClient returns an API client that honors --proxy and the
+// HTTP_PROXY/HTTPS_PROXY/NO_PROXY environment variables.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = proxyFor
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// rateLimitUntil holds back every request after any of them is rate
+// limited, so concurrent batch workers back off together rather than
+// each hitting the limit in turn.
+var (
+	rateLimitMu    sync.Mutex
+	rateLimitUntil time.Time
+)
+
+// holdRequests delays all requests for at least wait from now.
+func holdRequests(wait time.Duration) {
+	rateLimitMu.Lock()
+	defer rateLimitMu.Unlock()
+	if until := time.Now().Add(wait); until.After(rateLimitUntil) {
+		rateLimitUntil = until
+	}
+}
+
+// waitForRateLimit sleeps until any shared rate-limit backoff has passed,
+// returning early with ctx's error if ctx ends first.
+func waitForRateLimit(ctx context.Context) error {
+	rateLimitMu.Lock()
+	wait := time.Until(rateLimitUntil)
+	rateLimitMu.Unlock()
+	if wait <= 0 {
+		return nil
+	}
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// requestRate caps API requests per second across all workers and
+// retries (--rps); 0 means no cap. The limiter is a token bucket holding
+// a single token, so requests are spaced evenly instead of bursting.
+var (
+	requestRate  float64
+	throttleMu   sync.Mutex
+	throttleNext time.Time // when the bucket next holds a token
+)
+
+// throttle takes a token from the --rps bucket, sleeping until one is
+// available or ctx ends.
+func throttle(ctx context.Context) error {
+	if requestRate <= 0 {
+		return nil
+	}
+	throttleMu.Lock()
+	now := time.Now()
+	slot := throttleNext
+	if slot.Before(now) {
+		slot = now
+	}
+	throttleNext = slot.Add(time.Duration(float64(time.Second) / requestRate))
+	throttleMu.Unlock()
+
+	wait := slot.Sub(now)
+	if wait <= 0 {
+		return nil
+	}
+	debugf("Waiting %s to stay under --rps %g", wait.Round(time.Millisecond), requestRate)
+	select {
+	case <-time.After(wait):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var (
+	apiClientOnce sync.Once
+	apiClient     *http.Client
+)
+
+// sharedHTTPClient returns a process-wide API client so repeated calls
+// (batches, the REPL) reuse connections.
+func sharedHTTPClient() *http.Client {
+	apiClientOnce.Do(func() {
+		apiClient = newHTTPClient(httpTimeout)
+	})
+	return apiClient
+}
+
+// parseProxyURL validates a --proxy value.
+func parseProxyURL(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q", raw)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+		return u, nil
+	}
+	return nil, fmt.Errorf("invalid proxy URL %q (scheme must be http, https or socks5)", raw)
+}
+
+// connectionError describes a failed request, naming the proxy if one was used.
+func connectionError(req *http.Request, err error) error {
+	if proxy, _ := proxyFor(req); proxy != nil {
+		return fmt.Errorf("could not reach API through proxy %s (%v). Check the proxy URL and that the proxy is reachable", proxy.Redacted(), errors.Unwrap(err))
+	}
+	return fmt.Errorf("could not reach API. Check your internet connection")
+}
+
+func isRetryableStatus(code int) bool {
+	return code == 429 || code >= 500
+}
+
+// retryDelay returns how long to wait before retry number attempt (0-based).
+// A Retry-After header (seconds or HTTP date) wins over exponential backoff;
+// either way the delay is capped at maxWait.
+func retryDelay(attempt int, retryAfter string, maxWait time.Duration) time.Duration {
+	delay := time.Second << attempt
+	if retryAfter != "" {
+		if secs, err := strconv.Atoi(strings.TrimSpace(retryAfter)); err == nil && secs >= 0 {
+			delay = time.Duration(secs) * time.Second
+		} else if t, err := http.ParseTime(retryAfter); err == nil {
+			delay = max(time.Until(t), 0)
+		}
+	}
+	if maxWait > 0 && delay > maxWait {
+		delay = maxWait
+	}
+	return delay
+}
+
+var base64Re = regexp.MustCompile(`^[A-Za-z0-9+/]*={0,2}$`)
+
+// isBase64Image reports whether s could be base64 image data. It only
+// checks the character set; callers sniff the decoded bytes.
+func isBase64Image(s string) bool {
+	return base64Re.MatchString(s)
+}
+
+// --- Image I/O ---
+
+// maxDownloadBytes caps images fetched from URLs.
+const maxDownloadBytes = 20 << 20
+
+// isURL reports whether an image argument is an http(s) URL.
+func isURL(arg string) bool {
+	return strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://")
+}
+
+// dataURIPrefix matches the start of a base64 image data URI such as
+// data:image/png;base64,... Prompt text that merely starts with "data:"
+// doesn't match.
+var dataURIPrefix = regexp.MustCompile(`(?i)^data:image/[a-z0-9.+-]+(;[^;,\s]*)*;\s*base64\s*(;[^;,\s]*)*,`)
+
+// isDataURI reports whether an image argument is a base64 image data URI.
+func isDataURI(arg string) bool {
+	return dataURIPrefix.MatchString(arg)
+}
+
+// hasDataScheme reports whether arg starts with data:, well-formed or not,
+// so readImageSource can say what's wrong with it.
+func hasDataScheme(arg string) bool {
+	return len(arg) >= 5 && strings.EqualFold(arg[:5], "data:")
+}
+
+// schemePattern matches a URL-like argument such as ftp://host/cat.png. The
+// whole argument has to look like one, without spaces, so a prompt that
+// starts with a URL isn't taken for an image.
+var schemePattern = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+.-]*://\S+$`)
+
+// isRemoteArg reports whether an image argument names something other
+// than a local file: a URL, a data URI, or an unsupported scheme that
+// readImage will reject.
+func isRemoteArg(arg string) bool {
+	return isDataURI(arg) || schemePattern.MatchString(arg)
+}
+
+// dataURITypes are the image types a data URI input may declare.
+var dataURITypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp", "image/avif"}
+
+// parseDataURI decodes a base64 data URI such as
+// data:image/png;base64,iVBOR... and checks that the payload really is an
+// image of the declared type.
+func parseDataURI(uri string) ([]byte, string, error) {
+	header, payload, ok := strings.Cut(uri[len("data:"):], ",")
+	if !ok {
+		return nil, "", fmt.Errorf("invalid data URI: no comma before the data")
+	}
+	params := strings.Split(header, ";")
+	mimeType := strings.ToLower(strings.TrimSpace(params[0]))
+	if !slices.Contains(dataURITypes, mimeType) {
+		return nil, "", fmt.Errorf("unsupported data URI type %q (use %s)", params[0], strings.Join(dataURITypes, ", "))
+	}
+	if !slices.ContainsFunc(params[1:], func(p string) bool { return strings.EqualFold(strings.TrimSpace(p), "base64") }) {
+		return nil, "", fmt.Errorf("data URI must be base64 encoded (data:%s;base64,...)", mimeType)
+	}
+	payload = strings.Map(func(r rune) rune {
+		if unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, payload)
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		data, err = base64.RawStdEncoding.DecodeString(payload)
+	}
+	if err != nil || len(data) == 0 {
+		return nil, "", fmt.Errorf("invalid data URI: the data is not valid base64")
+	}
+	if sniffed := sniffImageType(data); sniffed != mimeType {
+		return nil, "", fmt.Errorf("data URI declares %s but holds %s", mimeType, sniffed)
+	}
+	return data, mimeType, nil
+}
+
+// dataURIPlaceholder stands in for a data URI in history, manifests and
+// messages, which would otherwise carry the whole image.
+func dataURIPlaceholder(uri string) string {
+	header, _, _ := strings.Cut(uri, ",")
+	return header + ",..."
+}
+
+// imageLabel names an input image in messages.
+func imageLabel(path string) string {
+	switch {
+	case path == "-":
+		return "stdin"
+	case isDataURI(path):
+		return dataURIPlaceholder(path)
+	}
+	return path
+}
+
+// fetchImage downloads an input image, honoring the proxy settings. The
+// MIME type comes from Content-Type, or content detection when the server
+// sends a generic type.
+func fetchImage(rawURL string) ([]byte, string, error) {
+	client := newHTTPClient(httpTimeout)
+	req, err := http.NewRequest("GET", rawURL, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid image URL %q: %w", rawURL, err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		debugf("Download failed: %v", err)
+		return nil, "", fmt.Errorf("downloading %s: %w", rawURL, connectionError(req, err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, "", fmt.Errorf("downloading %s: HTTP %d", rawURL, resp.StatusCode)
+	}
+	if resp.ContentLength > maxDownloadBytes {
+		return nil, "", fmt.Errorf("image at %s is too large (%s, limit %s)", rawURL, formatBytes(resp.ContentLength), formatBytes(maxDownloadBytes))
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxDownloadBytes+1))
+	if err != nil {
+		return nil, "", fmt.Errorf("downloading %s: %w", rawURL, err)
+	}
+	if len(data) > maxDownloadBytes {
+		return nil, "", fmt.Errorf("image at %s is larger than %s", rawURL, formatBytes(maxDownloadBytes))
+	}
+	if len(data) == 0 {
+		return nil, "", fmt.Errorf("no image data at %s", rawURL)
+	}
+
+	ct, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch {
+	case strings.HasPrefix(ct, "image/"):
+		return data, ct, nil
+	case ct == "" || ct == "application/octet-stream" || ct == "binary/octet-stream":
+		if detected := sniffImageType(data); strings.HasPrefix(detected, "image/") {
+			return data, detected, nil
+		}
+		return nil, "", fmt.Errorf("%s does not look like an image", rawURL)
+	}
+	return nil, "", fmt.Errorf("%s is not an image (Content-Type %s)", rawURL, ct)
+}
+
+func readImage(path string) ([]byte, string, error) {
+	path = expandPath(path)
+	data, mimeType, err := readImageSource(path)
+	if err != nil {
+		return nil, "", err
+	}
+	if mimeType, err = checkImage(imageLabel(path), data, mimeType); err != nil {
+		return nil, "", err
+	}
+	if mimeType == "image/jpeg" {
+		data = uprightJPEG(data)
+	}
+	return data, mimeType, nil
+}
+
+// readImageSource returns the bytes of an input image and the type its
+// source claims: the data: URI's type, the Content-Type of a URL, or the
+// file extension ("" for stdin).
+func readImageSource(path string) ([]byte, string, error) {
+	if hasDataScheme(path) {
+		return parseDataURI(path)
+	}
+	if !isURL(path) && schemePattern.MatchString(path) {
+		scheme, _, _ := strings.Cut(path, "://")
+		return nil, "", fmt.Errorf("unsupported image location %s:// (use a file path, an http(s) URL, a data: URI or - for stdin)", scheme)
+	}
+	if isURL(path) {
+		return fetchImage(path)
+	}
+
+	var data []byte
+	var err error
+	if path == "-" {
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil, "", fmt.Errorf("no image piped on stdin (use a file path or pipe image data to -)")
+		}
+		data, err = io.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading stdin: %w", err)
+		}
+		if len(data) == 0 {
+			return nil, "", fmt.Errorf("no image data received on stdin")
+		}
+	} else {
+		data, err = os.ReadFile(path)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading image: %w", err)
+		}
+	}
+
+	claimed := ""
+	if path != "-" {
+		claimed = mime.TypeByExtension(strings.ToLower(filepath.Ext(path)))
+	}
+	return data, claimed, nil
+}
+
+// imageFormatNames name the input formats checkImage can verify.
+var imageFormatNames = map[string]string{
+	"image/png":  "PNG",
+	"image/jpeg": "JPEG",
+	"image/gif":  "GIF",
+	"image/webp": "WebP",
+	"image/avif": "AVIF",
+}
+
+// checkImage makes sure data is an image before it is sent, so a corrupt
+// or mislabeled file fails here instead of as a confusing API error. The
+// type sniffed from the content wins over claimed, e.g. a JPEG saved as
+// .png is sent as image/jpeg. PNG, JPEG and GIF are decoded in full to
+// catch truncated files; WebP and AVIF only have their headers checked.
+func checkImage(label string, data []byte, claimed string) (string, error) {
+	sniffed := sniffImageType(data)
+	if !strings.HasPrefix(sniffed, "image/") {
+		content, _, _ := mime.ParseMediaType(sniffed)
+		if content == "application/octet-stream" {
+			content = "unrecognized data"
+		}
+		if name, ok := imageFormatNames[claimed]; ok {
+			return "", fmt.Errorf("%s is not a valid %s (its content looks like %s)", label, name, content)
+		}
+		return "", fmt.Errorf("%s is not an image (its content looks like %s)", label, content)
+	}
+	if claimed != "" && sniffed != claimed {
+		debugf("%s is labeled %s but holds %s; sending it as %s", label, claimed, sniffed, sniffed)
+	}
+	name := imageFormatNames[sniffed]
+	var err error
+	switch sniffed {
+	case "image/png", "image/jpeg", "image/gif":
+		_, _, err = image.Decode(bytes.NewReader(data))
+	case "image/avif":
+		_, _, err = image.DecodeConfig(bytes.NewReader(data))
+	case "image/webp":
+		// The RIFF header gives the file size, so a cut-off file shows
+		// up as fewer bytes than it claims; there's no WebP decoder here
+		// to check more
+		if size := binary.LittleEndian.Uint32(data[4:8]); int64(size)+8 > int64(len(data)) {
+			err = fmt.Errorf("truncated: the header says %d bytes, the file has %d", int64(size)+8, len(data))
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("%s is not a valid %s: %v", label, name, err)
+	}
+	return sniffed, nil
+}
+
+// urlEditedName names the output of editing a downloaded image after the
+// last path segment of its URL, e.g. .../cat.jpg -> cat_edited.jpg.
+func urlEditedName(rawURL, mime string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return autoName("edited", mime)
+	}
+	base := path.Base(u.Path)
+	ext := path.Ext(base)
+	stem := strings.TrimSuffix(base, ext)
+	if stem == "" || stem == "." || stem == "/" {
+		return autoName("edited", mime)
+	}
+	if ext == "" {
+		ext = extForMIME(mime)
+	}
+	return stem + "_edited" + ext
+}
+
+// envVarRef matches $VAR and ${VAR} references in a path.
+var envVarRef = regexp.MustCompile(`\$(\{[A-Za-z_][A-Za-z0-9_]*\}|[A-Za-z_][A-Za-z0-9_]*)`)
+
+// expandPath expands $VAR, ${VAR} and a leading ~ in a path the shell
+// didn't expand, e.g. a quoted argument or a config value. References to
+// unset variables are kept as written, so a literal $ in a file name
+// survives. "-", URLs and data URIs are returned unchanged.
+func expandPath(p string) string {
+	if p == "" || p == "-" || isRemoteArg(p) {
+		return p
+	}
+	p = envVarRef.ReplaceAllStringFunc(p, func(ref string) string {
+		if v, ok := os.LookupEnv(strings.Trim(ref, "${}")); ok {
+			return v
+		}
+		return ref
+	})
+	if p == "~" || strings.HasPrefix(p, "~/") || strings.HasPrefix(p, "~"+string(filepath.Separator)) {
+		if home, err := os.UserHomeDir(); err == nil {
+			p = filepath.Join(home, p[1:])
+		}
+	}
+	return p
+}
+
+// isImageArg reports whether an edit argument names an input image: stdin,
+// a URL, or an existing file.
+func isImageArg(arg string) bool {
+	if arg == "-" || isRemoteArg(arg) {
+		return true
+	}
+	fi, err := os.Stat(expandPath(arg))
+	return err == nil && !fi.IsDir()
+}
+
+// splitImageArgs splits edit's positional args into leading image paths and
+// the prompt. The first arg is always an image; following args are images
+// while they name existing files or URLs (or "-" for stdin, at most once).
+func splitImageArgs(args []string) ([]string, string) {
+	if len(args) == 0 {
+		return nil, ""
+	}
+	paths := []string{expandPath(args[0])}
+	usedStdin := args[0] == "-"
+	i := 1
+	for ; i < len(args); i++ {
+		if args[i] == "-" && !usedStdin {
+			usedStdin = true
+		} else if !isRemoteArg(args[i]) {
+			if fi, err := os.Stat(expandPath(args[i])); err != nil || fi.IsDir() {
+				break
+			}
+		}
+		paths = append(paths, expandPath(args[i]))
+	}
+	return paths, strings.Join(args[i:], " ")
+}
+
+func detectMIMEType(path string, data []byte) string {
+	if path != "-" {
+		ext := strings.ToLower(filepath.Ext(path))
+		switch ext {
+		case ".png":
+			return "image/png"
+		case ".jpg", ".jpeg":
+			return "image/jpeg"
+		case ".gif":
+			return "image/gif"
+		case ".webp":
+			return "image/webp"
+		case ".avif":
+			return "image/avif"
+		}
+	}
+	// Fallback to content detection (always used for stdin)
+	ct := sniffImageType(data)
+	if strings.HasPrefix(ct, "image/") {
+		return ct
+	}
+	return "image/png"
+}
+
+// sniffImageType is http.DetectContentType plus AVIF, which the standard
+// sniffer doesn't know.
+func sniffImageType(data []byte) string {
+	if isAVIF(data) {
+		return "image/avif"
+	}
+	return http.DetectContentType(data)
+}
+
+// isAVIF reports whether data starts with an ISO BMFF ftyp box whose major
+// brand is avif (still image) or avis (image sequence).
+func isAVIF(data []byte) bool {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return false
+	}
+	brand := string(data[8:12])
+	return brand == "avif" || brand == "avis"
+}
+
+// errNoAVIFDecoder is returned when AVIF pixels are needed, e.g. to convert
+// an AVIF with --format. Go has no AVIF decoder; the file can still be sent
+// to the API as is.
+var errNoAVIFDecoder = errors.New("avif: no AVIF decoder available; convert the image to PNG or JPEG first")
+
+// Registering AVIF lets image.DecodeConfig report its size (for --aspect
+// auto, --mask checks and info) from the ispe property; decoding pixels
+// fails with errNoAVIFDecoder.
+func init() {
+	for _, brand := range []string{"avif", "avis"} {
+		image.RegisterFormat("avif", "????ftyp"+brand, decodeAVIF, decodeAVIFConfig)
+	}
+}
+
+func decodeAVIF(io.Reader) (image.Image, error) {
+	return nil, errNoAVIFDecoder
+}
+
+// maxAVIFHeader bounds how far decodeAVIFConfig looks for the ispe box;
+// the meta box that holds it comes before the image data.
+const maxAVIFHeader = 64 << 10
+
+// decodeAVIFConfig reads the width and height of the primary image from
+// the first ispe (image spatial extents) property: a full box header, then
+// the width and height as 32-bit big-endian integers.
+func decodeAVIFConfig(r io.Reader) (image.Config, error) {
+	head, err := io.ReadAll(io.LimitReader(r, maxAVIFHeader))
+	if err != nil {
+		return image.Config{}, err
+	}
+	i := bytes.Index(head, []byte("ispe"))
+	if i < 0 || i+16 > len(head) {
+		return image.Config{}, errors.New("avif: no image size (ispe) found")
+	}
+	width := binary.BigEndian.Uint32(head[i+8:])
+	height := binary.BigEndian.Uint32(head[i+12:])
+	if width == 0 || height == 0 || width > math.MaxInt32 || height > math.MaxInt32 {
+		return image.Config{}, errors.New("avif: invalid image size")
+	}
+	return image.Config{ColorModel: color.RGBAModel, Width: int(width), Height: int(height)}, nil
+}
+
+// writeOptions controls how writeImageWithOptions encodes its output.
+type writeOptions struct {
+	Metadata   *imageMetadata // embedded into PNG/JPEG output when non-nil
+	Quality    int            // JPEG quality (1-100); 0 means defaultJPEGQuality
+	Format     string         // --format: forces png, jpg, webp or gif regardless of extension
+	TargetSize int64          // --target-size: lower JPEG quality until the file fits; 0 for none
+	MaxBytes   int64          // --max-bytes, checked once --target-size has fitted the file; 0 for none
+	// Source is the image as the API returned it, before --crop, --quality
+	// or --format re-encoded it; --target-size fits from it, cropped again
+	// with Crop, so nothing is compressed twice
+	Source []byte
+	Crop   *cropSpec
+}
+
+// formatMIMETypes maps --format values to the MIME type written.
+var formatMIMETypes = map[string]string{
+	"png":  "image/png",
+	"jpg":  "image/jpeg",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+	"gif":  "image/gif",
+}
+
+// validateFormat checks a --format value; empty means "follow the extension".
+func validateFormat(format string) error {
+	if _, ok := formatMIMETypes[format]; format != "" && !ok {
+		return fmt.Errorf("invalid format %q (valid: png, jpg, webp, gif)", format)
+	}
+	return nil
+}
+
+const defaultJPEGQuality = 95
+
+func writeImage(path string, data []byte, sourceMIME string) error {
+	return writeImageWithOptions(path, data, sourceMIME, writeOptions{})
+}
+
+func writeImageWithOptions(path string, data []byte, sourceMIME string, opts writeOptions) error {
+	path = expandPath(path)
+	var out []byte
+	var err error
+	if opts.Format != "" {
+		out, err = encodeFormat(opts.Format, data, sourceMIME, opts.Quality)
+	} else {
+		out, err = encodeImage(path, data, sourceMIME, opts.Quality)
+	}
+	if err != nil {
+		return err
+	}
+	warnDroppedCredentials(data, out)
+	embed := opts.Metadata != nil
+	if embed && hasContentCredentials(out) {
+		// Adding chunks would break the manifest's signature
+		debugf("Not embedding metadata in %s: it carries content credentials", path)
+		embed = false
+	}
+	finish := func(b []byte) []byte {
+		if embed {
+			return embedMetadata(b, *opts.Metadata)
+		}
+		return b
+	}
+	final := finish(out)
+	if opts.TargetSize > 0 && int64(len(final)) > opts.TargetSize {
+		source, crop := opts.Source, opts.Crop
+		if source == nil {
+			source, crop = data, nil
+		}
+		if final, err = fitTargetSize(source, crop, out, opts.Quality, opts.TargetSize, finish); err != nil {
+			return err
+		}
+	}
+	if opts.MaxBytes > 0 && int64(len(final)) > opts.MaxBytes {
+		return classify(exitIO, fmt.Errorf("image is %s (%d bytes), over --max-bytes %s; not saved", formatBytes(int64(len(final))), len(final), formatBytes(opts.MaxBytes)))
+	}
+	return os.WriteFile(path, final, 0644)
+}
+
+// minTargetQuality is the lowest JPEG quality --target-size will go to.
+const minTargetQuality = 20
+
+// fitTargetSize re-encodes JPEG output at the highest quality, up to
+// quality, whose size after finish (which adds metadata) is within target.
+// It starts from the API's source image, cropped with crop when set, rather
+// than out, so nothing is compressed twice. When even minTargetQuality is
+// too big it settles for that, with a warning. Other formats have no
+// quality to trade, so they are kept as they are.
+func fitTargetSize(source []byte, crop *cropSpec, out []byte, quality int, target int64, finish func([]byte) []byte) ([]byte, error) {
+	if !bytes.HasPrefix(out, []byte{0xff, 0xd8}) {
+		warn("--target-size only applies to JPEG output; saving the %s image as is", sniffImageType(out))
+		return finish(out), nil
+	}
+	img, _, err := image.Decode(bytes.NewReader(source))
+	if err == nil && crop != nil {
+		img, err = cropImage(img, *crop)
+	}
+	if err != nil {
+		img, err = jpeg.Decode(bytes.NewReader(out))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("re-encoding for --target-size: %w", err)
+	}
+	encode := func(q int) ([]byte, error) {
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: q}); err != nil {
+			return nil, err
+		}
+		return finish(buf.Bytes()), nil
+	}
+	if quality == 0 {
+		quality = defaultJPEGQuality
+	}
+	var best []byte
+	bestQuality := 0
+	for lo, hi := minTargetQuality, quality; lo <= hi; {
+		q := (lo + hi) / 2
+		out, err := encode(q)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(out)) <= target {
+			best, bestQuality, lo = out, q, q+1
+		} else {
+			hi = q - 1
+		}
+	}
+	if best == nil {
+		out, err := encode(minTargetQuality)
+		if err != nil {
+			return nil, err
+		}
+		warn("could not get the image under %s; saved at JPEG quality %d (%s)", formatBytes(target), minTargetQuality, formatBytes(int64(len(out))))
+		best = out
+	} else {
+		info("Saved at JPEG quality %d to fit %s (%s)", bestQuality, formatBytes(target), formatBytes(int64(len(best))))
+	}
+	warnDroppedCredentials(source, best)
+	return best, nil
+}
+
+// hasContentCredentials reports whether image data carries a C2PA
+// manifest: a caBX chunk in PNG, an APP11 JUMBF segment in JPEG or a C2PA
+// chunk in WebP.
+func hasContentCredentials(data []byte) bool {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		pos := len(pngSignature)
+		for pos+8 <= len(data) {
+			length := int(binary.BigEndian.Uint32(data[pos:]))
+			if string(data[pos+4:pos+8]) == "caBX" {
+				return true
+			}
+			pos += 12 + length
+		}
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		pos := 2
+		for pos+4 <= len(data) && data[pos] == 0xff {
+			marker := data[pos+1]
+			if marker == 0xd9 || marker == 0xda {
+				break
+			}
+			length := int(binary.BigEndian.Uint16(data[pos+2:]))
+			if length < 2 || pos+2+length > len(data) {
+				break
+			}
+			if marker == 0xeb && bytes.Contains(data[pos+4:pos+2+length], []byte("c2pa")) {
+				return true
+			}
+			pos += 2 + length
+		}
+	case len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP":
+		return bytes.Contains(data[12:], []byte("C2PA"))
+	}
+	return false
+}
+
+// warnDroppedCredentials warns when converting an image lost the C2PA
+// content credentials the API attached to it.
+func warnDroppedCredentials(before, after []byte) {
+	if hasContentCredentials(before) && !hasContentCredentials(after) {
+		warn("converting the image dropped its content credentials (C2PA); save in the original format to keep them")
+	}
+}
+
+// encodeFormat transcodes data to a --format value. Go has no WebP
+// encoder, so webp only works when the source is already WebP.
+func encodeFormat(format string, data []byte, sourceMIME string, quality int) ([]byte, error) {
+	switch formatMIMETypes[format] {
+	case sourceMIME:
+		return data, nil
+	case "image/webp":
+		return nil, fmt.Errorf("cannot convert %s to WebP (no WebP encoder available); use --format png or jpg", sourceMIME)
+	case "image/jpeg":
+		return encodeImage("out.jpg", data, sourceMIME, quality)
+	case "image/gif":
+		return encodeImage("out.gif", data, sourceMIME, quality)
+	}
+	return encodeImage("out.png", data, sourceMIME, quality)
+}
+
+// encodeImage returns the bytes to write for path, transcoding the source
+// image when the output extension calls for a different format.
+func encodeImage(path string, data []byte, sourceMIME string, quality int) ([]byte, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+
+	// If the output extension matches the source MIME, write raw bytes.
+	// This also keeps WebP and GIF animations, which can't be re-encoded.
+	if (ext == ".png" && sourceMIME == "image/png") ||
+		(ext == ".jpg" && sourceMIME == "image/jpeg") ||
+		(ext == ".jpeg" && sourceMIME == "image/jpeg") ||
+		(ext == ".gif" && sourceMIME == "image/gif") ||
+		(ext == ".webp" && sourceMIME == "image/webp") {
+		return data, nil
+	}
+
+	// Need to transcode
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		// If we can't decode, just write raw bytes
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	switch ext {
+	case ".jpg", ".jpeg":
+		if quality == 0 {
+			quality = defaultJPEGQuality
+		}
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+	case ".png":
+		err = png.Encode(&buf, img)
+	case ".gif":
+		err = encodeGIF(&buf, img)
+	default:
+		// Default to PNG
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeGIF writes img as a single-frame GIF dithered to the Plan 9
+// palette. Images with transparency give up one palette entry so fully
+// transparent pixels stay transparent.
+func encodeGIF(w io.Writer, img image.Image) error {
+	pal := color.Palette(palette.Plan9)
+	if o, ok := img.(interface{ Opaque() bool }); ok && !o.Opaque() {
+		pal = append(color.Palette{color.Transparent}, palette.Plan9[:255]...)
+	}
+	bounds := img.Bounds()
+	out := image.NewPaletted(bounds, pal)
+	draw.FloydSteinberg.Draw(out, bounds, img, bounds.Min)
+	return gif.Encode(w, out, nil)
+}
+
+// --- Metadata ---
+
+// imageMetadata describes how an image was generated. It is embedded as
+// PNG text chunks or JPEG EXIF so outputs can be traced back to a prompt.
+type imageMetadata struct {
+	Prompt  string    `json:"prompt"`
+	Model   string    `json:"model"`
+	Aspect  string    `json:"aspect,omitempty"`
+	Size    string    `json:"size,omitempty"`
+	Seed    *int64    `json:"seed,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+var pngSignature = []byte("\x89PNG\r\n\x1a\n")
+
+// embedMetadata adds meta to PNG or JPEG data. Other formats (and data
+// that doesn't parse as expected) are returned unchanged.
+func embedMetadata(data []byte, meta imageMetadata) []byte {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return embedPNGMetadata(data, meta)
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return embedJPEGMetadata(data, meta)
+	}
+	return data
+}
+
+func embedPNGMetadata(data []byte, meta imageMetadata) []byte {
+	// Chunks go right after IHDR: 8-byte signature + 25-byte IHDR chunk
+	const ihdrEnd = 8 + 4 + 4 + 13 + 4
+	if len(data) < ihdrEnd || string(data[12:16]) != "IHDR" {
+		return data
+	}
+
+	var chunks bytes.Buffer
+	chunks.Write(pngChunk("tEXt", []byte("Software\x00nanobanana "+Version)))
+	chunks.Write(pngITXtChunk("Description", meta.Prompt))
+	chunks.Write(pngITXtChunk("Creation Time", meta.Created.UTC().Format(time.RFC3339)))
+	chunks.Write(pngITXtChunk("nanobanana:prompt", meta.Prompt))
+	chunks.Write(pngITXtChunk("nanobanana:model", meta.Model))
+	if meta.Aspect != "" {
+		chunks.Write(pngITXtChunk("nanobanana:aspect", meta.Aspect))
+	}
+	if meta.Size != "" {
+		chunks.Write(pngITXtChunk("nanobanana:size", meta.Size))
+	}
+	if meta.Seed != nil {
+		chunks.Write(pngITXtChunk("nanobanana:seed", strconv.FormatInt(*meta.Seed, 10)))
+	}
+
+	out := make([]byte, 0, len(data)+chunks.Len())
+	out = append(out, data[:ihdrEnd]...)
+	out = append(out, chunks.Bytes()...)
+	return append(out, data[ihdrEnd:]...)
+}
+
+func pngChunk(typ string, data []byte) []byte {
+	buf := make([]byte, 8, 12+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	copy(buf[4:], typ)
+	buf = append(buf, data...)
+	crc := crc32.ChecksumIEEE(buf[4:])
+	return binary.BigEndian.AppendUint32(buf, crc)
+}
+
+// pngITXtChunk builds an uncompressed UTF-8 iTXt chunk.
+func pngITXtChunk(keyword, text string) []byte {
+	data := keyword + "\x00" + // keyword
+		"\x00\x00" + // compression flag and method
+		"\x00" + // empty language tag
+		"\x00" + // empty translated keyword
+		text
+	return pngChunk("iTXt", []byte(data))
+}
+
+// EXIF/TIFF field types and tags used for JPEG metadata.
+const (
+	exifTypeASCII     = 2
+	exifTypeShort     = 3
+	exifTypeLong      = 4
+	exifTypeUndefined = 7
+
+	exifTagImageDescription = 0x010e
+	exifTagOrientation      = 0x0112
+	exifTagSoftware         = 0x0131
+	exifTagDateTime         = 0x0132
+	exifTagExifIFD          = 0x8769
+	exifTagUserComment      = 0x9286
+)
+
+type exifEntry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func exifASCII(tag uint16, s string) exifEntry {
+	data := append([]byte(s), 0)
+	return exifEntry{tag: tag, typ: exifTypeASCII, count: uint32(len(data)), data: data}
+}
+
+// encodeIFD serializes a big-endian TIFF IFD that starts at offset start,
+// followed by its out-of-line value data.
+func encodeIFD(entries []exifEntry, start uint32) []byte {
+	dataOff := start + 2 + 12*uint32(len(entries)) + 4
+	var ifd, values []byte
+	ifd = binary.BigEndian.AppendUint16(ifd, uint16(len(entries)))
+	for _, e := range entries {
+		ifd = binary.BigEndian.AppendUint16(ifd, e.tag)
+		ifd = binary.BigEndian.AppendUint16(ifd, e.typ)
+		ifd = binary.BigEndian.AppendUint32(ifd, e.count)
+		if len(e.data) <= 4 {
+			inline := make([]byte, 4)
+			copy(inline, e.data)
+			ifd = append(ifd, inline...)
+			continue
+		}
+		ifd = binary.BigEndian.AppendUint32(ifd, dataOff+uint32(len(values)))
+		values = append(values, e.data...)
+		if len(values)%2 == 1 {
+			values = append(values, 0)
+		}
+	}
+	ifd = binary.BigEndian.AppendUint32(ifd, 0) // no next IFD
+	return append(ifd, values...)
+}
+
+// buildEXIF returns a TIFF structure with the prompt in ImageDescription and
+// the full metadata as JSON in the Exif UserComment.
+func buildEXIF(meta imageMetadata) []byte {
+	comment, _ := json.Marshal(meta)
+	exifIFD := []exifEntry{{
+		tag:   exifTagUserComment,
+		typ:   exifTypeUndefined,
+		count: uint32(8 + len(comment)),
+		data:  append([]byte("ASCII\x00\x00\x00"), comment...),
+	}}
+
+	ifd0 := []exifEntry{
+		exifASCII(exifTagImageDescription, meta.Prompt),
+		exifASCII(exifTagSoftware, "nanobanana "+Version),
+		exifASCII(exifTagDateTime, meta.Created.Format("2006:01:02 15:04:05")),
+		{tag: exifTagExifIFD, typ: exifTypeLong, count: 1, data: make([]byte, 4)},
+	}
+	// The Exif IFD follows IFD0; its offset doesn't change IFD0's length
+	exifOffset := 8 + uint32(len(encodeIFD(ifd0, 8)))
+	binary.BigEndian.PutUint32(ifd0[3].data, exifOffset)
+
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = append(tiff, encodeIFD(ifd0, 8)...)
+	return append(tiff, encodeIFD(exifIFD, exifOffset)...)
+}
+
+func embedJPEGMetadata(data []byte, meta imageMetadata) []byte {
+	payload := append([]byte("Exif\x00\x00"), buildEXIF(meta)...)
+	if len(payload)+2 > 0xffff {
+		return data // too large for a single APP1 segment
+	}
+	segment := []byte{0xff, 0xe1}
+	segment = binary.BigEndian.AppendUint16(segment, uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	// Insert after SOI, keeping a leading JFIF APP0 segment first
+	pos := 2
+	if len(data) >= 6 && data[2] == 0xff && data[3] == 0xe0 {
+		pos = 4 + int(binary.BigEndian.Uint16(data[4:6]))
+		if pos > len(data) {
+			return data
+		}
+	}
+	out := make([]byte, 0, len(data)+len(segment))
+	out = append(out, data[:pos]...)
+	out = append(out, segment...)
+	return append(out, data[pos:]...)
+}
+
+// fileExists reports whether something is already at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+func extForMIME(mime string) string {
+	switch mime {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/gif":
+		return ".gif"
+	case "image/webp":
+		return ".webp"
+	case "image/avif":
+		return ".avif"
+	default:
+		return ".png"
+	}
+}
+
+func autoName(prefix, mime string) string {
+	ts := time.Now().Format("20060102_150405")
+	return fmt.Sprintf("%s_%s%s", prefix, ts, extForMIME(mime))
+}
+
+// nameTemplateData holds the fields --name-template and output_template
+// can use, e.g. {{.Slug}}-{{.Model}}{{.Ext}}.
+type nameTemplateData struct {
+	Prefix    string // "nanobanana" or "edited"
+	Timestamp string // 20060102_150405
+	Model     string
+	Slug      string // the prompt, shortened to a file name stem
+	Ext       string // extension with the dot, e.g. ".png"
+	Index     int    // 1-based position in a batch
+}
+
+// parseNameTemplate parses a file name template and checks that it
+// produces a safe name for sample data.
+func parseNameTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("name").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid name template: %w", err)
+	}
+	sample := nameTemplateData{Prefix: "nanobanana", Timestamp: "20060102_150405", Model: "flash", Slug: "a-cat", Ext: ".png", Index: 1}
+	if _, err := executeNameTemplate(tmpl, sample); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+// executeNameTemplate renders a file name, refusing anything that isn't a
+// plain name in the output directory. The extension is added if the
+// template leaves it out.
+func executeNameTemplate(tmpl *template.Template, data nameTemplateData) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("invalid name template: %w", err)
+	}
+	name := strings.TrimSpace(b.String())
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\:*?\"<>|\x00") {
+		return "", fmt.Errorf("name template produced an unsafe file name %q", name)
+	}
+	if !strings.HasSuffix(name, data.Ext) {
+		name += data.Ext
+	}
+	return name, nil
+}
+
+// slugify turns a prompt into a short, filesystem-safe file name stem.
+func slugify(prompt string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(prompt) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') {
+			b.WriteRune(r)
+			dash = false
+		} else if !dash && b.Len() > 0 {
+			b.WriteByte('-')
+			dash = true
+		}
+		if b.Len() >= 60 {
+			break
+		}
+	}
+	slug := strings.TrimRight(b.String(), "-")
+	if slug == "" {
+		return "nanobanana"
+	}
+	// Windows reserves device names regardless of extension (con.png)
+	if windowsReserved[slug] {
+		slug += "-image"
+	}
+	return slug
+}
+
+var windowsReserved = map[string]bool{
+	"con": true, "prn": true, "aux": true, "nul": true,
+	"com1": true, "com2": true, "com3": true, "com4": true, "com5": true, "com6": true, "com7": true, "com8": true, "com9": true,
+	"lpt1": true, "lpt2": true, "lpt3": true, "lpt4": true, "lpt5": true, "lpt6": true, "lpt7": true, "lpt8": true, "lpt9": true,
+}
+
+// readPromptFile reads a whole --prompt-file as one prompt ("-" reads
+// stdin), dropping trailing whitespace such as the final newline.
+func readPromptFile(path string) (string, error) {
+	var data []byte
+	var err error
+	if path == "-" {
+		if term.IsTerminal(int(os.Stdin.Fd())) {
+			return "", fmt.Errorf("no prompt piped on stdin (use --prompt-file with a file path or pipe text to -)")
+		}
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(expandPath(path))
+	}
+	if err != nil {
+		return "", fmt.Errorf("reading prompt file: %w", err)
+	}
+	prompt := strings.TrimRightFunc(string(data), unicode.IsSpace)
+	if strings.TrimSpace(prompt) == "" {
+		return "", fmt.Errorf("prompt file %s is empty", path)
+	}
+	return prompt, nil
+}
+
+// readPromptsFile reads one prompt per line, skipping blank lines and
+// lines starting with #.
+func readPromptsFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading prompts file: %w", err)
+	}
+	var prompts []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		prompts = append(prompts, line)
+	}
+	if len(prompts) == 0 {
+		return nil, fmt.Errorf("no prompts found in %s", path)
+	}
+	return prompts, nil
+}
+
+// indexedPath inserts a 1-based index before the file extension, so
+// "out.png" becomes "out_2.png". Used to number outputs of a --count batch.
+func indexedPath(path string, index int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(path, ext), index, ext)
+}
+
+// seededPath adds an image's seed before the file extension, so
+// "out_2.png" becomes "out_2_seed43.png".
+func seededPath(path string, seed int64) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_seed%d%s", strings.TrimSuffix(path, ext), seed, ext)
+}
+
+// readMetadata extracts nanobanana metadata from PNG or JPEG data,
+// returning nil when none is present.
+func readMetadata(data []byte) *imageMetadata {
+	switch {
+	case bytes.HasPrefix(data, pngSignature):
+		return readPNGMetadata(data)
+	case bytes.HasPrefix(data, []byte{0xff, 0xd8}):
+		return readJPEGMetadata(data)
+	}
+	return nil
+}
+
+// readPNGText returns the tEXt and iTXt entries of a PNG by keyword.
+func readPNGText(data []byte) map[string]string {
+	text := make(map[string]string)
+	pos := len(pngSignature)
+	for pos+8 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		typ := string(data[pos+4 : pos+8])
+		if length < 0 || pos+12+length > len(data) {
+			break
+		}
+		chunk := data[pos+8 : pos+8+length]
+		pos += 12 + length
+
+		switch typ {
+		case "tEXt":
+			if key, val, ok := bytes.Cut(chunk, []byte{0}); ok {
+				// tEXt is Latin-1; widen each byte to a rune
+				runes := make([]rune, len(val))
+				for i, b := range val {
+					runes[i] = rune(b)
+				}
+				text[string(key)] = string(runes)
+			}
+		case "iTXt":
+			key, rest, ok := bytes.Cut(chunk, []byte{0})
+			if !ok || len(rest) < 2 {
+				continue
+			}
+			compressed := rest[0] == 1
+			rest = rest[2:]
+			if _, rest, ok = bytes.Cut(rest, []byte{0}); !ok { // language tag
+				continue
+			}
+			if _, rest, ok = bytes.Cut(rest, []byte{0}); !ok { // translated keyword
+				continue
+			}
+			if compressed {
+				zr, err := zlib.NewReader(bytes.NewReader(rest))
+				if err != nil {
+					continue
+				}
+				rest, err = io.ReadAll(zr)
+				if err != nil {
+					continue
+				}
+			}
+			text[string(key)] = string(rest)
+		case "IEND":
+			return text
+		}
+	}
+	return text
+}
+
+func readPNGMetadata(data []byte) *imageMetadata {
+	text := readPNGText(data)
+	if text["nanobanana:prompt"] == "" && text["nanobanana:model"] == "" {
+		return nil
+	}
+	meta := &imageMetadata{
+		Prompt: text["nanobanana:prompt"],
+		Model:  text["nanobanana:model"],
+		Aspect: text["nanobanana:aspect"],
+		Size:   text["nanobanana:size"],
+	}
+	if seed, err := strconv.ParseInt(text["nanobanana:seed"], 10, 64); err == nil {
+		meta.Seed = &seed
+	}
+	if created, err := time.Parse(time.RFC3339, text["Creation Time"]); err == nil {
+		meta.Created = created
+	}
+	return meta
+}
+
+func readJPEGMetadata(data []byte) *imageMetadata {
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xff {
+		marker := data[pos+1]
+		if marker == 0xd9 || marker == 0xda { // EOI or start of scan
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		payload := data[pos+4 : pos+2+length]
+		pos += 2 + length
+		if marker == 0xe1 && bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			comment := readEXIFUserComment(payload[6:])
+			if len(comment) <= 8 {
+				continue
+			}
+			var meta imageMetadata
+			// The first 8 bytes of UserComment name its character code
+			if err := json.Unmarshal(comment[8:], &meta); err == nil && (meta.Prompt != "" || meta.Model != "") {
+				return &meta
+			}
+		}
+	}
+	return nil
+}
+
+// readEXIFUserComment returns the raw UserComment value from a TIFF
+// structure, or nil if it has none.
+func readEXIFUserComment(tiff []byte) []byte {
+	order := tiffByteOrder(tiff)
+	if order == nil {
+		return nil
+	}
+	ptr := tiffEntry(tiff, order, order.Uint32(tiff[4:]), exifTagExifIFD)
+	if len(ptr) != 4 {
+		return nil
+	}
+	return tiffEntry(tiff, order, order.Uint32(ptr), exifTagUserComment)
+}
+
+// tiffByteOrder returns the byte order of a TIFF structure, or nil if the
+// header is invalid.
+func tiffByteOrder(tiff []byte) binary.ByteOrder {
+	if len(tiff) < 8 {
+		return nil
+	}
+	switch string(tiff[:2]) {
+	case "MM":
+		return binary.BigEndian
+	case "II":
+		return binary.LittleEndian
+	}
+	return nil
+}
+
+// tiffEntry returns the value bytes of tag in the IFD at offset off, or
+// nil if the IFD has no such tag.
+func tiffEntry(tiff []byte, order binary.ByteOrder, off uint32, tag uint16) []byte {
+	if uint64(off)+2 > uint64(len(tiff)) {
+		return nil
+	}
+	n := int(order.Uint16(tiff[off:]))
+	for i := range n {
+		e := int(off) + 2 + 12*i
+		if e+12 > len(tiff) {
+			return nil
+		}
+		if order.Uint16(tiff[e:]) != tag {
+			continue
+		}
+		typ := order.Uint16(tiff[e+2:])
+		count := uint64(order.Uint32(tiff[e+4:]))
+		unit := uint64(1)
+		switch typ {
+		case exifTypeShort:
+			unit = 2
+		case exifTypeLong:
+			unit = 4
+		}
+		size := count * unit
+		if size <= 4 {
+			return tiff[e+8 : e+8+int(size)]
+		}
+		valOff := uint64(order.Uint32(tiff[e+8:]))
+		if valOff+size > uint64(len(tiff)) {
+			return nil
+		}
+		return tiff[valOff : valOff+size]
+	}
+	return nil
+}
+
+// jpegOrientation returns the EXIF orientation (1-8) of JPEG data, or 1
+// when it has none.
+func jpegOrientation(data []byte) int {
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xff {
+		marker := data[pos+1]
+		if marker == 0xd9 || marker == 0xda { // EOI or start of scan
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			break
+		}
+		payload := data[pos+4 : pos+2+length]
+		pos += 2 + length
+		if marker != 0xe1 || !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			continue
+		}
+		tiff := payload[6:]
+		order := tiffByteOrder(tiff)
+		if order == nil {
+			continue
+		}
+		if v := tiffEntry(tiff, order, order.Uint32(tiff[4:]), exifTagOrientation); len(v) == 2 {
+			if o := int(order.Uint16(v)); o >= 1 && o <= 8 {
+				return o
+			}
+		}
+		return 1
+	}
+	return 1
+}
+
+// stripJPEGMetadata removes EXIF and XMP (APP1), IPTC (APP13) and comment
+// segments from JPEG data without re-encoding it, so pixels are unchanged.
+// Color-relevant segments (JFIF, ICC profiles, Adobe) are kept, and data
+// that isn't JPEG is returned as is.
+func stripJPEGMetadata(data []byte) []byte {
+	if !bytes.HasPrefix(data, []byte{0xff, 0xd8}) {
+		return data
+	}
+	out := append(make([]byte, 0, len(data)), data[:2]...)
+	pos := 2
+	for pos+4 <= len(data) && data[pos] == 0xff {
+		marker := data[pos+1]
+		if marker == 0xda { // start of scan: the rest is image data
+			break
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return data
+		}
+		if marker != 0xe1 && marker != 0xed && marker != 0xfe {
+			out = append(out, data[pos:pos+2+length]...)
+		}
+		pos += 2 + length
+	}
+	return append(out, data[pos:]...)
+}
+
+// orientImage returns img transformed so that an image stored with the
+// given EXIF orientation displays upright.
+func orientImage(img image.Image, orientation int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	dw, dh := w, h
+	if orientation >= 5 { // 5-8 swap width and height
+		dw, dh = h, w
+	}
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := range dh {
+		for x := range dw {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // rotated 180
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // needs 90 clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // needs 90 counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			out.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return out
+}
+
+// uprightJPEG re-encodes a JPEG with an EXIF orientation so its pixels
+// are stored upright. The model ignores EXIF, so without this phone photos
+// can be edited (and returned) sideways. Other data is returned unchanged.
+func uprightJPEG(data []byte) []byte {
+	orientation := jpegOrientation(data)
+	if orientation == 1 {
+		return data
+	}
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return data
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orientImage(img, orientation), &jpeg.Options{Quality: defaultJPEGQuality}); err != nil {
+		return data
+	}
+	debugf("Rotated input upright (EXIF orientation %d)", orientation)
+	return buf.Bytes()
+}
+
+// --- Output helpers ---
+
+// joinInts formats a list of indices as "1, 2, 3" (or "none" when empty).
+func joinInts(nums []int) string {
+	if len(nums) == 0 {
+		return "none"
+	}
+	parts := make([]string, len(nums))
+	for i, n := range nums {
+		parts[i] = strconv.Itoa(n)
+	}
+	return strings.Join(parts, ", ")
+}
+
+func success(format string, args ...any) {
+	logf(slog.LevelInfo, format, args...)
+	if !quiet {
+		fmt.Fprintf(os.Stderr, colorGreen+"✓ "+colorReset+format+"\n", args...)
+	}
+}
+
+func info(format string, args ...any) {
+	logf(slog.LevelInfo, format, args...)
+	if !quiet {
+		fmt.Fprintf(os.Stderr, colorBlue+"→ "+colorReset+format+"\n", args...)
+	}
+}
+
+func warn(format string, args ...any) {
+	logf(slog.LevelWarn, format, args...)
+	if !quiet {
+		fmt.Fprintf(os.Stderr, colorYellow+"⚠ "+colorReset+format+"\n", args...)
+	}
+}
+
+func errorf(format string, args ...any) {
+	logf(slog.LevelError, format, args...)
+	if jsonOutput {
+		json.NewEncoder(os.Stdout).Encode(jsonError{Error: fmt.Sprintf(format, args...)})
+		return
+	}
+	fmt.Fprintf(os.Stderr, colorRed+"✗ "+colorReset+format+"\n", args...)
+}
+
+// auditLog receives structured log lines when --log-file is set.
+var auditLog *slog.Logger
+
+// openLogFile starts appending JSON log lines to path. Each line goes out in
+// a single O_APPEND write, so concurrent runs sharing a file don't interleave.
+func openLogFile(path string) (func(), error) {
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	auditLog = slog.New(slog.NewJSONHandler(file, nil))
+	return func() {
+		auditLog = nil
+		file.Close()
+	}, nil
+}
+
+// logf writes a message to the --log-file log, whatever --quiet says.
+func logf(level slog.Level, format string, args ...any) {
+	if auditLog != nil {
+		auditLog.Log(context.Background(), level, fmt.Sprintf(format, args...))
+	}
+}
+
+// logResult records a saved image and its metadata in the --log-file log.
+func logResult(command string, r jsonResult) {
+	if auditLog == nil {
+		return
+	}
+	attrs := []any{
+		"command", command,
+		"file", r.File,
+		"model", r.Model,
+		"prompt", r.Prompt,
+		"bytes", r.Bytes,
+		"mime_type", r.MIMEType,
+		"aspect", r.Aspect,
+		"size", r.Size,
+		"estimated_cost_usd", r.Cost,
+	}
+	if r.Seed != nil {
+		attrs = append(attrs, "seed", *r.Seed)
+	}
+	if r.EffectivePrompt != "" {
+		attrs = append(attrs, "effective_prompt", r.EffectivePrompt)
+	}
+	auditLog.Info("image saved", attrs...)
+}
+
+// expensiveRunCost is the estimated cost from which confirm_expensive asks
+// before a run: one pro image at 4K, or a batch of several.
+const expensiveRunCost = 0.20
+
+// wantsConfirm reports whether a run estimated at cost needs a yes first:
+// always with --confirm, and with confirm_expensive once a known price
+// reaches expensiveRunCost.
+func (f *imageFlags) wantsConfirm(cost float64, priced bool) bool {
+	return f.confirm || (f.confirmCost && priced && cost >= expensiveRunCost)
+}
+
+// confirmSpend asks before spending on what (e.g. "1 image with ... (16:9,
+// 4K)") when wantsConfirm says so, and returns false if the user says no.
+// Quiet runs and ones without a terminal on stdin never ask.
+func (f *imageFlags) confirmSpend(what string, cost float64, priced bool) bool {
+	if !f.wantsConfirm(cost, priced) || quiet || !term.IsTerminal(int(os.Stdin.Fd())) {
+		return true
+	}
+	estimate := "cost unknown"
+	if priced {
+		estimate = fmt.Sprintf("~$%.2f", cost)
+	}
+	info("About to generate %s: %s", what, estimate)
+	return confirm("Proceed?")
+}
+
+// confirm asks a yes/no question on stderr and reads the answer from stdin.
+func confirm(question string) bool {
+	fmt.Fprintf(os.Stderr, "%s [y/N] ", question)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// --- Spinner ---
+
+// spinnerMsg is the message shown by the active spinner; updateSpinner
+// changes it mid-flight (e.g. to report retries).
+var (
+	spinnerMu  sync.Mutex
+	spinnerMsg string
+)
+
+// noSpinner replaces the spinner with a single static line, for
+// --no-spinner or NANOBANANA_NO_SPINNER.
+var noSpinner bool
+
+func startSpinner(msg string) func() {
+	spinnerMu.Lock()
+	spinnerMsg = msg
+	spinnerMu.Unlock()
+
+	if quiet || noSpinner || !ansiTerminal() {
+		if !quiet {
+			fmt.Fprintln(os.Stderr, msg)
+		}
+		return func() {}
+	}
+
+	frames := []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+	var mu sync.Mutex
+	done := false
+
+	go func() {
+		i := 0
+		for {
+			mu.Lock()
+			if done {
+				mu.Unlock()
+				return
+			}
+			mu.Unlock()
+
+			spinnerMu.Lock()
+			cur := spinnerMsg
+			spinnerMu.Unlock()
+			fmt.Fprintf(os.Stderr, "\r\033[K%s%s%s %s", colorCyan, frames[i%len(frames)], colorReset, cur)
+			i++
+			time.Sleep(80 * time.Millisecond)
+		}
+	}()
+
+	return func() {
+		mu.Lock()
+		done = true
+		mu.Unlock()
+		fmt.Fprintf(os.Stderr, "\r\033[K") // Clear line
+	}
+}
+
+// updateSpinner replaces the active spinner message. When no animated
+// spinner is running, the message is printed as a plain status line.
+func updateSpinner(msg string) {
+	setSpinnerMsg(msg)
+	if !quiet && !term.IsTerminal(int(os.Stderr.Fd())) {
+		fmt.Fprintln(os.Stderr, msg)
+	}
+}
+
+// setSpinnerMsg changes the animated spinner's message without printing
+// anything when there is no animation, for frequent progress updates.
+func setSpinnerMsg(msg string) {
+	spinnerMu.Lock()
+	spinnerMsg = msg
+	spinnerMu.Unlock()
+}
+
+// --- JSON output ---
+
+type jsonResult struct {
+	File            string      `json:"file,omitempty"`
+	Input           string      `json:"input,omitempty"` // the source image, with edit --input-dir
+	Model           string      `json:"model"`
+	Prompt          string      `json:"prompt"`
+	EffectivePrompt string      `json:"effective_prompt,omitempty"` // set when a prefix, suffix or --auto-fix changed the prompt
+	Bytes           int         `json:"bytes,omitempty"`
+	MIMEType        string      `json:"mime_type,omitempty"`
+	Aspect          string      `json:"aspect,omitempty"`
+	Size            string      `json:"size,omitempty"`
+	Seed            *int64      `json:"seed,omitempty"`
+	System          string      `json:"system,omitempty"`
+	Cost            float64     `json:"estimated_cost_usd,omitempty"`
+	SynthID         bool        `json:"synthid,omitempty"`             // Gemini output carries an invisible SynthID watermark
+	Credentials     bool        `json:"content_credentials,omitempty"` // the API's image came with C2PA content credentials
+	Skipped         bool        `json:"skipped,omitempty"`             // --skip-existing found the file already there
+	Blocked         bool        `json:"blocked,omitempty"`             // the safety filter withheld the image
+	Text            string      `json:"text,omitempty"`                // the model's text, with --with-text
+	ExtraFiles      []string    `json:"extra_files,omitempty"`         // further images in the reply, with --all-parts
+	Usage           *tokenUsage `json:"usage,omitempty"`               // token counts from the response's usageMetadata
+	Thumbnail       string      `json:"thumbnail,omitempty"`           // the --thumbnail copy
+	HookError       string      `json:"hook_error,omitempty"`          // how the --on-success command failed
+	Error           string      `json:"error,omitempty"`
+}
+
+type jsonError struct {
+	Error string `json:"error"`
+}
+
+// --- Preview ---
+
+func openFile(path string) error {
+	return openCommand(runtime.GOOS, path).Start()
+}
+
+// openCommand returns the command that opens path in the default viewer.
+// On Windows, "start" is a cmd.exe builtin, so use rundll32 instead.
+func openCommand(goos, path string) *exec.Cmd {
+	switch goos {
+	case "darwin":
+		return exec.Command("open", path)
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", path)
+	default:
+		return exec.Command("xdg-open", path)
+	}
+}
+
+// --- Validation ---
+
+// validateImageOptions checks an aspect ratio and size against a resolved
+// full model name, before any network or key lookup happens.
+func validateImageOptions(model, aspect, size string) error {
+	if err := validateAspectRatio(aspect, model); err != nil {
+		return err
+	}
+	return validateImageSize(size, model)
+}
+
+func validateAspectRatio(ar, model string) error {
+	validSet := validAspectRatios
+	if isProModel(model) || isLegacyModel(model) {
+		validSet = validAspectRatiosProLegacy
+	}
+
+	if !validSet[ar] {
+		return fmt.Errorf("invalid aspect ratio %q (valid: %s)", ar, strings.Join(supportedAspectRatios(model), ", "))
+	}
+	return nil
+}
+
+// supportedAspectRatios returns the aspect ratios a model accepts, in display order.
+func supportedAspectRatios(model string) []string {
+	validSet := validAspectRatios
+	if isProModel(model) || isLegacyModel(model) {
+		validSet = validAspectRatiosProLegacy
+	}
+	var out []string
+	for _, ar := range aspectRatioOrder {
+		if validSet[ar] {
+			out = append(out, ar)
+		}
+	}
+	return out
+}
+
+// nearestAspectRatio maps width x height to the closest aspect ratio the
+// model supports. ok is false when even the closest is more than about
+// 10% off, e.g. a very tall image on a model without 1:4.
+func nearestAspectRatio(model string, width, height int) (ar string, ok bool) {
+	if width <= 0 || height <= 0 {
+		return "1:1", false
+	}
+	ar, dist := closestAspectRatio(model, float64(width)/float64(height))
+	if dist > 0.1 {
+		return "1:1", false
+	}
+	return ar, true
+}
+
+// closestAspectRatio returns the supported aspect ratio nearest to ratio
+// (width over height) and how far off it is, in log scale so 2:1 and 1:2
+// are equally far from 1:1.
+func closestAspectRatio(model string, ratio float64) (ar string, dist float64) {
+	target := math.Log(ratio)
+	dist = math.Inf(1)
+	for _, candidate := range supportedAspectRatios(model) {
+		w, h, _ := parseRatio(candidate)
+		if d := math.Abs(math.Log(w/h) - target); d < dist {
+			ar, dist = candidate, d
+		}
+	}
+	return ar, dist
+}
+
+// parseRatio reads a ratio written as W:H, such as 2.35:1, or as pixel
+// dimensions WxH, such as 1920x1080.
+func parseRatio(s string) (w, h float64, ok bool) {
+	ws, hs, found := strings.Cut(s, ":")
+	if !found {
+		ws, hs, found = strings.Cut(strings.ToLower(s), "x")
+	}
+	if !found {
+		return 0, 0, false
+	}
+	w, errW := strconv.ParseFloat(strings.TrimSpace(ws), 64)
+	h, errH := strconv.ParseFloat(strings.TrimSpace(hs), 64)
+	if errW != nil || errH != nil || !(w > 0 && h > 0) || math.IsInf(w/h, 0) {
+		return 0, 0, false
+	}
+	return w, h, true
+}
+
+// snapAspectRatio turns a free-form --aspect such as 2.35:1 or 1920x1080
+// into the nearest ratio the model supports, warning about the choice.
+// Supported ratios and values that aren't ratios at all come back as they
+// are, for validateAspectRatio to accept or reject.
+func snapAspectRatio(ar, model string) string {
+	if slices.Contains(supportedAspectRatios(model), ar) {
+		return ar
+	}
+	w, h, ok := parseRatio(ar)
+	if !ok {
+		return ar
+	}
+	nearest, _ := closestAspectRatio(model, w/h)
+	warn("aspect ratio %s isn't supported by %s; using the nearest, %s", ar, model, nearest)
+	return nearest
+}
+
+// autoAspectRatio picks the aspect ratio for --aspect auto from an edit's
+// first input image, falling back to 1:1 with a warning.
+func autoAspectRatio(model string, img inputImage) string {
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(img.Data))
+	if err != nil {
+		warn("--aspect auto could not read the input image size; using 1:1")
+		return "1:1"
+	}
+	ar, ok := nearestAspectRatio(model, cfg.Width, cfg.Height)
+	if !ok {
+		warn("no supported aspect ratio is close to the %dx%d input; using 1:1", cfg.Width, cfg.Height)
+		return ar
+	}
+	info("Using aspect ratio %s for the %dx%d input", ar, cfg.Width, cfg.Height)
+	return ar
+}
+
+// supportedSizes returns the image sizes a model accepts, in display order.
+func supportedSizes(model string) []string {
+	var out []string
+	for _, size := range sizeOrder {
+		if validateImageSize(size, model) == nil {
+			out = append(out, size)
+		}
+	}
+	return out
+}
+
+func validateImageSize(size, model string) error {
+	if _, ok := validSizes[size]; !ok {
+		return fmt.Errorf("invalid size %q (valid: %s)", size, strings.Join(supportedSizes(model), ", "))
+	}
+	if !modelSupportsImageSize(model) && size != "1K" {
+		return fmt.Errorf("model %q supports only --size 1K", model)
+	}
+	if size == "512px" && !modelSupports512Size(model) {
+		return fmt.Errorf("size 512px is only supported by %s", modelFlash)
+	}
+	return nil
+}
+
+// isProModel returns true if the model string refers to the pro model,
+// whether by alias or full model name.
+func isProModel(model string) bool {
+	return model == "pro" || model == modelPro
+}
+
+func isLegacyModel(model string) bool {
+	return model == "legacy" || model == modelLegacy
+}
+
+func modelSupportsImageSize(model string) bool {
+	return !isLegacyModel(model)
+}
+
+// responseMIMEType returns the MIME type to request for a
+// --response-format value, checked against a resolved model. Only PNG and
+// JPEG can be requested, and the legacy model always returns PNG.
+func responseMIMEType(format, model string) (string, error) {
+	if format == "" {
+		return "", nil
+	}
+	mime := formatMIMETypes[format]
+	if mime != "image/png" && mime != "image/jpeg" {
+		return "", fmt.Errorf("invalid --response-format %q (valid: png, jpg)", format)
+	}
+	if isLegacyModel(model) {
+		return "", fmt.Errorf("model %q does not support --response-format", model)
+	}
+	return mime, nil
+}
+
+func modelSupports512Size(model string) bool {
+	return model == "flash" || model == modelFlash
+}
+
+// resolveModel maps an alias to a full model name, or passes through
+// a full model name directly.
+func resolveModel(alias string) (string, error) {
+	if full, ok := modelAliases[alias]; ok {
+		return full, nil
+	}
+	// Accept full model names (anything containing a hyphen)
+	if strings.Contains(alias, "-") {
+		return alias, nil
+	}
+	return "", fmt.Errorf("unknown model %q (valid: flash, pro, legacy, or a full model name)", alias)
+}
 
 // --- Commands ---
 
-func main() {
-	os.Exit(run())
+func main() {
+	os.Exit(run())
+}
+
+func run() int {
+	// Ctrl-C cancels in-flight API calls so commands can clean up and
+	// report it; between calls it exits at once. A second Ctrl-C always
+	// kills the process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	rootCtx = ctx
+	go func() {
+		<-ctx.Done()
+		stop()
+		if apiCalls.Load() == 0 {
+			fmt.Fprintln(os.Stderr)
+			errorf("canceled")
+			os.Exit(exitCanceled)
+		}
+	}()
+
+	code := runCommand()
+	if ctx.Err() != nil {
+		return exitCanceled
+	}
+	return code
+}
+
+func runCommand() int {
+	args, noColor := stripBoolFlag(os.Args[1:], "no-color")
+	args, envOverride := stripBoolFlag(args, "env-override")
+	args, envPath, err := stripValueFlag(args, "env-file", "a file path")
+	if err == nil && envPath != "" {
+		err = loadEnvFile(expandPath(envPath), envOverride)
+	}
+	if !useColor(noColor) {
+		disableColor()
+	}
+	if err != nil {
+		errorf("%v", err)
+		return exitCode(err)
+	}
+	args, cfgPath, err := stripValueFlag(args, "config", "a file path")
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	if cfgPath != "" {
+		configOverride = expandPath(cfgPath)
+	}
+	args, logPath, err := stripValueFlag(args, "log-file", "a file path")
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	args, authOverride, err = stripValueFlag(args, "auth", "an auth method (api-key or adc)")
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	if logPath != "" {
+		closeLog, err := openLogFile(expandPath(logPath))
+		if err != nil {
+			errorf("opening log file: %v", err)
+			return exitIO
+		}
+		defer closeLog()
+	}
+	if len(args) == 0 {
+		printUsage()
+		return 0
+	}
+
+	// Check for updates (skip for version/help/upgrade/readme commands)
+	skipCheck := args[0] == "version" || args[0] == "help" || args[0] == "--help" || args[0] == "-h" || args[0] == "upgrade" || args[0] == "readme"
+	if !skipCheck {
+		checkForUpdates()
+	}
+
+	switch args[0] {
+	case "generate", "gen":
+		return runGenerate(args[1:])
+	case "edit":
+		return runEdit(args[1:])
+	case "models":
+		return runModels(args[1:])
+	case "info":
+		return runInfo(args[1:])
+	case "styles":
+		return runStyles(args[1:])
+	case "describe":
+		return runDescribe(args[1:])
+	case "validate", "doctor":
+		return runValidate(args[1:])
+	case "history":
+		return runHistory(args[1:])
+	case "repl":
+		return runRepl(args[1:])
+	case "setup":
+		return runSetup()
+	case "config":
+		return runConfig(args[1:])
+	case "completion":
+		return runCompletion(args[1:])
+	case "version":
+		printVersion()
+		return 0
+	case "upgrade":
+		return runUpgrade()
+	case "readme":
+		fmt.Print(readmeContent)
+		return 0
+	case "help", "--help", "-h":
+		printUsage()
+		return 0
+	default:
+		errorf("unknown command: %s (try 'nanobanana help')", args[0])
+		return 1
+	}
+}
+
+// imageFlags holds the flags shared by generate and edit.
+type imageFlags struct {
+	model          string
+	output         string
+	outputDir      string
+	format         string
+	responseFormat string
+	aspect         string
+	size           string
+	quiet          bool
+	noSpinner      bool
+	json           bool
+	preview        bool
+	stdout         bool
+	noMetadata     bool
+	quality        int
+	proxy          string
+	profile        string
+	autoFix        bool
+	autoFixRules   []autoFixRule
+	retryOnBlock   bool
+	exitOnBlock    bool
+	session        string
+	safety         string
+	system         string
+	promptPrefix   string
+	promptSuffix   string
+	onSuccess      string
+	hookArgs       []string // onSuccess split into words
+	failOnHook     bool
+	style          string
+	styleText      string // the prompt fragment --style resolved to
+	stream         bool
+	verbose        bool
+	saveRequest    string
+	saveResponse   string
+	retries        int
+	rps            float64
+	retryMaxWait   time.Duration
+	timeout        time.Duration
+	retryTimeout   time.Duration // --timeout-per-retry
+	mock           bool
+	promptWarn     int
+	overwrite      bool
+	confirm        bool
+	confirmCost    bool // confirm_expensive from the config
+	noClobber      bool
+	nameFromPrompt bool
+	nameTemplate   string
+	nameTmpl       *template.Template // parsed --name-template or output_template
+	nameHasIndex   bool               // the template numbers batch images itself
+	disclose       bool
+	withText       bool
+	manifest       bool
+	allParts       bool
+	showUsage      bool
+	setFlags       map[string]string // flags given on the command line, for --manifest
+	mask           string            // edit only
+	stripEXIF      bool              // edit only
+	inputDir       string            // edit only
+	glob           string            // edit only, with --input-dir
+	promptFile     string            // generate and edit
+	from           string            // generate only
+	maxBytes       int64             // refuse results larger than this; 0 for no limit
+	targetSize     int64             // pick the JPEG quality that fits this; 0 for none
+	crop           *cropSpec
+	thumbnail      image.Point // --thumbnail box; zero for none
+	seed           *int64
+}
+
+func (f *imageFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.model, "model", "", "model: flash, pro, legacy, or full model name")
+	fs.StringVar(&f.model, "m", "", "model (shorthand)")
+	fs.StringVar(&f.output, "output", "", "output file path")
+	fs.StringVar(&f.output, "o", "", "output file path (shorthand)")
+	fs.StringVar(&f.outputDir, "output-dir", "", "directory for auto-named output files")
+	fs.StringVar(&f.format, "format", "", "output format: png, jpg, webp, gif (overrides the extension)")
+	fs.StringVar(&f.responseFormat, "response-format", "", "image format to ask the API for: png, jpg")
+	fs.StringVar(&f.aspect, "aspect", "", "aspect ratio (default 1:1)")
+	fs.StringVar(&f.aspect, "a", "", "aspect ratio (shorthand)")
+	fs.StringVar(&f.size, "size", "", "image size: 512px, 1K, 2K, 4K (default 1K)")
+	fs.StringVar(&f.size, "s", "", "image size (shorthand)")
+	fs.BoolVar(&f.quiet, "quiet", false, "suppress output, print only file path")
+	fs.BoolVar(&f.quiet, "q", false, "suppress output (shorthand)")
+	fs.BoolVar(&f.noSpinner, "no-spinner", false, "print a static progress line instead of the spinner")
+	fs.BoolVar(&f.json, "json", false, "output result as JSON")
+	fs.BoolVar(&f.preview, "preview", false, "open image after saving")
+	fs.BoolVar(&f.preview, "p", false, "open image after saving (shorthand)")
+	fs.BoolVar(&f.preview, "open", false, "open image after saving (alias for --preview)")
+	fs.BoolVar(&f.stdout, "stdout", false, "write image bytes to stdout (same as -o -)")
+	fs.BoolVar(&f.noMetadata, "no-metadata", false, "don't embed prompt metadata in output files")
+	fs.BoolVar(&f.overwrite, "overwrite", false, "replace an existing --output file")
+	fs.BoolVar(&f.confirm, "confirm", false, "show the model, size and estimated cost and ask before calling the API")
+	fs.BoolVar(&f.noClobber, "no-clobber", false, "save to a new numbered name when the --output file exists")
+	fs.BoolVar(&f.nameFromPrompt, "name-from-prompt", false, "start auto-generated file names with a slug of the prompt")
+	fs.StringVar(&f.nameTemplate, "name-template", "", "template for auto-generated file names, e.g. {{.Slug}}-{{.Model}}{{.Ext}}")
+	fs.BoolVar(&f.disclose, "disclose", false, "note that outputs carry an invisible SynthID watermark")
+	fs.BoolVar(&f.withText, "with-text", false, "ask for text alongside the image and print it")
+	fs.BoolVar(&f.manifest, "manifest", false, "write a JSON manifest next to each saved image")
+	fs.BoolVar(&f.allParts, "all-parts", false, "save every image in the reply, not just the first")
+	fs.BoolVar(&f.showUsage, "show-usage", false, "print the prompt, candidate and total token counts")
+	fs.IntVar(&f.quality, "quality", defaultJPEGQuality, "JPEG quality (1-100)")
+	fs.StringVar(&f.proxy, "proxy", "", "proxy URL (overrides HTTP(S)_PROXY)")
+	fs.StringVar(&f.profile, "profile", "", "config profile (overrides NANOBANANA_PROFILE)")
+	fs.BoolVar(&f.autoFix, "auto-fix", false, "on a 400 INVALID_ARGUMENT, retry once with a softened prompt")
+	fs.BoolVar(&f.retryOnBlock, "retry-on-block", false, "when the safety filter blocks an image, retry once (softened by the auto-fix rules)")
+	fs.BoolVar(&f.exitOnBlock, "exit-on-block", false, "stop a batch at the first image the safety filter blocks")
+	fs.StringVar(&f.session, "session", "", "session file that carries conversation turns between runs")
+	fs.StringVar(&f.system, "system", "", "system instruction applied to every prompt")
+	fs.StringVar(&f.promptPrefix, "prompt-prefix", "", "text put before every prompt")
+	fs.StringVar(&f.promptPrefix, "prepend-prompt", "", "text put before every prompt (alias for --prompt-prefix)")
+	fs.StringVar(&f.promptSuffix, "prompt-suffix", "", "text put after every prompt, e.g. \", high detail, studio lighting\"")
+	fs.StringVar(&f.promptSuffix, "append-prompt", "", "text put after every prompt (alias for --prompt-suffix)")
+	fs.StringVar(&f.onSuccess, "on-success", "", "command run after each image is saved; {} is replaced by the path, e.g. \"aws s3 cp {} s3://bucket/\"")
+	fs.BoolVar(&f.failOnHook, "fail-on-hook", false, "exit with code 8 if an --on-success command fails")
+	fs.StringVar(&f.style, "style", "", "style preset appended to every prompt, e.g. anime (see nanobanana styles)")
+	fs.StringVar(&f.safety, "safety", "default", "safety filter level: default, relaxed, strict")
+	fs.BoolVar(&f.stream, "stream", false, "use the streaming endpoint and show download progress")
+	fs.BoolVar(&f.verbose, "verbose", false, "log API requests and responses to stderr")
+	fs.BoolVar(&f.verbose, "v", false, "log API requests and responses (shorthand)")
+	fs.BoolVar(&f.verbose, "debug", false, "log API requests and responses (alias for --verbose)")
+	fs.StringVar(&f.saveRequest, "save-request", "", "write the request JSON, image data truncated, to this file")
+	fs.StringVar(&f.saveResponse, "save-response", "", "write the raw response body to this file")
+	fs.IntVar(&f.retries, "retries", maxRetries, "retries on rate limit or server errors")
+	fs.DurationVar(&f.retryMaxWait, "retry-max-wait", retryMaxWait, "maximum wait between retries")
+	fs.Float64Var(&f.rps, "rps", 0, "maximum API requests per second, shared by all workers (0 for no limit)")
+	fs.DurationVar(&f.timeout, "timeout", 0, "give up on a request after this long, including retries (0 for no limit)")
+	fs.BoolVar(&f.mock, "mock", false, "don't call the API; save a small placeholder image (for testing scripts)")
+	fs.DurationVar(&f.retryTimeout, "timeout-per-retry", 0, "abandon and retry an attempt that takes longer than this (0 for no limit)")
+	fs.Func("max-bytes", "refuse to save images larger than this, e.g. 15MB", func(v string) error {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return err
+		}
+		f.maxBytes = n
+		return nil
+	})
+	fs.Func("crop", "crop the result to a centered aspect ratio, e.g. 16:9, or to x,y,w,h", func(v string) error {
+		c, err := parseCrop(v)
+		if err != nil {
+			return err
+		}
+		f.crop = c
+		return nil
+	})
+	fs.Func("thumbnail", "also save a downscaled copy that fits WxH, e.g. 256x256, as name_thumb.ext", func(v string) error {
+		box, err := parseThumbnail(v)
+		if err != nil {
+			return err
+		}
+		f.thumbnail = box
+		return nil
+	})
+	fs.Func("target-size", "lower JPEG quality until the file fits this size, e.g. 200KB", func(v string) error {
+		n, err := parseByteSize(v)
+		if err != nil {
+			return err
+		}
+		f.targetSize = n
+		return nil
+	})
+	fs.Func("seed", "seed for reproducible generation", func(v string) error {
+		seed, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid seed %q", v)
+		}
+		f.seed = &seed
+		return nil
+	})
+}
+
+// resolve fills unset flags from the config, applies the model precedence
+// rules, resolves aliases to a full model name and validates --aspect and
+// --size against it.
+func (f *imageFlags) resolve(cfg *Config) (string, error) {
+	if f.system == "" {
+		f.system = cfg.System
+	}
+	f.promptPrefix = cmp.Or(f.promptPrefix, cfg.PromptPrefix)
+	f.promptSuffix = cmp.Or(f.promptSuffix, cfg.PromptSuffix)
+	if f.style != "" {
+		text, err := lookupStyle(cfg, f.style)
+		if err != nil {
+			return "", err
+		}
+		f.styleText = text
+	}
+	f.promptWarn = defaultPromptWarn
+	if cfg.PromptWarn > 0 {
+		f.promptWarn = cfg.PromptWarn
+	}
+	f.confirmCost = cfg.ConfirmExpensive
+	f.autoFixRules = defaultAutoFixRules
+	if len(cfg.AutoFix) > 0 {
+		rules, err := compileAutoFix(cfg.AutoFix)
+		if err != nil {
+			return "", err
+		}
+		f.autoFixRules = rules
+	}
+	if text := cmp.Or(f.nameTemplate, cfg.OutputTemplate); text != "" {
+		tmpl, err := parseNameTemplate(text)
+		if err != nil {
+			return "", err
+		}
+		f.nameTmpl, f.nameHasIndex = tmpl, strings.Contains(text, ".Index")
+	}
+	// CLI flag > NANOBANANA_ASPECT/NANOBANANA_SIZE env > config file > default
+	f.aspect = cmp.Or(f.aspect, os.Getenv("NANOBANANA_ASPECT"), cfg.Aspect, "1:1")
+	f.size = cmp.Or(f.size, os.Getenv("NANOBANANA_SIZE"), cfg.Size, "1K")
+	f.model = resolveModelFlag(f.model, cfg)
+	modelName, err := resolveModel(f.model)
+	if err != nil {
+		return "", err
+	}
+	f.aspect = snapAspectRatio(f.aspect, modelName)
+	if err := validateImageOptions(modelName, f.aspect, f.size); err != nil {
+		return "", err
+	}
+	if _, err := responseMIMEType(f.responseFormat, modelName); err != nil {
+		return "", err
+	}
+	return modelName, nil
+}
+
+// Prompt length limits in characters, counting the system instruction.
+// Long prompts get a warning (prompt_warn_length in config); past
+// maxPromptLength the API would reject the request anyway.
+const (
+	defaultPromptWarn = 4000
+	maxPromptLength   = 100000
+)
+
+// checkPrompt warns about a long prompt and rejects one that is too long
+// to send.
+func (f *imageFlags) checkPrompt(prompt string) error {
+	prompt = f.buildPrompt(prompt)
+	n := utf8.RuneCountInString(f.system) + utf8.RuneCountInString(prompt)
+	if n > maxPromptLength {
+		return fmt.Errorf("prompt is too long (%d characters including the system instruction, max %d)", n, maxPromptLength)
+	}
+	if n > f.promptWarn {
+		excerpt := prompt
+		if r := []rune(excerpt); len(r) > 40 {
+			excerpt = string(r[:40]) + "..."
+		}
+		warn("prompt %q is %d characters including the system instruction; long prompts may be rejected or partly ignored", excerpt, n)
+	}
+	return nil
+}
+
+// buildPrompt wraps prompt in --prompt-prefix and --prompt-suffix (or
+// prompt_prefix and prompt_suffix from the config), joined with a space; a
+// suffix that starts with punctuation attaches directly. The --style
+// fragment goes between the prompt and the suffix after a comma. A prompt
+// that already contains them, e.g. one rerun from history, is left as it
+// is.
+func (f *imageFlags) buildPrompt(prompt string) string {
+	if p := strings.TrimSpace(f.promptPrefix); p != "" && !strings.HasPrefix(prompt, p) {
+		prompt = p + " " + prompt
+	}
+	if s := strings.TrimSpace(f.styleText); s != "" && !strings.Contains(prompt, s) {
+		prompt = strings.TrimRight(prompt, " ,.") + ", " + s
+	}
+	if s := strings.TrimSpace(f.promptSuffix); s != "" && !strings.HasSuffix(prompt, s) {
+		if !strings.ContainsAny(s[:1], ",.;:!?") {
+			prompt += " "
+		}
+		prompt += s
+	}
+	return prompt
+}
+
+// builtinStyles are the --style presets, each a prompt fragment. A
+// [styles] entry in the config adds a style or replaces one of these.
+var builtinStyles = map[string]string{
+	"anime":       "anime style, cel shading, clean line art, vibrant colors",
+	"photoreal":   "photorealistic, natural lighting, sharp focus, shot on a 35mm camera, high detail",
+	"pixel-art":   "pixel art, 16-bit retro video game style, limited color palette, crisp square pixels",
+	"watercolor":  "watercolor painting, soft washes, visible paper texture, loose brushstrokes",
+	"line-art":    "black and white line art, clean ink outlines, no shading, white background",
+	"flat-vector": "flat vector illustration, simple geometric shapes, solid colors, no gradients",
+	"3d-render":   "3D render, soft global illumination, smooth materials, studio backdrop",
+	"cinematic":   "cinematic film still, dramatic lighting, shallow depth of field, subtle film grain",
+}
+
+// styleInfo is one entry of nanobanana styles.
+type styleInfo struct {
+	Name   string `json:"name"`
+	Prompt string `json:"prompt"`
+	Custom bool   `json:"custom,omitempty"` // from [styles] in the config
+}
+
+// styleList returns the built-in and configured styles sorted by name.
+func styleList(cfg *Config) []styleInfo {
+	var styles []styleInfo
+	for name, text := range builtinStyles {
+		if _, ok := cfg.Styles[name]; !ok {
+			styles = append(styles, styleInfo{Name: name, Prompt: text})
+		}
+	}
+	for name, text := range cfg.Styles {
+		styles = append(styles, styleInfo{Name: name, Prompt: text, Custom: true})
+	}
+	sort.Slice(styles, func(i, j int) bool { return styles[i].Name < styles[j].Name })
+	return styles
+}
+
+// lookupStyle returns the prompt fragment for a --style name.
+func lookupStyle(cfg *Config, name string) (string, error) {
+	if text, ok := cfg.Styles[name]; ok {
+		return text, nil
+	}
+	if text, ok := builtinStyles[name]; ok {
+		return text, nil
+	}
+	var names []string
+	for _, s := range styleList(cfg) {
+		names = append(names, s.Name)
+	}
+	return "", fmt.Errorf("unknown style %q (available: %s)", name, strings.Join(names, ", "))
+}
+
+// generateFlags holds the flags only the generate command accepts.
+type generateFlags struct {
+	count        int
+	promptsFile  string
+	estimate     bool
+	concurrency  int
+	skipExisting bool
+	matrix       string
+	compare      bool
+}
+
+func (g *generateFlags) register(fs *flag.FlagSet) {
+	fs.IntVar(&g.count, "count", 1, "number of images to generate")
+	fs.IntVar(&g.count, "n", 1, "number of images (shorthand)")
+	fs.StringVar(&g.promptsFile, "prompts-file", "", "file with one prompt per line")
+	fs.BoolVar(&g.estimate, "estimate", false, "print estimated cost and confirm before generating")
+	fs.IntVar(&g.concurrency, "concurrency", 3, "number of batch requests to run at once")
+	fs.BoolVar(&g.skipExisting, "skip-existing", false, "skip images whose output file already exists")
+	fs.StringVar(&g.matrix, "matrix", "", `generate every combination, e.g. "aspect=1:1,16:9 size=1K,2K"`)
+	fs.BoolVar(&g.compare, "compare", false, "generate with both flash and pro and compare size and cost")
+}
+
+// apply validates flag combinations after parsing and sets the global
+// output and retry settings.
+func (f *imageFlags) apply() error {
+	if f.stdout {
+		if f.output != "" {
+			return fmt.Errorf("--stdout cannot be used with --output")
+		}
+		f.output = "-"
+	}
+	if f.targetSize > 0 && f.output == "-" {
+		return fmt.Errorf("--target-size cannot be used when writing to stdout")
+	}
+	if f.quality < 1 || f.quality > 100 {
+		return fmt.Errorf("--quality must be between 1 and 100")
+	}
+	if f.overwrite && f.noClobber {
+		return fmt.Errorf("--overwrite cannot be used with --no-clobber")
+	}
+	if f.allParts && f.output == "-" {
+		return fmt.Errorf("--all-parts cannot be used when writing to stdout")
+	}
+	// Quoted or scripted paths reach us with ~ and $VAR unexpanded
+	f.output = expandPath(f.output)
+	f.outputDir = expandPath(f.outputDir)
+	f.session = expandPath(f.session)
+	f.mask = expandPath(f.mask)
+	f.from = expandPath(f.from)
+	f.saveRequest = expandPath(f.saveRequest)
+	f.saveResponse = expandPath(f.saveResponse)
+	if f.onSuccess != "" {
+		args, err := splitCommand(f.onSuccess)
+		if err != nil {
+			return fmt.Errorf("--on-success: %w", err)
+		}
+		if len(args) == 0 {
+			return fmt.Errorf("--on-success needs a command")
+		}
+		f.hookArgs = args
+	}
+	hookFailures.Store(0)
+	if f.retries < 0 {
+		return fmt.Errorf("--retries must be 0 or greater")
+	}
+	if f.timeout < 0 {
+		return fmt.Errorf("--timeout must be 0 or greater")
+	}
+	if f.retryTimeout < 0 {
+		return fmt.Errorf("--timeout-per-retry must be 0 or greater")
+	}
+	if f.timeout > 0 && f.retryTimeout >= f.timeout {
+		warn("--timeout-per-retry %s is not shorter than --timeout %s, so a slow attempt is never retried", f.retryTimeout, f.timeout)
+	}
+	if f.rps < 0 || math.IsInf(f.rps, 0) || math.IsNaN(f.rps) {
+		return fmt.Errorf("--rps must be 0 or greater")
+	}
+	if _, err := safetySettings(f.safety); err != nil {
+		return err
+	}
+	if err := validateFormat(f.format); err != nil {
+		return err
+	}
+	if f.proxy != "" {
+		proxy, err := parseProxyURL(f.proxy)
+		if err != nil {
+			return err
+		}
+		proxyOverride = proxy
+	}
+	maxRetries = f.retries
+	retryMaxWait = f.retryMaxWait
+	requestRate = f.rps
+	apiTimeout = f.timeout
+	attemptTimeout = f.retryTimeout
+	envMocked, err := envMock()
+	if err != nil {
+		return err
+	}
+	mockAPI = f.mock || envMocked
+	if mockAPI {
+		warn("--mock: the API is not called; images are placeholders")
+	}
+	verbose = f.verbose
+	saveRequestPath, saveResponsePath = f.saveRequest, f.saveResponse
+	streamResponses = f.stream
+	// --json and --stdout imply --quiet: no spinner or info lines, so
+	// stdout holds only the JSON or the image. See announce.
+	quiet = f.quiet || f.json || f.stdout
+	jsonOutput = f.json
+	noSpinner = f.noSpinner || os.Getenv("NANOBANANA_NO_SPINNER") != ""
+	return nil
+}
+
+// prepareOutputDir falls back to the configured output_dir and creates the
+// directory when outputs will be auto-named. An explicit --output wins.
+func (f *imageFlags) prepareOutputDir(cfg *Config) error {
+	if f.output != "" {
+		f.outputDir = ""
+		return nil
+	}
+	if f.outputDir == "" {
+		f.outputDir = expandPath(cfg.OutputDir)
+	}
+	if f.outputDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(f.outputDir, 0755); err != nil {
+		return fmt.Errorf("creating output dir: %w", err)
+	}
+	return nil
+}
+
+// writeOptions returns how output files for prompt should be written.
+// source is the image as the API returned it, before convert.
+func (f *imageFlags) writeOptions(prompt, model string, source []byte) writeOptions {
+	opts := writeOptions{Quality: f.quality, Format: f.format, TargetSize: f.targetSize, Source: source, Crop: f.crop}
+	if f.targetSize > 0 {
+		opts.MaxBytes = f.maxBytes
+	}
+	if !f.noMetadata {
+		opts.Metadata = &imageMetadata{
+			Prompt:  prompt,
+			Model:   model,
+			Aspect:  f.aspect,
+			Size:    f.size,
+			Seed:    f.seed,
+			Created: time.Now(),
+		}
+	}
+	return opts
+}
+
+// autoName is the default file name: timestamped, prefixed with a slug of
+// the prompt instead of prefix when --name-from-prompt is set, or built
+// from --name-template. index is the image's 1-based position in a batch.
+func (f *imageFlags) autoName(prefix, prompt, mime string, index int) string {
+	if f.nameFromPrompt {
+		prefix = slugify(prompt)
+	}
+	if f.nameTmpl == nil {
+		return autoName(prefix, mime)
+	}
+	name, err := executeNameTemplate(f.nameTmpl, nameTemplateData{
+		Prefix:    prefix,
+		Timestamp: time.Now().Format("20060102_150405"),
+		Model:     f.model,
+		Slug:      slugify(prompt),
+		Ext:       extForMIME(mime),
+		Index:     index,
+	})
+	if err != nil {
+		warn("%v; using the default name", err)
+		return autoName(prefix, mime)
+	}
+	return name
+}
+
+// announce reports a saved file according to the output flags. Plain
+// runs print a success line to stderr and nothing to stdout; --quiet prints
+// just the path to stdout; --json, with or without --quiet, prints nothing
+// here because the command's JSON object on stdout carries the path.
+func (f *imageFlags) announce(path, format string, args ...any) {
+	switch {
+	case f.json:
+	case f.quiet:
+		fmt.Println(path)
+	default:
+		success(format, args...)
+	}
+}
+
+// settings is the model, aspect ratio and size a run used, e.g. "flash,
+// 16:9, 2K", echoed on the success line so the scrollback of a long run
+// shows what each image was made with.
+func (f *imageFlags) settings() string {
+	return f.model + ", " + f.aspect + ", " + f.size
+}
+
+// hookFailures counts --on-success commands that failed during a run.
+var hookFailures atomic.Int32
+
+// runHook runs the --on-success command for a saved file, with {} in its
+// arguments replaced by the path, or the path appended if there is no {}.
+// No shell is involved. The command's output goes to stderr so stdout
+// stays clean for --quiet and --json. A failure is reported and returned
+// for the --json result; it fails the run only with --fail-on-hook.
+func (f *imageFlags) runHook(path string) string {
+	if len(f.hookArgs) == 0 {
+		return ""
+	}
+	args := make([]string, len(f.hookArgs))
+	placed := false
+	for i, a := range f.hookArgs {
+		args[i] = strings.ReplaceAll(a, "{}", path)
+		placed = placed || args[i] != a
+	}
+	if !placed {
+		args = append(args, path)
+	}
+	debugf("Running --on-success: %q", args)
+	cmd := exec.CommandContext(rootCtx, args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		hookFailures.Add(1)
+		msg := fmt.Sprintf("--on-success %s: %v", args[0], err)
+		switch {
+		case f.json:
+			// The result's hook_error carries it; stdout holds only the result
+			logf(slog.LevelError, "%s: %s", path, msg)
+			fmt.Fprintf(os.Stderr, colorRed+"✗ "+colorReset+"%s: %s\n", path, msg)
+		case f.failOnHook:
+			errorf("%s: %s", path, msg)
+		default:
+			warn("%s: %s", path, msg)
+		}
+		return msg
+	}
+	return ""
+}
+
+// hookExit turns a successful exit code into exitHook when --fail-on-hook
+// is set and an --on-success command failed.
+func (f *imageFlags) hookExit(code int) int {
+	if code == 0 && f.failOnHook && hookFailures.Load() > 0 {
+		return exitHook
+	}
+	return code
+}
+
+// splitCommand splits a command line into words: whitespace separates
+// them, single or double quotes group them, and a backslash outside single
+// quotes escapes the next character.
+func splitCommand(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inWord = r, true
+		case unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", line)
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// synthIDNote is printed with --disclose. Google embeds SynthID in every
+// generated image, but no local tool can detect it.
+const synthIDNote = "Gemini images carry an invisible SynthID watermark identifying them as AI-generated (it can't be checked locally)"
+
+// claimOutput protects an existing file at an explicit --output path. It
+// is an error unless --overwrite is set; with --no-clobber the first free
+// numbered name (out-1.png, out-2.png, ...) is returned instead.
+func (f *imageFlags) claimOutput(path string) (string, error) {
+	if f.overwrite || path == "-" || !fileExists(path) {
+		return path, nil
+	}
+	if !f.noClobber {
+		return "", fmt.Errorf("%s already exists (use --overwrite to replace it or --no-clobber to save under a new name)", path)
+	}
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		candidate := fmt.Sprintf("%s-%d%s", stem, i, ext)
+		if !fileExists(candidate) {
+			return candidate, nil
+		}
+	}
+}
+
+// convert applies --crop, --quality and --format to a generated image so
+// its bytes, MIME type and auto-generated file extension all match what was
+// asked for.
+func (f *imageFlags) convert(data []byte, mime string) ([]byte, string, error) {
+	if f.crop != nil {
+		out, outMIME, err := cropImageData(data, mime, *f.crop, f.quality)
+		if err != nil {
+			return nil, "", err
+		}
+		warnDroppedCredentials(data, out)
+		data, mime = out, outMIME
+	} else if f.requality(mime) {
+		out, err := reencodeJPEG(data, f.quality)
+		if err != nil {
+			warn("--quality %d: %v; saving the API's JPEG as is", f.quality, err)
+		} else {
+			warnDroppedCredentials(data, out)
+			data = out
+		}
+	}
+	if f.format != "" {
+		out, err := encodeFormat(f.format, data, mime, f.quality)
+		if err != nil {
+			return nil, "", err
+		}
+		warnDroppedCredentials(data, out)
+		data, mime = out, formatMIMETypes[f.format]
+	}
+	if err := f.checkSize(len(data)); err != nil {
+		return nil, "", err
+	}
+	return data, mime, nil
+}
+
+// requality reports whether a result of type mime has to be re-encoded for
+// --quality: the API's JPEG would otherwise be saved byte for byte and the
+// flag silently ignored. Only an explicit --quality does this, and only for
+// JPEG output, so the default keeps the original bytes.
+func (f *imageFlags) requality(mime string) bool {
+	if _, set := f.setFlags["quality"]; !set || mime != "image/jpeg" {
+		return false
+	}
+	if f.format != "" {
+		return formatMIMETypes[f.format] == "image/jpeg"
+	}
+	switch strings.ToLower(filepath.Ext(f.output)) {
+	case ".png", ".gif", ".webp":
+		return false
+	}
+	return true
+}
+
+// reencodeJPEG decodes a JPEG and encodes it again at quality.
+func reencodeJPEG(data []byte, quality int) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("cannot re-encode the JPEG: %w", err)
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// cropSpec is a parsed --crop: a centered region of the given aspect
+// ratio, or an explicit box when ratio is 0.
+type cropSpec struct {
+	ratio float64
+	box   image.Rectangle
+}
+
+// parseCrop reads a --crop value: an aspect ratio such as 16:9 or
+// 1920x1080, or a box as x,y,w,h in pixels.
+func parseCrop(s string) (*cropSpec, error) {
+	if strings.Contains(s, ",") {
+		fields := strings.Split(s, ",")
+		var n [4]int
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("invalid --crop %q (use x,y,w,h or a ratio like 16:9)", s)
+		}
+		for i, field := range fields {
+			v, err := strconv.Atoi(strings.TrimSpace(field))
+			if err != nil || v < 0 {
+				return nil, fmt.Errorf("invalid --crop %q (use x,y,w,h or a ratio like 16:9)", s)
+			}
+			n[i] = v
+		}
+		if n[2] == 0 || n[3] == 0 {
+			return nil, fmt.Errorf("invalid --crop %q: width and height must be positive", s)
+		}
+		return &cropSpec{box: image.Rect(n[0], n[1], n[0]+n[2], n[1]+n[3])}, nil
+	}
+	w, h, ok := parseRatio(s)
+	if !ok {
+		return nil, fmt.Errorf("invalid --crop %q (use x,y,w,h or a ratio like 16:9)", s)
+	}
+	return &cropSpec{ratio: w / h}, nil
+}
+
+// rect returns the region of bounds to keep, checking that an explicit
+// box fits inside the image.
+func (c cropSpec) rect(bounds image.Rectangle) (image.Rectangle, error) {
+	if c.ratio == 0 {
+		r := c.box.Add(bounds.Min)
+		if !r.In(bounds) {
+			return image.Rectangle{}, fmt.Errorf("crop box %dx%d at %d,%d is outside the %dx%d image",
+				c.box.Dx(), c.box.Dy(), c.box.Min.X, c.box.Min.Y, bounds.Dx(), bounds.Dy())
+		}
+		return r, nil
+	}
+	w, h := bounds.Dx(), bounds.Dy()
+	if float64(w)/float64(h) > c.ratio {
+		w = max(int(math.Round(float64(h)*c.ratio)), 1)
+	} else {
+		h = max(int(math.Round(float64(w)/c.ratio)), 1)
+	}
+	x := bounds.Min.X + (bounds.Dx()-w)/2
+	y := bounds.Min.Y + (bounds.Dy()-h)/2
+	return image.Rect(x, y, x+w, y+h), nil
+}
+
+// cropImage returns the region of img that c keeps.
+func cropImage(img image.Image, c cropSpec) (image.Image, error) {
+	r, err := c.rect(img.Bounds())
+	if err != nil {
+		return nil, err
+	}
+	sub, ok := img.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok {
+		return nil, errors.New("the decoded image can't be cut")
+	}
+	return sub.SubImage(r), nil
+}
+
+// cropImageData crops an image and re-encodes it: JPEG and GIF keep their
+// format, JPEG at the given quality, and anything else becomes PNG.
+func cropImageData(data []byte, mime string, c cropSpec, quality int) ([]byte, string, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot crop the %s image: %w", mime, err)
+	}
+	cropped, err := cropImage(img, c)
+	if err != nil {
+		return nil, "", fmt.Errorf("cannot crop the %s image: %w", mime, err)
+	}
+	var buf bytes.Buffer
+	switch mime {
+	case "image/jpeg":
+		err = jpeg.Encode(&buf, cropped, &jpeg.Options{Quality: cmp.Or(quality, defaultJPEGQuality)})
+	case "image/gif":
+		err = encodeGIF(&buf, cropped)
+	default:
+		mime = "image/png"
+		err = png.Encode(&buf, cropped)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), mime, nil
+}
+
+// parseThumbnail reads a --thumbnail box such as 256x256.
+func parseThumbnail(s string) (image.Point, error) {
+	ws, hs, ok := strings.Cut(strings.ToLower(s), "x")
+	w, errW := strconv.Atoi(strings.TrimSpace(ws))
+	h, errH := strconv.Atoi(strings.TrimSpace(hs))
+	if !ok || errW != nil || errH != nil {
+		return image.Point{}, fmt.Errorf("invalid --thumbnail %q (use WxH, e.g. 256x256)", s)
+	}
+	if w <= 0 || h <= 0 {
+		return image.Point{}, fmt.Errorf("invalid --thumbnail %q: width and height must be positive", s)
+	}
+	return image.Pt(w, h), nil
+}
+
+// thumbnailPath is the --thumbnail sidecar name for an image: out.png gets
+// out_thumb.png. WebP and AVIF have no encoder, so theirs are PNG.
+func thumbnailPath(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext) + "_thumb"
+	switch strings.ToLower(ext) {
+	case ".png", ".jpg", ".jpeg", ".gif":
+		return base + ext
+	}
+	return base + ".png"
+}
+
+// fitBox returns the largest size with the aspect ratio of size that fits
+// in box, never larger than size itself.
+func fitBox(size, box image.Point) image.Point {
+	scale := min(float64(box.X)/float64(size.X), float64(box.Y)/float64(size.Y), 1)
+	return image.Pt(
+		max(int(math.Round(float64(size.X)*scale)), 1),
+		max(int(math.Round(float64(size.Y)*scale)), 1),
+	)
+}
+
+// scaleImage shrinks img to size by averaging the source pixels that
+// cover each output pixel, which keeps fine detail from aliasing.
+func scaleImage(img image.Image, size image.Point) *image.RGBA {
+	b := img.Bounds()
+	out := image.NewRGBA(image.Rectangle{Max: size})
+	for y := range size.Y {
+		y0 := b.Min.Y + y*b.Dy()/size.Y
+		y1 := max(b.Min.Y+(y+1)*b.Dy()/size.Y, y0+1)
+		for x := range size.X {
+			x0 := b.Min.X + x*b.Dx()/size.X
+			x1 := max(b.Min.X+(x+1)*b.Dx()/size.X, x0+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := img.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			out.SetRGBA(x, y, color.RGBA{uint8(r / n >> 8), uint8(g / n >> 8), uint8(bl / n >> 8), uint8(a / n >> 8)})
+		}
+	}
+	return out
+}
+
+// writeThumbnail saves the --thumbnail copy of a saved image and returns
+// its path. A failure is a warning; the image itself is already written.
+func (f *imageFlags) writeThumbnail(path string) string {
+	if f.thumbnail == (image.Point{}) || path == "-" {
+		return ""
+	}
+	thumb := thumbnailPath(path)
+	if err := writeThumbnailFile(path, thumb, f.thumbnail, f.quality); err != nil {
+		warn("thumbnail for %s: %v", path, err)
+		return ""
+	}
+	if !f.json {
+		info("Saved thumbnail to %s", thumb)
+	}
+	return thumb
+}
+
+// writeThumbnailFile decodes the image at path, scales it to fit box and
+// writes it to thumb in the format its extension names.
+func writeThumbnailFile(path, thumb string, box image.Point, quality int) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("cannot decode the %s image: %w", sniffImageType(data), err)
+	}
+	size := fitBox(img.Bounds().Size(), box)
+	if size != img.Bounds().Size() {
+		img = scaleImage(img, size)
+	}
+	var buf bytes.Buffer
+	switch strings.ToLower(filepath.Ext(thumb)) {
+	case ".jpg", ".jpeg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: cmp.Or(quality, defaultJPEGQuality)})
+	case ".gif":
+		err = encodeGIF(&buf, img)
+	default:
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(thumb, buf.Bytes(), 0644)
+}
+
+// largeImageBytes is the size above which a result gets a warning.
+const largeImageBytes = 20 << 20
+
+// checkSize enforces --max-bytes on a result before anything is written,
+// and warns about unusually large ones. With --target-size the cap is
+// checked by writeImageWithOptions instead, once the file has been fitted.
+func (f *imageFlags) checkSize(n int) error {
+	if f.maxBytes > 0 && f.targetSize == 0 && int64(n) > f.maxBytes {
+		return classify(exitIO, fmt.Errorf("image is %s (%d bytes), over --max-bytes %s; not saved", formatBytes(int64(n)), n, formatBytes(f.maxBytes)))
+	}
+	if n > largeImageBytes {
+		warn("image is %s, larger than %s", formatBytes(int64(n)), formatBytes(largeImageBytes))
+	}
+	return nil
+}
+
+// options returns the per-request generation settings.
+func (f *imageFlags) options() genOptions {
+	opts := genOptions{
+		Aspect:   f.aspect,
+		Size:     f.size,
+		Seed:     f.seed,
+		Safety:   f.safety,
+		System:   f.system,
+		WithText: f.withText,
+	}
+	// resolve has already checked the format against the model
+	opts.ResponseMIME, _ = responseMIMEType(f.responseFormat, f.model)
+	if f.withText || f.manifest || f.allParts {
+		opts.Reply = &apiCandidate{}
+	}
+	opts.Usage = &apiUsage{}
+	return opts
+}
+
+// reportUsage prints the token counts for --show-usage.
+func (f *imageFlags) reportUsage(u *apiUsage) {
+	if t := u.tokens(); f.showUsage && t != nil {
+		info("Tokens: %d prompt + %d candidates = %d total", t.PromptTokens, t.CandidateTokens, t.TotalTokens)
+	}
+}
+
+// showText prints the text the model returned with --with-text.
+func (f *imageFlags) showText(text string) {
+	if text != "" {
+		info("Model says: %s", text)
+	}
+}
+
+func runGenerate(args []string) (code int) {
+	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var f imageFlags
+	f.register(fs)
+
+	var g generateFlags
+	g.register(fs)
+	fs.StringVar(&f.promptFile, "prompt-file", "", "read the prompt from a file (- for stdin)")
+	fs.StringVar(&f.from, "from", "", "reference image to base the new image on (file, URL, data: URI, or - for stdin)")
+	// Experimental and deliberately left out of the help and completion
+	var rawRequest string
+	fs.StringVar(&rawRequest, "raw-request", "", "send this JSON file as the request body, unchecked (experimental)")
+
+	if err := fs.Parse(args); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
+	}
+	f.setFlags = visitedFlags(fs)
+	if err := f.apply(); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	defer func() { code = f.hookExit(code) }()
+
+	remaining := fs.Args()
+	if rawRequest != "" {
+		return runRawRequest(&f, rawRequest, remaining)
+	}
+	var prompts []string
+	if f.promptFile != "" {
+		if len(remaining) > 0 {
+			errorf("a prompt argument cannot be used with --prompt-file")
+			return 1
+		}
+		if g.promptsFile != "" {
+			errorf("--prompt-file cannot be used with --prompts-file")
+			return 1
+		}
+		prompt, err := readPromptFile(f.promptFile)
+		if err != nil {
+			errorf("%v", err)
+			return 1
+		}
+		prompts = []string{prompt}
+	} else if g.promptsFile != "" {
+		if len(remaining) > 0 {
+			errorf("a prompt argument cannot be used with --prompts-file")
+			return 1
+		}
+		if f.output != "" {
+			errorf("--output cannot be used with --prompts-file (use --output-dir)")
+			return 1
+		}
+		var err error
+		prompts, err = readPromptsFile(expandPath(g.promptsFile))
+		if err != nil {
+			errorf("%v", err)
+			return 1
+		}
+	} else {
+		if len(remaining) == 0 {
+			errorf("usage: nanobanana generate \"prompt\" [flags]")
+			return 1
+		}
+		prompts = []string{strings.Join(remaining, " ")}
+	}
+
+	if g.count < 1 || g.count > 8 {
+		errorf("--count must be between 1 and 8")
+		return 1
+	}
+	if g.concurrency < 1 {
+		errorf("--concurrency must be at least 1")
+		return 1
+	}
+	if f.session != "" && (g.count > 1 || g.promptsFile != "") {
+		errorf("--session cannot be used with --count or --prompts-file")
+		return 1
+	}
+	if g.matrix != "" || g.compare {
+		return runMatrix(&f, &g, prompts)
+	}
+
+	cfg, err := loadCommandConfig(f.profile)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+
+	modelName, err := f.resolve(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	opts, err := f.sessionOptions()
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	for _, prompt := range prompts {
+		if err := f.checkPrompt(prompt); err != nil {
+			errorf("%v", err)
+			return 1
+		}
+	}
+
+	apiKey, err := resolveAPIKey(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return exitAuth
+	}
+
+	total := len(prompts) * g.count
+	if total > 1 && f.output == "-" {
+		errorf("--output - cannot be used with more than one image")
+		return 1
+	}
+	if err := f.prepareOutputDir(cfg); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+
+	// --from sends a reference image the same way edit sends its inputs
+	var refs []inputImage
+	if f.from != "" {
+		if f.from == "-" && (f.promptFile == "-" || g.promptsFile == "-") {
+			errorf("--from - cannot be used with prompts read from stdin")
+			return 1
+		}
+		data, mimeType, err := readImage(f.from)
+		if err != nil {
+			errorf("%v", err)
+			return exitIO
+		}
+		refs = []inputImage{{Data: data, MIMEType: mimeType}}
+	}
+
+	usedNames := make(map[string]bool)
+
+	// outputPath is the name image n of the batch is saved under, before
+	// --overwrite and --no-clobber are applied. used holds names already
+	// taken in this run.
+	outputPath := func(prompt string, i, n int, mime string, used map[string]bool) string {
+		var path string
+		switch {
+		case f.output != "":
+			path = f.output
+			if g.count > 1 {
+				path = indexedPath(path, i+1)
+			}
+		case f.outputDir != "" && g.promptsFile != "":
+			path = filepath.Join(f.outputDir, slugify(prompt)+extForMIME(mime))
+			if g.count > 1 {
+				path = indexedPath(path, i+1)
+			}
+			// Prompts that slugify identically get numbered
+			if used[path] {
+				path = indexedPath(path, n)
+			}
+		default:
+			path = f.autoName("nanobanana", prompt, mime, n)
+			if f.outputDir != "" {
+				path = filepath.Join(f.outputDir, path)
+			}
+			if total > 1 && !f.nameHasIndex {
+				path = indexedPath(path, n)
+			}
+		}
+		if g.count > 1 && f.seed != nil {
+			path = seededPath(path, *f.imageSeed(i))
+		}
+		return path
+	}
+
+	// skipped[job] is the existing file that job would have written
+	skipped := make([]string, total)
+	toRun := total
+	if g.skipExisting {
+		if f.output == "" && (f.outputDir == "" || g.promptsFile == "") {
+			warn("--skip-existing only applies to --output or --prompts-file with --output-dir; timestamped names never exist yet")
+		} else if f.output != "-" {
+			toRun = planSkips(prompts, g.count, skipped, usedNames, f.format, outputPath)
+		}
+	}
+	if toRun == 0 {
+		info("All %d image(s) already exist; nothing to generate", total)
+	}
+
+	// Refuse before paying for images that couldn't be saved
+	if f.output != "" {
+		for i := range g.count {
+			if skipped[i] != "" {
+				continue
+			}
+			if _, err := f.claimOutput(outputPath(prompts[0], i, i+1, "", nil)); err != nil {
+				errorf("%v", err)
+				return 1
+			}
+		}
+	}
+
+	imageCost, _ := estimateCost(modelName, f.size, 1)
+	if g.estimate && toRun > 0 {
+		cost, ok := estimateCost(modelName, f.size, toRun)
+		if !ok {
+			warn("no pricing data for %s; cannot estimate cost", modelName)
+		} else {
+			info("Estimated cost: ~$%.2f for %d image(s) with %s", cost, toRun, modelName)
+		}
+		if !quiet && term.IsTerminal(int(os.Stdin.Fd())) && !confirm("Continue?") {
+			errorf("aborted")
+			return 1
+		}
+	} else if toRun > 0 {
+		cost, ok := estimateCost(modelName, f.size, toRun)
+		if !f.confirmSpend(fmt.Sprintf("%d image(s) with %s (%s, %s)", toRun, modelName, f.aspect, f.size), cost, ok) {
+			errorf("aborted")
+			return 1
+		}
+	}
+
+	var results []jsonResult
+	var succeeded, failed, blocked []int
+	failCode := 0 // exit code of the first failed image
+
+	switch {
+	case len(prompts) > 1:
+		info("Generating %d images from %s with %s (%s, %s)", total, g.promptsFile, f.model, f.aspect, f.size)
+	case g.count > 1:
+		info("Generating %d images with %s (%s, %s, %s)", g.count, f.model, f.aspect, f.size, prompts[0])
+	default:
+		info("Generating with %s (%s, %s, %s)", f.model, f.aspect, f.size, prompts[0])
+	}
+	if f.from == "-" {
+		info("Using the image on stdin as a reference")
+	} else if f.from != "" {
+		info("Using %s as a reference", imageLabel(f.from))
+	}
+
+	// Requests run in a worker pool but results are consumed in input
+	// order, so file numbering and the summary don't depend on timing.
+	workers := max(min(g.concurrency, toRun), 1)
+	if workers > 1 {
+		info("Running %d requests at a time", workers)
+	}
+	var done atomic.Int32
+	var stopped atomic.Bool // --exit-on-block saw a blocked image
+	pending, stopPool := runPool(total, workers, func(ctx context.Context, job int) generation {
+		var gen generation
+		if skipped[job] != "" || stopped.Load() {
+			return gen
+		}
+		o := opts
+		o.Ctx = ctx
+		o.Seed = f.imageSeed(job % g.count)
+		if o.Reply != nil && total > 1 {
+			o.Reply = &apiCandidate{} // one reply slot per request
+		}
+		o.Usage = &apiUsage{}
+		gen.usage = o.Usage
+		gen.data, gen.mime, gen.used, gen.err = f.withAutoFix(prompts[job/g.count], func(p string) ([]byte, string, error) {
+			if len(refs) > 0 {
+				return editImage(apiKey, modelName, p, refs, o)
+			}
+			return generateImage(apiKey, modelName, p, o)
+		})
+		if gen.err == nil && o.Reply != nil {
+			gen.finish = o.Reply.FinishReason
+			if f.withText {
+				gen.text = replyText(o.Reply)
+			}
+			gen.extra = f.extraImages(o.Reply)
+		}
+		if workers > 1 {
+			// The spinner would garble with several requests in flight
+			info("%d of %d requests finished", done.Add(1), toRun)
+		}
+		return gen
+	})
+	defer stopPool()
+
+	n := 0
+batch:
+	for _, prompt := range prompts {
+		for i := range g.count {
+			n++
+			f := f // per-image copy, so history, metadata and JSON get this image's seed
+			f.seed = f.imageSeed(i)
+			if path := skipped[n-1]; path != "" {
+				if f.json {
+					results = append(results, jsonResult{File: path, Model: modelName, Prompt: prompt, Skipped: true})
+				} else {
+					info("Skipped %s (already exists)", path)
+				}
+				continue
+			}
+			stop := func() {}
+			if workers == 1 {
+				spinnerMsg := "Generating image..."
+				if total > 1 {
+					spinnerMsg = fmt.Sprintf("Generating image %d of %d...", n, total)
+				}
+				stop = startSpinner(spinnerMsg)
+			}
+			gen := <-pending[n-1]
+			stop()
+			imgData, mimeType, used, err := gen.data, gen.mime, gen.used, gen.err
+			if err == nil {
+				imgData, mimeType, err = f.convert(imgData, mimeType)
+			}
+			if err != nil {
+				if total > 1 && !errors.Is(err, errCanceled) {
+					if f.json {
+						results = append(results, jsonResult{Model: modelName, Prompt: prompt, Error: err.Error(), Blocked: isBlocked(err)})
+					} else {
+						errorf("image %d: %v", n, err)
+					}
+					failCode = cmp.Or(failCode, exitCode(err))
+					if !isBlocked(err) {
+						failed = append(failed, n)
+						continue // try remaining images
+					}
+					blocked = append(blocked, n)
+					if f.exitOnBlock {
+						stopped.Store(true)
+						stopPool() // cancel requests still running
+						break batch
+					}
+					continue
+				}
+				errorf("%v", err)
+				return exitCode(err)
+			}
+
+			// Write output
+			if f.output == "-" {
+				if _, err := os.Stdout.Write(imgData); err != nil {
+					errorf("writing to stdout: %v", err)
+					return exitIO
+				}
+				results = append(results, jsonResult{
+					File:            "-",
+					Model:           modelName,
+					Prompt:          prompt,
+					Bytes:           len(imgData),
+					MIMEType:        mimeType,
+					Aspect:          f.aspect,
+					Size:            f.size,
+					Seed:            f.seed,
+					System:          f.system,
+					Cost:            imageCost,
+					SynthID:         true,
+					Credentials:     hasContentCredentials(imgData),
+					EffectivePrompt: effectivePrompt(prompt, used),
+					Text:            gen.text,
+					Usage:           gen.usage.tokens(),
+				})
+				f.record("generate", used, "-", nil)
+				f.saveSessionTurn(opts, used, refs)
+				f.showText(gen.text)
+				f.reportUsage(gen.usage)
+			} else {
+				outPath := outputPath(prompt, i, n, mimeType, usedNames)
+				if f.output != "" {
+					if outPath, err = f.claimOutput(outPath); err != nil {
+						errorf("%v", err)
+						return 1
+					}
+				}
+				usedNames[outPath] = true
+
+				if err := writeImageWithOptions(outPath, imgData, mimeType, f.writeOptions(used, modelName, gen.data)); err != nil {
+					if total > 1 {
+						if f.json {
+							results = append(results, jsonResult{File: outPath, Model: modelName, Prompt: prompt, Error: err.Error()})
+						} else {
+							errorf("image %d: writing image: %v", n, err)
+						}
+						failed = append(failed, n)
+						failCode = cmp.Or(failCode, exitIO)
+						continue
+					}
+					errorf("writing image: %v", err)
+					return exitIO
+				}
+
+				result := jsonResult{
+					File:            outPath,
+					Model:           modelName,
+					Prompt:          prompt,
+					Bytes:           len(imgData),
+					MIMEType:        mimeType,
+					Aspect:          f.aspect,
+					Size:            f.size,
+					Seed:            f.seed,
+					System:          f.system,
+					Cost:            imageCost,
+					SynthID:         true,
+					Credentials:     hasContentCredentials(imgData),
+					EffectivePrompt: effectivePrompt(prompt, used),
+					Text:            gen.text,
+					Usage:           gen.usage.tokens(),
+					ExtraFiles:      f.saveExtraImages(outPath, gen.extra, used, modelName),
+				}
+				result.Thumbnail = f.writeThumbnail(outPath)
+				result.HookError = f.runHook(outPath)
+				results = append(results, result)
+				logResult("generate", result)
+				f.writeManifest("generate", result, gen.finish, nil)
+				f.record("generate", used, outPath, nil)
+				f.saveSessionTurn(opts, used, refs)
+
+				f.announce(outPath, "Saved to %s (%d bytes; %s)", outPath, len(imgData), f.settings())
+				f.showExtraFiles(result.ExtraFiles)
+				f.showText(gen.text)
+				f.reportUsage(gen.usage)
+
+				if f.preview {
+					if err := openFile(outPath); err != nil {
+						warn("could not open preview: %v", err)
+					}
+				}
+			}
+			succeeded = append(succeeded, n)
+		}
+	}
+
+	if f.disclose && len(succeeded) > 0 {
+		info(synthIDNote)
+	}
+	if total > 1 {
+		var skipNote string
+		if n := total - toRun; n > 0 {
+			skipNote = fmt.Sprintf(", skipped %d existing", n)
+		}
+		switch {
+		case len(failed) == 0 && len(blocked) == 0:
+			success("Generated %d of %d images%s", len(succeeded), total, skipNote)
+		case len(blocked) == 0:
+			warn("Generated %d of %d images%s (succeeded: %s; failed: %s)",
+				len(succeeded), total, skipNote, joinInts(succeeded), joinInts(failed))
+		default:
+			var stopNote string
+			if stopped.Load() {
+				stopNote = "; stopped by --exit-on-block"
+			}
+			warn("Generated %d of %d images%s (succeeded: %s; failed: %s; blocked: %s%s)",
+				len(succeeded), total, skipNote, joinInts(succeeded), joinInts(failed), joinInts(blocked), stopNote)
+		}
+	}
+
+	if f.json {
+		// Keep stdout clean for image bytes when writing to stdout
+		jsonOut := os.Stdout
+		if f.output == "-" {
+			jsonOut = os.Stderr
+		}
+		if total == 1 && len(results) == 1 {
+			json.NewEncoder(jsonOut).Encode(results[0])
+		} else {
+			json.NewEncoder(jsonOut).Encode(results)
+		}
+	}
+
+	// A prompts file run fails if any prompt failed or was blocked; a
+	// --count run only fails if nothing was generated, or --exit-on-block
+	// stopped it.
+	if stopped.Load() {
+		return exitBlocked
+	}
+	if (len(succeeded) == 0 && toRun > 0) || (g.promptsFile != "" && len(failed)+len(blocked) > 0) {
+		return failCode
+	}
+	return 0
+}
+
+// matrixCell is one aspect ratio and size combination of a --matrix run.
+// With --compare each combination runs once per model alias in Model.
+type matrixCell struct {
+	Aspect string
+	Size   string
+	Model  string
+}
+
+// parseMatrix parses a --matrix spec such as "aspect=1:1,16:9 size=1K,2K"
+// into its cartesian product, aspect-major. Dimensions are separated by
+// spaces or semicolons; one left out takes its value from aspect or size.
+func parseMatrix(spec, aspect, size string) ([]matrixCell, error) {
+	values := map[string][]string{}
+	for _, dim := range strings.FieldsFunc(spec, func(r rune) bool { return unicode.IsSpace(r) || r == ';' }) {
+		key, list, ok := strings.Cut(dim, "=")
+		key = strings.ToLower(key)
+		if !ok || (key != "aspect" && key != "size") {
+			return nil, fmt.Errorf("invalid --matrix dimension %q (use aspect=... or size=...)", dim)
+		}
+		if _, dup := values[key]; dup {
+			return nil, fmt.Errorf("--matrix gives %s twice", key)
+		}
+		var vals []string
+		for v := range strings.SplitSeq(list, ",") {
+			if v = strings.TrimSpace(v); v == "" {
+				return nil, fmt.Errorf("--matrix %s has an empty value", key)
+			}
+			if key == "aspect" {
+				v = strings.Replace(strings.ToLower(v), "x", ":", 1) // 16x9 as in file names
+			}
+			if key == "size" {
+				v = strings.ToUpper(v)
+				if v == "512PX" {
+					v = "512px"
+				}
+			}
+			if !slices.Contains(vals, v) {
+				vals = append(vals, v)
+			}
+		}
+		values[key] = vals
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf(`--matrix needs at least one dimension, e.g. "aspect=1:1,16:9 size=1K,2K"`)
+	}
+	aspects, sizes := values["aspect"], values["size"]
+	if aspects == nil {
+		aspects = []string{aspect}
+	}
+	if sizes == nil {
+		sizes = []string{size}
+	}
+	var cells []matrixCell
+	for _, a := range aspects {
+		for _, sz := range sizes {
+			cells = append(cells, matrixCell{Aspect: a, Size: sz})
+		}
+	}
+	return cells, nil
+}
+
+// compareModels are the model aliases --compare runs side by side.
+var compareModels = []string{"flash", "pro"}
+
+// matrixPath names a --matrix image after its cell, so "cat.png" becomes
+// "cat_16x9_2K.png", and a --compare image after its model, so "cat.png"
+// becomes "cat-pro.png". matrix reports whether --matrix was given.
+func matrixPath(path string, c matrixCell, matrix bool) string {
+	ext := filepath.Ext(path)
+	stem := strings.TrimSuffix(path, ext)
+	if matrix {
+		stem += fmt.Sprintf("_%s_%s", strings.ReplaceAll(c.Aspect, ":", "x"), c.Size)
+	}
+	if c.Model != "" {
+		stem += "-" + c.Model
+	}
+	return stem + ext
+}
+
+// label names a cell in progress and summary lines.
+func (c matrixCell) label() string {
+	return strings.TrimSpace(c.Model + " " + c.Aspect + " " + c.Size)
+}
+
+// maxMatrixCells caps how many images one --matrix run may request.
+const maxMatrixCells = 16
+
+// runRawRequest sends the JSON body in a --raw-request file as is and saves
+// the image in the response. It is an unsupported escape hatch for trying
+// API fields the flags don't cover yet: the body only has to be valid JSON,
+// and --aspect, --size, --system and the like are not applied to it.
+func runRawRequest(f *imageFlags, path string, args []string) int {
+	if len(args) > 0 || f.promptFile != "" || f.from != "" {
+		errorf("--raw-request takes no prompt or --from; the request file holds them")
+		return 1
+	}
+	data, err := os.ReadFile(expandPath(path))
+	if err != nil {
+		errorf("reading raw request: %v", err)
+		return exitIO
+	}
+	if !json.Valid(data) {
+		errorf("%s is not valid JSON", path)
+		return 1
+	}
+	// The first text part stands in for the prompt in file names, metadata
+	// and --json output
+	var req apiRequest
+	prompt := "raw request"
+	if json.Unmarshal(data, &req) == nil {
+		if p := requestText(req); p != "" {
+			prompt = p
+		}
+	}
+
+	cfg, err := loadCommandConfig(f.profile)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	modelName, err := f.resolve(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	apiKey, err := resolveAPIKey(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return exitAuth
+	}
+	if err := f.prepareOutputDir(cfg); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	outPath := f.output
+	if outPath != "" {
+		if outPath, err = f.claimOutput(outPath); err != nil {
+			errorf("%v", err)
+			return 1
+		}
+	}
+
+	warn("--raw-request is experimental and unsupported; the body is sent unchecked")
+	opts := f.options()
+	stop := startSpinner("Sending raw request...")
+	imgData, mimeType, err := doAPICall(opts.context(), apiKey, modelName, apiRequest{Raw: data}, opts.Reply, opts.Usage)
+	stop()
+	source := imgData
+	if err == nil {
+		imgData, mimeType, err = f.convert(imgData, mimeType)
+	}
+	if err != nil {
+		errorf("%v", err)
+		return exitCode(err)
+	}
+
+	if outPath == "-" {
+		if _, err := os.Stdout.Write(imgData); err != nil {
+			errorf("writing to stdout: %v", err)
+			return exitIO
+		}
+		f.reportUsage(opts.Usage)
+		return 0
+	}
+	if outPath == "" {
+		outPath = f.autoName("nanobanana", prompt, mimeType, 1)
+		if f.outputDir != "" {
+			outPath = filepath.Join(f.outputDir, outPath)
+		}
+	}
+	if err := writeImageWithOptions(outPath, imgData, mimeType, f.writeOptions(prompt, modelName, source)); err != nil {
+		errorf("writing image: %v", err)
+		return exitIO
+	}
+	result := jsonResult{
+		File:     outPath,
+		Model:    modelName,
+		Prompt:   prompt,
+		Bytes:    len(imgData),
+		MIMEType: mimeType,
+		SynthID:  true,
+		Usage:    opts.Usage.tokens(),
+	}
+	result.Thumbnail = f.writeThumbnail(outPath)
+	result.HookError = f.runHook(outPath)
+	logResult("generate", result)
+	if f.json {
+		json.NewEncoder(os.Stdout).Encode(result)
+	}
+	f.announce(outPath, "Saved to %s (%d bytes)", outPath, len(imgData))
+	f.reportUsage(opts.Usage)
+	if f.preview {
+		if err := openFile(outPath); err != nil {
+			warn("could not open preview: %v", err)
+		}
+	}
+	return 0
+}
+
+// requestText returns the first text part of a request's last turn.
+func requestText(req apiRequest) string {
+	if len(req.Contents) == 0 {
+		return ""
+	}
+	for _, p := range req.Contents[len(req.Contents)-1].Parts {
+		if p.Text != "" {
+			return p.Text
+		}
+	}
+	return ""
+}
+
+// runMatrix renders one prompt at every aspect ratio and size combination
+// of --matrix and, with --compare, with both flash and pro. Every cell is
+// checked against its model before any request is sent; a failed cell is
+// reported and the rest still run.
+func runMatrix(f *imageFlags, g *generateFlags, prompts []string) int {
+	mode := "--matrix"
+	if g.matrix == "" {
+		mode = "--compare"
+	}
+	switch {
+	case len(prompts) != 1 || g.promptsFile != "":
+		errorf("%s renders a single prompt; it cannot be used with --prompts-file", mode)
+		return 1
+	case g.count > 1:
+		errorf("%s cannot be used with --count", mode)
+		return 1
+	case f.session != "":
+		errorf("--session cannot be used with %s", mode)
+		return 1
+	case f.output == "-":
+		errorf("--output - cannot be used with %s", mode)
+		return 1
+	case g.compare && f.model != "":
+		errorf("--compare picks the models itself; drop --model")
+		return 1
+	}
+	prompt := prompts[0]
+
+	cfg, err := loadCommandConfig(f.profile)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	modelName, err := f.resolve(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	cells := []matrixCell{{Aspect: f.aspect, Size: f.size}}
+	if g.matrix != "" {
+		if cells, err = parseMatrix(g.matrix, f.aspect, f.size); err != nil {
+			errorf("%v", err)
+			return 1
+		}
+	}
+	if g.compare {
+		var models []matrixCell
+		for _, c := range cells {
+			for _, alias := range compareModels {
+				c.Model = alias
+				models = append(models, c)
+			}
+		}
+		cells = models
+	}
+	if len(cells) > maxMatrixCells {
+		errorf("%s has %d combinations; the limit is %d", mode, len(cells), maxMatrixCells)
+		return 1
+	}
+	// cellModel is the full model name a cell is sent to
+	cellModel := func(c matrixCell) string {
+		if c.Model != "" {
+			return modelAliases[c.Model]
+		}
+		return modelName
+	}
+	var invalid []string
+	for _, c := range cells {
+		if err := validateImageOptions(cellModel(c), c.Aspect, c.Size); err != nil {
+			invalid = append(invalid, fmt.Sprintf("%s: %v", c.label(), err))
+		}
+	}
+	if len(invalid) > 0 {
+		errorf("%s combinations not supported:\n  %s", mode, strings.Join(invalid, "\n  "))
+		return 1
+	}
+	if err := f.checkPrompt(prompt); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	apiKey, err := resolveAPIKey(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return exitAuth
+	}
+	if err := f.prepareOutputDir(cfg); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	var refs []inputImage
+	if f.from != "" {
+		data, mimeType, err := readImage(f.from)
+		if err != nil {
+			errorf("%v", err)
+			return exitIO
+		}
+		refs = []inputImage{{Data: data, MIMEType: mimeType}}
+	}
+
+	// Refuse before paying for images that couldn't be saved
+	if f.output != "" {
+		for _, c := range cells {
+			if _, err := f.claimOutput(matrixPath(f.output, c, g.matrix != "")); err != nil {
+				errorf("%v", err)
+				return 1
+			}
+		}
+	}
+	var total float64
+	priced := true
+	for _, c := range cells {
+		cost, ok := estimateCost(cellModel(c), c.Size, 1)
+		total, priced = total+cost, priced && ok
+	}
+	if g.estimate {
+		if !priced {
+			warn("no pricing data for %s; cannot estimate cost", modelName)
+		} else {
+			info("Estimated cost: ~$%.2f for %d image(s)", total, len(cells))
+		}
+		if !quiet && term.IsTerminal(int(os.Stdin.Fd())) && !confirm("Continue?") {
+			errorf("aborted")
+			return 1
+		}
+	} else if !f.confirmSpend(fmt.Sprintf("%d image(s), one per %s combination", len(cells), mode), total, priced) {
+		errorf("aborted")
+		return 1
+	}
+
+	if g.matrix == "" {
+		info("Generating with %s (%s, %s, %s)", strings.Join(compareModels, " and "), f.aspect, f.size, prompt)
+	} else {
+		info("Generating %d combinations with %s (%s)", len(cells), f.model, prompt)
+	}
+	workers := max(min(g.concurrency, len(cells)), 1)
+	var done atomic.Int32
+	pending, stopPool := runPool(len(cells), workers, func(ctx context.Context, job int) generation {
+		var gen generation
+		o := f.options()
+		o.Ctx = ctx
+		o.Aspect, o.Size = cells[job].Aspect, cells[job].Size
+		model := cellModel(cells[job])
+		gen.data, gen.mime, gen.used, gen.err = f.withAutoFix(prompt, func(p string) ([]byte, string, error) {
+			if len(refs) > 0 {
+				return editImage(apiKey, model, p, refs, o)
+			}
+			return generateImage(apiKey, model, p, o)
+		})
+		if gen.err == nil && o.Reply != nil {
+			gen.finish = o.Reply.FinishReason
+			if f.withText {
+				gen.text = replyText(o.Reply)
+			}
+			gen.extra = f.extraImages(o.Reply)
+		}
+		gen.usage = o.Usage
+		info("%d of %d combinations finished", done.Add(1), len(cells))
+		return gen
+	})
+	defer stopPool()
+
+	var results []jsonResult
+	var succeeded, failed []string
+	failCode := 0
+	type modelTotal struct {
+		images, bytes int
+		cost          float64
+	}
+	totals := map[string]*modelTotal{} // by alias, for --compare
+	for n, c := range cells {
+		f := *f // per-cell copy, so metadata, history and JSON get this cell's settings
+		f.aspect, f.size = c.Aspect, c.Size
+		f.model = cmp.Or(c.Model, f.model)
+		modelName := cellModel(c)
+		label := c.label()
+		gen := <-pending[n]
+		imgData, mimeType, err := gen.data, gen.mime, gen.err
+		if err == nil {
+			imgData, mimeType, err = f.convert(imgData, mimeType)
+		}
+		var outPath string
+		if err == nil {
+			if f.output != "" {
+				outPath, err = f.claimOutput(matrixPath(f.output, c, g.matrix != ""))
+			} else {
+				outPath = matrixPath(f.autoName("nanobanana", prompt, mimeType, n+1), c, g.matrix != "")
+				if f.outputDir != "" {
+					outPath = filepath.Join(f.outputDir, outPath)
+				}
+			}
+		}
+		if err == nil {
+			if werr := writeImageWithOptions(outPath, imgData, mimeType, f.writeOptions(gen.used, modelName, gen.data)); werr != nil {
+				err = classify(exitIO, fmt.Errorf("writing image: %w", werr))
+			}
+		}
+		if errors.Is(err, errCanceled) {
+			errorf("%v", err)
+			return exitCode(err)
+		}
+		if err != nil {
+			if f.json {
+				results = append(results, jsonResult{Model: modelName, Prompt: prompt, Aspect: c.Aspect, Size: c.Size, Error: err.Error(), Blocked: isBlocked(err)})
+			} else {
+				errorf("%s: %v", label, err)
+			}
+			failed = append(failed, label)
+			failCode = cmp.Or(failCode, exitCode(err))
+			continue
+		}
+
+		imageCost, _ := estimateCost(modelName, c.Size, 1)
+		result := jsonResult{
+			File:            outPath,
+			Model:           modelName,
+			Prompt:          prompt,
+			Bytes:           len(imgData),
+			MIMEType:        mimeType,
+			Aspect:          c.Aspect,
+			Size:            c.Size,
+			Seed:            f.seed,
+			System:          f.system,
+			Cost:            imageCost,
+			SynthID:         true,
+			Credentials:     hasContentCredentials(imgData),
+			EffectivePrompt: effectivePrompt(prompt, gen.used),
+			Text:            gen.text,
+			ExtraFiles:      f.saveExtraImages(outPath, gen.extra, gen.used, modelName),
+			Usage:           gen.usage.tokens(),
+		}
+		result.Thumbnail = f.writeThumbnail(outPath)
+		result.HookError = f.runHook(outPath)
+		results = append(results, result)
+		logResult("generate", result)
+		f.writeManifest("generate", result, gen.finish, nil)
+		f.record("generate", gen.used, outPath, nil)
+		succeeded = append(succeeded, label)
+		if c.Model != "" {
+			t := totals[c.Model]
+			if t == nil {
+				t = &modelTotal{}
+				totals[c.Model] = t
+			}
+			t.images, t.bytes, t.cost = t.images+1, t.bytes+len(imgData), t.cost+imageCost
+		}
+
+		f.announce(outPath, "Saved to %s (%d bytes; %s)", outPath, len(imgData), f.settings())
+		f.showExtraFiles(result.ExtraFiles)
+		f.showText(gen.text)
+		f.reportUsage(gen.usage)
+		if f.preview {
+			if err := openFile(outPath); err != nil {
+				warn("could not open preview: %v", err)
+			}
+		}
+	}
+
+	if f.disclose && len(succeeded) > 0 {
+		info(synthIDNote)
+	}
+	if len(failed) == 0 {
+		success("Generated %d of %d combinations", len(succeeded), len(cells))
+	} else {
+		warn("Generated %d of %d combinations (failed: %s)", len(succeeded), len(cells), strings.Join(failed, ", "))
+	}
+	if flash, pro := totals["flash"], totals["pro"]; flash != nil && pro != nil {
+		for _, alias := range compareModels {
+			t := totals[alias]
+			info("%-5s %d image(s), %d bytes, ~$%.3f", alias, t.images, t.bytes, t.cost)
+		}
+		info("pro cost ~$%.3f more than flash (%.1fx)", pro.cost-flash.cost, pro.cost/flash.cost)
+	}
+	if f.json {
+		json.NewEncoder(os.Stdout).Encode(results)
+	}
+	if len(failed) > 0 {
+		return failCode
+	}
+	return 0
+}
+
+// planSkips fills skipped with the existing file each job of a batch
+// would be saved under and returns how many jobs are left to run. Names
+// are predicted in input order so prompts that slugify identically keep
+// the numbers they got on the first run. Since the API picks the image
+// type, every type it returns is tried unless --format fixes one.
+func planSkips(prompts []string, count int, skipped []string, used map[string]bool, format string,
+	outputPath func(prompt string, i, n int, mime string, used map[string]bool) string) int {
+	mimes := []string{"image/png", "image/jpeg", "image/webp"}
+	if format != "" {
+		mimes = []string{formatMIMETypes[format]}
+	}
+	planned := make(map[string]bool)
+	toRun := len(skipped)
+	n := 0
+	for _, prompt := range prompts {
+		for i := range count {
+			n++
+			predicted := ""
+			for _, mime := range mimes {
+				path := outputPath(prompt, i, n, mime, planned)
+				if predicted == "" {
+					predicted = path
+				}
+				if fileExists(path) {
+					skipped[n-1], predicted = path, path
+					used[path] = true
+					toRun--
+					break
+				}
+			}
+			planned[predicted] = true
+		}
+	}
+	return toRun
+}
+
+// imageSeed is the seed for image i (0-based) of a --count batch: --seed,
+// --seed+1, ... so the images differ but each can be reproduced.
+func (f *imageFlags) imageSeed(i int) *int64 {
+	if f.seed == nil || i == 0 {
+		return f.seed
+	}
+	seed := *f.seed + int64(i)
+	return &seed
+}
+
+// generation is the outcome of one image request in a batch.
+type generation struct {
+	data   []byte
+	mime   string
+	used   string        // prompt actually sent, after --auto-fix
+	text   string        // the model's text, with --with-text
+	finish string        // the candidate's finish reason, for --manifest
+	extra  []outputImage // images after the first, with --all-parts
+	usage  *apiUsage     // tokens billed for the request
+	err    error
+}
+
+// runPool calls gen for jobs 0..n-1 on up to workers goroutines. Each job
+// gets its own buffered channel so callers can read results in order
+// while later jobs are still running. gen gets a context that the returned
+// stop function cancels; stop then waits for the workers, so a caller that
+// gives up early leaves no requests running behind it.
+func runPool(n, workers int, gen func(ctx context.Context, job int) generation) ([]chan generation, func()) {
+	ctx, cancel := context.WithCancel(rootCtx)
+	results := make([]chan generation, n)
+	for i := range results {
+		results[i] = make(chan generation, 1)
+	}
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Go(func() {
+			for job := range jobs {
+				if ctx.Err() != nil {
+					continue // stopped: drain the queue without starting anything
+				}
+				results[job] <- gen(ctx, job)
+			}
+		})
+	}
+	go func() {
+		defer close(jobs)
+		for job := range n {
+			select {
+			case jobs <- job:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return results, func() {
+		cancel()
+		wg.Wait()
+	}
+}
+
+func runEdit(args []string) (code int) {
+	fs := flag.NewFlagSet("edit", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var f imageFlags
+	f.register(fs)
+	fs.StringVar(&f.mask, "mask", "", "mask image; white marks the region to edit")
+	fs.BoolVar(&f.stripEXIF, "strip-exif", false, "remove EXIF, XMP and IPTC metadata from JPEG inputs before sending")
+	fs.StringVar(&f.promptFile, "prompt-file", "", "read the prompt from a file (- for stdin)")
+	fs.StringVar(&f.inputDir, "input-dir", "", "edit every image in this directory with the same prompt")
+	fs.StringVar(&f.glob, "glob", "", "with --input-dir, only edit files matching this pattern, e.g. *.jpg")
+
+	if err := fs.Parse(args); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
+	}
+	f.setFlags = visitedFlags(fs)
+	if err := f.apply(); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	defer func() { code = f.hookExit(code) }()
+	if f.inputDir != "" {
+		return runEditDir(&f, fs.Args())
+	}
+	if f.glob != "" {
+		errorf("--glob needs --input-dir")
+		return 1
+	}
+
+	// With session history the model already has the image, so the
+	// arguments may be just the prompt.
+	var history []apiContent
+	if f.session != "" {
+		var err error
+		if history, err = loadSession(f.session); err != nil {
+			errorf("%v", err)
+			return 1
+		}
+	}
+	var imagePaths []string
+	var prompt string
+	if f.promptFile != "" {
+		// Every positional argument is an image
+		for _, arg := range fs.Args() {
+			if !isImageArg(arg) {
+				errorf("%s is not an image file (the prompt comes from --prompt-file)", arg)
+				return 1
+			}
+			if arg == "-" && f.promptFile == "-" {
+				errorf("stdin cannot be both an input image and --prompt-file")
+				return 1
+			}
+			imagePaths = append(imagePaths, expandPath(arg))
+		}
+		if len(imagePaths) == 0 && len(history) == 0 {
+			errorf("usage: nanobanana edit <image> [image...] --prompt-file <file> [flags]")
+			return 1
+		}
+		var err error
+		if prompt, err = readPromptFile(f.promptFile); err != nil {
+			errorf("%v", err)
+			return 1
+		}
+	} else if len(history) > 0 && fs.NArg() > 0 && !isImageArg(fs.Arg(0)) {
+		prompt = strings.Join(fs.Args(), " ")
+	} else {
+		imagePaths, prompt = splitImageArgs(fs.Args())
+		if len(imagePaths) == 0 {
+			errorf("usage: nanobanana edit <image> [image...] \"prompt\" [flags]")
+			return 1
+		}
+	}
+	if strings.TrimSpace(prompt) == "" {
+		errorf("usage: nanobanana edit <image> [image...] \"prompt\" [flags]")
+		return 1
+	}
+	if f.mask != "" && len(imagePaths) == 0 {
+		errorf("--mask needs the image it applies to as the first argument")
+		return 1
+	}
+	if f.mask == "-" {
+		errorf("--mask cannot be read from stdin")
+		return 1
+	}
+	imagePath := ""
+	if len(imagePaths) > 0 {
+		imagePath = imagePaths[0]
+	}
+	// --aspect auto is settled once the input image is read
+	autoAspect := f.aspect == "auto"
+	if autoAspect {
+		if len(imagePaths) == 0 {
+			errorf("--aspect auto needs an input image")
+			return 1
+		}
+		f.aspect = "1:1"
+	}
+
+	cfg, err := loadCommandConfig(f.profile)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+
+	modelName, err := f.resolve(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	opts, err := f.sessionOptions()
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	if err := f.checkPrompt(prompt); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	if f.output != "" {
+		if _, err := f.claimOutput(f.output); err != nil {
+			errorf("%v", err)
+			return 1
+		}
+	}
+
+	apiKey, err := resolveAPIKey(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return exitAuth
+	}
+
+	if err := f.prepareOutputDir(cfg); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+
+	// Read input images
+	var images []inputImage
+	var labels []string
+	for _, path := range imagePaths {
+		imgData, mimeType, err := readImage(path)
+		if err != nil {
+			errorf("%v", err)
+			return exitIO
+		}
+		images = append(images, inputImage{Data: imgData, MIMEType: mimeType})
+		labels = append(labels, imageLabel(path))
+	}
+
+	if autoAspect {
+		f.aspect = autoAspectRatio(modelName, images[0])
+		opts.Aspect = f.aspect
+	}
+
+	// The mask goes last, after the images it describes
+	if f.mask != "" {
+		mask, err := readMask(f.mask, images[0])
+		if err != nil {
+			errorf("%v", err)
+			return exitIO
+		}
+		images = append(images, mask)
+		labels[0] += " (masked by " + imageLabel(f.mask) + ")"
+	}
+	if f.stripEXIF {
+		for i := range images {
+			images[i].Data = stripJPEGMetadata(images[i].Data)
+		}
+	}
+
+	imageCost, _ := estimateCost(modelName, f.size, 1)
+	if len(labels) == 0 {
+		labels = append(labels, "the "+f.session+" session image")
+	}
+	info("Editing %s with %s (%s)", strings.Join(labels, ", "), f.model, prompt)
+	if !f.confirmSpend(fmt.Sprintf("1 image with %s (%s, %s)", modelName, f.aspect, f.size), imageCost, imageCost > 0) {
+		errorf("aborted")
+		return 1
+	}
+	stop := startSpinner("Editing image...")
+
+	resultData, resultMIME, used, err := f.withAutoFix(prompt, func(p string) ([]byte, string, error) {
+		if f.mask != "" {
+			p += "\n\n" + maskInstruction
+		}
+		return editImage(apiKey, modelName, p, images, opts)
+	})
+	stop()
+	text := ""
+	if f.withText {
+		text = replyText(opts.Reply)
+	}
+	source := resultData
+	if err == nil {
+		resultData, resultMIME, err = f.convert(resultData, resultMIME)
+	}
+	if err != nil {
+		errorf("%v", err)
+		return exitCode(err)
+	}
+
+	// Write output
+	if f.output == "-" {
+		if _, err := os.Stdout.Write(resultData); err != nil {
+			errorf("writing to stdout: %v", err)
+			return exitIO
+		}
+		f.record("edit", used, "-", imagePaths)
+		f.saveSessionTurn(opts, used, images)
+		if f.json {
+			json.NewEncoder(os.Stderr).Encode(jsonResult{
+				File:            "-",
+				Model:           modelName,
+				Prompt:          prompt,
+				Bytes:           len(resultData),
+				MIMEType:        resultMIME,
+				Aspect:          f.aspect,
+				Size:            f.size,
+				Seed:            f.seed,
+				System:          f.system,
+				Cost:            imageCost,
+				SynthID:         true,
+				Credentials:     hasContentCredentials(resultData),
+				EffectivePrompt: effectivePrompt(prompt, used),
+				Text:            text,
+				Usage:           opts.Usage.tokens(),
+			})
+		}
+		f.showText(text)
+		f.reportUsage(opts.Usage)
+	} else {
+		outPath := f.output
+		if outPath == "" {
+			outPath = f.editedPath(imagePath, prompt, resultMIME)
+		} else if outPath, err = f.claimOutput(outPath); err != nil {
+			errorf("%v", err)
+			return 1
+		}
+
+		if err := writeImageWithOptions(outPath, resultData, resultMIME, f.writeOptions(used, modelName, source)); err != nil {
+			errorf("writing image: %v", err)
+			return exitIO
+		}
+		f.record("edit", used, outPath, imagePaths)
+		f.saveSessionTurn(opts, used, images)
+
+		result := jsonResult{
+			File:            outPath,
+			Model:           modelName,
+			Prompt:          prompt,
+			Bytes:           len(resultData),
+			MIMEType:        resultMIME,
+			Aspect:          f.aspect,
+			Size:            f.size,
+			Seed:            f.seed,
+			System:          f.system,
+			Cost:            imageCost,
+			SynthID:         true,
+			Credentials:     hasContentCredentials(resultData),
+			EffectivePrompt: effectivePrompt(prompt, used),
+			Text:            text,
+			Usage:           opts.Usage.tokens(),
+			ExtraFiles:      f.saveExtraImages(outPath, f.extraImages(opts.Reply), used, modelName),
+		}
+		result.Thumbnail = f.writeThumbnail(outPath)
+		result.HookError = f.runHook(outPath)
+		var finish string
+		if opts.Reply != nil {
+			finish = opts.Reply.FinishReason
+		}
+		logResult("edit", result)
+		f.writeManifest("edit", result, finish, imagePaths)
+
+		if f.json {
+			json.NewEncoder(os.Stdout).Encode(result)
+		}
+		f.announce(outPath, "Saved to %s (%d bytes; %s)", outPath, len(resultData), f.settings())
+		f.showExtraFiles(result.ExtraFiles)
+		f.showText(text)
+		f.reportUsage(opts.Usage)
+
+		if f.preview {
+			if err := openFile(outPath); err != nil {
+				warn("could not open preview: %v", err)
+			}
+		}
+	}
+	if f.disclose {
+		info(synthIDNote)
+	}
+
+	return 0
+}
+
+// editedPath is the default output name for an edit of imagePath:
+// photo.jpg becomes photo_edited.jpg in --output-dir or the current
+// directory.
+func (f *imageFlags) editedPath(imagePath, prompt, mime string) string {
+	var outPath string
+	if imagePath == "-" || imagePath == "" || isDataURI(imagePath) {
+		outPath = f.autoName("edited", prompt, mime, 1)
+	} else if isURL(imagePath) {
+		outPath = urlEditedName(imagePath, mime)
+	} else {
+		ext := filepath.Ext(imagePath)
+		base := strings.TrimSuffix(filepath.Base(imagePath), ext)
+		outPath = base + "_edited" + ext
+	}
+	if f.format != "" {
+		outPath = strings.TrimSuffix(outPath, filepath.Ext(outPath)) + extForMIME(mime)
+	}
+	if f.outputDir != "" {
+		outPath = filepath.Join(f.outputDir, outPath)
+	}
+	return outPath
+}
+
+// inputDirExts are the file extensions --input-dir picks up.
+var inputDirExts = map[string]bool{".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".webp": true, ".avif": true}
+
+// listInputImages returns the image files directly inside dir, sorted by
+// name and filtered by a --glob pattern when one is given.
+func listInputImages(dir, glob string) ([]string, error) {
+	if glob != "" {
+		if _, err := filepath.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid --glob %q: %w", glob, err)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, classify(exitIO, fmt.Errorf("reading input directory: %w", err))
+	}
+	var paths []string
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || strings.HasPrefix(name, ".") || !inputDirExts[strings.ToLower(filepath.Ext(name))] {
+			continue
+		}
+		if glob != "" {
+			if ok, _ := filepath.Match(glob, name); !ok {
+				continue
+			}
+		}
+		paths = append(paths, filepath.Join(dir, name))
+	}
+	return paths, nil
+}
+
+// runEditDir applies one prompt to every image in --input-dir. A failed
+// image is reported and skipped, and a summary follows the last one.
+func runEditDir(f *imageFlags, args []string) int {
+	switch {
+	case f.output != "":
+		errorf("--input-dir saves one file per image; use --output-dir instead of --output or --stdout")
+		return 1
+	case f.session != "":
+		errorf("--session cannot be used with --input-dir")
+		return 1
+	case f.mask != "":
+		errorf("--mask cannot be used with --input-dir")
+		return 1
+	}
+	prompt := strings.Join(args, " ")
+	if f.promptFile != "" {
+		if len(args) > 0 {
+			errorf("with --input-dir and --prompt-file, give no other arguments")
+			return 1
+		}
+		var err error
+		if prompt, err = readPromptFile(f.promptFile); err != nil {
+			errorf("%v", err)
+			return 1
+		}
+	}
+	if strings.TrimSpace(prompt) == "" {
+		errorf("usage: nanobanana edit --input-dir <dir> \"prompt\" [flags]")
+		return 1
+	}
+	f.inputDir = expandPath(f.inputDir)
+	paths, err := listInputImages(f.inputDir, f.glob)
+	if err != nil {
+		errorf("%v", err)
+		return exitCode(err)
+	}
+	if len(paths) == 0 {
+		errorf("no images found in %s", f.inputDir)
+		return 1
+	}
+	autoAspect := f.aspect == "auto"
+	if autoAspect {
+		f.aspect = "1:1"
+	}
+
+	cfg, err := loadCommandConfig(f.profile)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	modelName, err := f.resolve(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	if err := f.checkPrompt(prompt); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	apiKey, err := resolveAPIKey(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return exitAuth
+	}
+	if err := f.prepareOutputDir(cfg); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+
+	imageCost, priced := estimateCost(modelName, f.size, 1)
+	info("Editing %d images in %s with %s (%s)", len(paths), f.inputDir, f.model, prompt)
+	if !f.confirmSpend(fmt.Sprintf("%d image(s) with %s (%s)", len(paths), modelName, f.size), imageCost*float64(len(paths)), priced) {
+		errorf("aborted")
+		return 1
+	}
+	var results []jsonResult
+	var failed, blocked []string
+	failCode := 0
+	fail := func(path string, err error) {
+		if f.json {
+			results = append(results, jsonResult{Input: path, Model: modelName, Prompt: prompt, Error: err.Error(), Blocked: isBlocked(err)})
+		} else {
+			errorf("%s: %v", path, err)
+		}
+		if isBlocked(err) {
+			blocked = append(blocked, filepath.Base(path))
+		} else {
+			failed = append(failed, filepath.Base(path))
+		}
+		failCode = cmp.Or(failCode, exitCode(err))
+	}
+	edited := 0
+	stopped := false // --exit-on-block saw a blocked image
+	for i, path := range paths {
+		data, mimeType, err := readImage(path)
+		if err != nil {
+			fail(path, classify(exitIO, err))
+			continue
+		}
+		img := inputImage{Data: data, MIMEType: mimeType}
+		if f.stripEXIF {
+			img.Data = stripJPEGMetadata(img.Data)
+		}
+		if autoAspect {
+			f.aspect = autoAspectRatio(modelName, img)
+		}
+		opts := f.options()
+
+		stop := startSpinner(fmt.Sprintf("Editing image %d of %d...", i+1, len(paths)))
+		resultData, resultMIME, used, err := f.withAutoFix(prompt, func(p string) ([]byte, string, error) {
+			return editImage(apiKey, modelName, p, []inputImage{img}, opts)
+		})
+		stop()
+		source := resultData
+		if err == nil {
+			resultData, resultMIME, err = f.convert(resultData, resultMIME)
+		}
+		if errors.Is(err, errCanceled) {
+			errorf("%v", err)
+			return exitCode(err)
+		}
+		if err != nil {
+			fail(path, err)
+			if stopped = f.exitOnBlock && isBlocked(err); stopped {
+				break
+			}
+			continue
+		}
+
+		outPath := f.editedPath(path, prompt, resultMIME)
+		if err := writeImageWithOptions(outPath, resultData, resultMIME, f.writeOptions(used, modelName, source)); err != nil {
+			fail(path, classify(exitIO, fmt.Errorf("writing image: %w", err)))
+			continue
+		}
+		f.record("edit", used, outPath, []string{path})
+
+		text := ""
+		if f.withText {
+			text = replyText(opts.Reply)
+		}
+		result := jsonResult{
+			File:            outPath,
+			Input:           path,
+			Model:           modelName,
+			Prompt:          prompt,
+			Bytes:           len(resultData),
+			MIMEType:        resultMIME,
+			Aspect:          f.aspect,
+			Size:            f.size,
+			Seed:            f.seed,
+			System:          f.system,
+			Cost:            imageCost,
+			SynthID:         true,
+			Credentials:     hasContentCredentials(resultData),
+			EffectivePrompt: effectivePrompt(prompt, used),
+			Text:            text,
+			Usage:           opts.Usage.tokens(),
+			ExtraFiles:      f.saveExtraImages(outPath, f.extraImages(opts.Reply), used, modelName),
+		}
+		result.Thumbnail = f.writeThumbnail(outPath)
+		result.HookError = f.runHook(outPath)
+		results = append(results, result)
+		edited++
+		var finish string
+		if opts.Reply != nil {
+			finish = opts.Reply.FinishReason
+		}
+		logResult("edit", result)
+		f.writeManifest("edit", result, finish, []string{path})
+
+		f.announce(outPath, "Saved to %s (%d bytes; %s)", outPath, len(resultData), f.settings())
+		f.showExtraFiles(result.ExtraFiles)
+		f.showText(text)
+		f.reportUsage(opts.Usage)
+		if f.preview {
+			if err := openFile(outPath); err != nil {
+				warn("could not open preview: %v", err)
+			}
+		}
+	}
+
+	if f.disclose && edited > 0 {
+		info(synthIDNote)
+	}
+	switch {
+	case len(failed) == 0 && len(blocked) == 0:
+		success("Edited %d of %d images", edited, len(paths))
+	case len(blocked) == 0:
+		warn("Edited %d of %d images (failed: %s)", edited, len(paths), strings.Join(failed, ", "))
+	default:
+		var stopNote string
+		if stopped {
+			stopNote = "; stopped by --exit-on-block"
+		}
+		warn("Edited %d of %d images (failed: %s; blocked: %s%s)", edited, len(paths),
+			cmp.Or(strings.Join(failed, ", "), "none"), strings.Join(blocked, ", "), stopNote)
+	}
+	if f.json {
+		json.NewEncoder(os.Stdout).Encode(results)
+	}
+	if stopped {
+		return exitBlocked
+	}
+	if len(failed)+len(blocked) > 0 {
+		return failCode
+	}
+	return 0
+}
+
+const replHelp = `Type a prompt to generate an image. Commands:
+  :model <name>    Switch model (flash, pro, legacy, or full name)
+  :aspect <ratio>  Set aspect ratio
+  :size <size>     Set image size
+  :settings        Show current settings
+  :help            Show this help
+  :quit            Exit (or Ctrl-D)`
+
+func runRepl(args []string) (code int) {
+	fs := flag.NewFlagSet("repl", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var f imageFlags
+	f.register(fs)
+
+	if err := fs.Parse(args); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
+	}
+	f.setFlags = visitedFlags(fs)
+	if err := f.apply(); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	defer func() { code = f.hookExit(code) }()
+	if f.output != "" {
+		errorf("--output cannot be used with repl (use --output-dir)")
+		return 1
+	}
+
+	cfg, err := loadCommandConfig(f.profile)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	modelName, err := f.resolve(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	apiKey, err := resolveAPIKey(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return exitAuth
+	}
+	if err := f.prepareOutputDir(cfg); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+
+	// With --session, each prompt continues the conversation
+	var history []apiContent
+	if f.session != "" {
+		if history, err = loadSession(f.session); err != nil {
+			errorf("%v", err)
+			return 1
+		}
+	}
+
+	saved := 0 // images so far, for {{.Index}} in --name-template
+
+	interactive := term.IsTerminal(int(os.Stdin.Fd()))
+	if interactive {
+		fmt.Fprintf(os.Stderr, "\n%snanobanana repl%s (%s, %s, %s)\n%s\n\n", colorBold, colorReset, f.model, f.aspect, f.size, replHelp)
+	}
+	if f.disclose {
+		info(synthIDNote)
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		if interactive {
+			fmt.Fprintf(os.Stderr, "%snanobanana>%s ", colorCyan, colorReset)
+		}
+		if !scanner.Scan() {
+			if interactive {
+				fmt.Fprintln(os.Stderr)
+			}
+			return 0
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, ":") {
+			cmd, arg, _ := strings.Cut(line[1:], " ")
+			arg = strings.TrimSpace(arg)
+			switch cmd {
+			case "quit", "exit", "q":
+				return 0
+			case "help", "h":
+				fmt.Fprintln(os.Stderr, replHelp)
+			case "settings":
+				info("model %s (%s), aspect %s, size %s", f.model, modelName, f.aspect, f.size)
+			case "model":
+				name, err := resolveModel(arg)
+				if err != nil {
+					errorf("%v", err)
+					continue
+				}
+				if err := validateImageOptions(name, f.aspect, f.size); err != nil {
+					errorf("%v (change :aspect or :size first)", err)
+					continue
+				}
+				if _, err := responseMIMEType(f.responseFormat, name); err != nil {
+					errorf("%v", err)
+					continue
+				}
+				f.model, modelName = arg, name
+				success("Model set to %s", f.model)
+			case "aspect":
+				arg = snapAspectRatio(arg, modelName)
+				if err := validateAspectRatio(arg, modelName); err != nil {
+					errorf("%v", err)
+					continue
+				}
+				f.aspect = arg
+				success("Aspect ratio set to %s", f.aspect)
+			case "size":
+				if err := validateImageSize(arg, modelName); err != nil {
+					errorf("%v", err)
+					continue
+				}
+				f.size = arg
+				success("Size set to %s", f.size)
+			default:
+				errorf("unknown command :%s (try :help)", cmd)
+			}
+			continue
+		}
+
+		if err := f.checkPrompt(line); err != nil {
+			errorf("%v", err)
+			continue
+		}
+		cost, priced := estimateCost(modelName, f.size, 1)
+		if !f.confirmSpend(fmt.Sprintf("1 image with %s (%s, %s)", modelName, f.aspect, f.size), cost, priced) {
+			info("Skipped")
+			continue
+		}
+		opts := f.options()
+		if f.session != "" {
+			opts.History, opts.Reply = history, &apiCandidate{}
+		}
+		stop := startSpinner("Generating image...")
+		imgData, mimeType, used, err := f.withAutoFix(line, func(p string) ([]byte, string, error) {
+			return generateImage(apiKey, modelName, p, opts)
+		})
+		stop()
+		source := imgData
+		if err == nil {
+			imgData, mimeType, err = f.convert(imgData, mimeType)
+		}
+		if errors.Is(err, errCanceled) {
+			errorf("%v", err)
+			return 1 // Ctrl-C ends the session rather than just the prompt
+		}
+		if err != nil {
+			errorf("%v", err)
+			continue
+		}
+		saved++
+		outPath := f.autoName("nanobanana", line, mimeType, saved)
+		if f.outputDir != "" {
+			outPath = filepath.Join(f.outputDir, outPath)
+		}
+		if err := writeImageWithOptions(outPath, imgData, mimeType, f.writeOptions(used, modelName, source)); err != nil {
+			errorf("writing image: %v", err)
+			continue
+		}
+		f.record("generate", used, outPath, nil)
+		history = f.saveSessionTurn(opts, used, nil)
+		imageCost, _ := estimateCost(modelName, f.size, 1)
+		result := jsonResult{
+			File:            outPath,
+			Model:           modelName,
+			Prompt:          line,
+			Bytes:           len(imgData),
+			MIMEType:        mimeType,
+			Aspect:          f.aspect,
+			Size:            f.size,
+			Seed:            f.seed,
+			System:          f.system,
+			Cost:            imageCost,
+			SynthID:         true,
+			Credentials:     hasContentCredentials(imgData),
+			EffectivePrompt: effectivePrompt(line, used),
+			Usage:           opts.Usage.tokens(),
+			ExtraFiles:      f.saveExtraImages(outPath, f.extraImages(opts.Reply), used, modelName),
+		}
+		result.Thumbnail = f.writeThumbnail(outPath)
+		result.HookError = f.runHook(outPath)
+		logResult("generate", result)
+		if f.manifest {
+			result.Text = replyText(opts.Reply)
+			f.writeManifest("generate", result, opts.Reply.FinishReason, nil)
+		}
+		if f.json {
+			json.NewEncoder(os.Stdout).Encode(result)
+		}
+		f.announce(outPath, "Saved to %s (%d bytes; %s)", outPath, len(imgData), f.settings())
+		f.showExtraFiles(result.ExtraFiles)
+		if f.withText {
+			f.showText(replyText(opts.Reply))
+		}
+		f.reportUsage(opts.Usage)
+		if f.preview {
+			if err := openFile(outPath); err != nil {
+				warn("could not open preview: %v", err)
+			}
+		}
+	}
+}
+
+func runSetup() int {
+	cfg, err := loadUserConfig()
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "\n%snanobanana setup%s\n\n", colorBold, colorReset)
+
+	// API key
+	fmt.Fprintf(os.Stderr, "Enter your Gemini API key")
+	if cfg.APIKey != "" {
+		fmt.Fprintf(os.Stderr, " (current: %s)", maskKey(cfg.APIKey))
+	}
+	fmt.Fprintf(os.Stderr, ": ")
+
+	scanner := bufio.NewScanner(os.Stdin)
+	if scanner.Scan() {
+		key := strings.TrimSpace(scanner.Text())
+		if key != "" {
+			cfg.APIKey = key
+		}
+	}
+
+	if cfg.APIKey == "" {
+		errorf("API key is required")
+		return 1
+	}
+
+	// Default model
+	fmt.Fprintf(os.Stderr, "Default model [flash/pro/legacy] (current: %s): ", cmp.Or(cfg.Model, "flash"))
+	if scanner.Scan() {
+		model := strings.TrimSpace(scanner.Text())
+		if model != "" {
+			if _, ok := modelAliases[model]; !ok {
+				errorf("invalid model: %s (must be flash, pro, or legacy)", model)
+				return 1
+			}
+			cfg.Model = model
+		}
+	}
+
+	// Optional defaults for --aspect and --size
+	for _, d := range []struct {
+		label string
+		key   string
+		value string
+	}{
+		{"Default aspect ratio", "aspect", cmp.Or(cfg.Aspect, "1:1")},
+		{"Default size", "size", cmp.Or(cfg.Size, "1K")},
+	} {
+		fmt.Fprintf(os.Stderr, "%s (current: %s, Enter to keep): ", d.label, d.value)
+		if !scanner.Scan() {
+			break
+		}
+		if v := strings.TrimSpace(scanner.Text()); v != "" {
+			if err := setConfigValue(cfg, "", d.key, v); err != nil {
+				errorf("%v", err)
+				return 1
+			}
+		}
+	}
+
+	if err := saveConfig(cfg); err != nil {
+		errorf("saving config: %v", err)
+		return 1
+	}
+
+	success("Config saved to %s", configPath())
+	return 0
+}
+
+func runConfig(args []string) int {
+	if len(args) > 0 && args[0] == "set" {
+		return runConfigSet(args[1:])
+	}
+
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var profileFlag string
+	fs.StringVar(&profileFlag, "profile", "", "show a specific profile")
+
+	if err := fs.Parse(args); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	if err := cfg.selectProfile(profileFlag); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "\n%snanobanana config%s\n\n", colorBold, colorReset)
+	h := helpLayout{w: os.Stderr, width: terminalWidth(os.Stderr)}
+	h.field("Config file", configPath())
+	for _, path := range baseConfigPaths() {
+		h.field("Base config", path)
+	}
+
+	apiKey, model := cfg.APIKey, cfg.Model
+	if cfg.profile != "" {
+		h.field("Profile", cfg.profile)
+		p := cfg.activeProfile()
+		if p.APIKey != "" {
+			apiKey = p.APIKey
+		}
+		if p.Model != "" {
+			model = p.Model
+		}
+	}
+
+	if apiKey != "" {
+		h.field("API key", maskKey(apiKey))
+	} else if cfg.APIKeyFile != "" {
+		h.field("API key file", cfg.APIKeyFile)
+	} else {
+		h.field("API key", colorYellow+"(not set)"+colorReset)
+	}
+
+	h.field("Model", model)
+	if cfg.OutputDir != "" {
+		h.field("Output dir", cfg.OutputDir)
+	}
+	if cfg.OutputTemplate != "" {
+		h.field("Name template", cfg.OutputTemplate)
+	}
+	if cfg.Aspect != "" {
+		h.field("Aspect", cfg.Aspect)
+	}
+	if cfg.Size != "" {
+		h.field("Size", cfg.Size)
+	}
+	if cfg.BaseURL != "" {
+		h.field("Base URL", cfg.BaseURL)
+	}
+	if cfg.Auth != "" {
+		h.field("Auth", cfg.Auth)
+	}
+	if cfg.System != "" {
+		h.field("System", cfg.System)
+	}
+	if cfg.PromptPrefix != "" {
+		h.field("Prefix", cfg.PromptPrefix)
+	}
+	if cfg.PromptSuffix != "" {
+		h.field("Suffix", cfg.PromptSuffix)
+	}
+	if len(cfg.Styles) > 0 {
+		names := make([]string, 0, len(cfg.Styles))
+		for name := range cfg.Styles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		h.field("Styles", strings.Join(names, ", "))
+	}
+	if cfg.PromptWarn > 0 {
+		h.field("Prompt warn", fmt.Sprintf("%d characters", cfg.PromptWarn))
+	}
+	if cfg.ConfirmExpensive {
+		h.field("Confirm", fmt.Sprintf("runs estimated at $%.2f or more", expensiveRunCost))
+	}
+	if len(cfg.Profiles) > 0 {
+		names := make([]string, 0, len(cfg.Profiles))
+		for name := range cfg.Profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		h.field("Profiles", strings.Join(names, ", "))
+	}
+
+	// Show env var overrides; a selected profile's key and model win over them
+	profile := cfg.activeProfile()
+	for _, env := range []string{"NANOBANANA_GEMINI_API_KEY", "GEMINI_API_KEY", "NANOBANANA_GEMINI_API_KEY_FILE"} {
+		if os.Getenv(env) != "" && profile.APIKey == "" {
+			fmt.Fprintf(os.Stderr, "\n  %s%s:%s set (overrides config)%s\n", colorYellow, env, colorReset, colorReset)
+			break
+		}
+	}
+	if envModel := os.Getenv("NANOBANANA_MODEL"); envModel != "" && profile.Model == "" {
+		fmt.Fprintf(os.Stderr, "  %sNANOBANANA_MODEL:%s %s (overrides config)%s\n", colorYellow, colorReset, envModel, colorReset)
+	}
+	for _, env := range []string{"NANOBANANA_ASPECT", "NANOBANANA_SIZE"} {
+		if v := os.Getenv(env); v != "" {
+			fmt.Fprintf(os.Stderr, "  %s%s:%s %s (overrides config)%s\n", colorYellow, env, colorReset, v, colorReset)
+		}
+	}
+	if envURL := os.Getenv("NANOBANANA_API_BASE_URL"); envURL != "" {
+		fmt.Fprintf(os.Stderr, "  %sNANOBANANA_API_BASE_URL:%s %s (overrides config)%s\n", colorYellow, colorReset, envURL, colorReset)
+	}
+	if envProfile := os.Getenv("NANOBANANA_PROFILE"); envProfile != "" && profileFlag == "" {
+		fmt.Fprintf(os.Stderr, "  %sNANOBANANA_PROFILE:%s %s (active profile)%s\n", colorYellow, colorReset, envProfile, colorReset)
+	}
+
+	fmt.Fprintln(os.Stderr)
+	return 0
+}
+
+// configKeys lists the keys accepted by "config set", in display order.
+var configKeys = []string{"api_key", "api_key_file", "model", "aspect", "size", "output_dir", "output_template", "base_url", "auth", "system", "prompt_prefix", "prompt_suffix", "prompt_warn_length", "confirm_expensive"}
+
+// setConfigValue validates and stores a single config key. With a profile
+// name, only api_key and model may be set, inside [profiles.<name>].
+func setConfigValue(cfg *Config, profile, key, value string) error {
+	switch key {
+	case "model":
+		if _, err := resolveModel(value); err != nil {
+			return err
+		}
+	case "api_key":
+		if value == "" {
+			return fmt.Errorf("api_key cannot be empty")
+		}
+	case "aspect", "size":
+		if profile != "" {
+			return fmt.Errorf("%s cannot be set per profile (profiles support api_key and model)", key)
+		}
+		check := Config{Aspect: value}
+		if key == "size" {
+			check = Config{Size: value}
+		}
+		if err := check.validateDefaults(); err != nil {
+			return err
+		}
+	case "output_template":
+		if profile != "" {
+			return fmt.Errorf("%s cannot be set per profile (profiles support api_key and model)", key)
+		}
+		if value != "" {
+			if _, err := parseNameTemplate(value); err != nil {
+				return err
+			}
+		}
+	case "auth":
+		if profile != "" {
+			return fmt.Errorf("%s cannot be set per profile (profiles support api_key and model)", key)
+		}
+		if value != "" && !slices.Contains(authMethods, value) {
+			return fmt.Errorf("unknown auth method %q (valid: %s)", value, strings.Join(authMethods, ", "))
+		}
+	case "api_key_file", "output_dir", "base_url", "system", "prompt_prefix", "prompt_suffix", "prompt_warn_length", "confirm_expensive":
+		if profile != "" {
+			return fmt.Errorf("%s cannot be set per profile (profiles support api_key and model)", key)
+		}
+	default:
+		return fmt.Errorf("unknown config key %q (valid: %s)", key, strings.Join(configKeys, ", "))
+	}
+
+	if profile != "" {
+		if cfg.Profiles == nil {
+			cfg.Profiles = make(map[string]Profile)
+		}
+		p := cfg.Profiles[profile]
+		if key == "model" {
+			p.Model = value
+		} else {
+			p.APIKey = value
+		}
+		cfg.Profiles[profile] = p
+		return nil
+	}
+
+	switch key {
+	case "api_key":
+		cfg.APIKey = value
+	case "model":
+		cfg.Model = value
+	case "api_key_file":
+		cfg.APIKeyFile = value
+	case "aspect":
+		cfg.Aspect = value
+	case "size":
+		cfg.Size = value
+	case "auth":
+		cfg.Auth = value
+	case "system":
+		cfg.System = value
+	case "prompt_prefix":
+		cfg.PromptPrefix = value
+	case "prompt_suffix":
+		cfg.PromptSuffix = value
+	case "prompt_warn_length":
+		n := 0
+		if value != "" {
+			var err error
+			if n, err = strconv.Atoi(value); err != nil || n < 1 {
+				return fmt.Errorf("prompt_warn_length must be a positive number of characters")
+			}
+		}
+		cfg.PromptWarn = n
+	case "confirm_expensive":
+		on := false
+		if value != "" {
+			var err error
+			if on, err = strconv.ParseBool(value); err != nil {
+				return fmt.Errorf("confirm_expensive must be true or false")
+			}
+		}
+		cfg.ConfirmExpensive = on
+	case "output_dir":
+		cfg.OutputDir = value
+	case "output_template":
+		cfg.OutputTemplate = value
+	case "base_url":
+		if value != "" {
+			base, err := parseBaseURL(value)
+			if err != nil {
+				return err
+			}
+			value = base
+		}
+		cfg.BaseURL = value
+	}
+	return nil
+}
+
+func runConfigSet(args []string) int {
+	fs := flag.NewFlagSet("config set", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var profileFlag string
+	fs.StringVar(&profileFlag, "profile", "", "write the value into [profiles.<name>]")
+
+	if err := fs.Parse(args); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
+	}
+	if fs.NArg() != 2 {
+		errorf("usage: nanobanana config set [--profile name] <key> <value> (keys: %s)", strings.Join(configKeys, ", "))
+		return 1
+	}
+	key, value := fs.Arg(0), fs.Arg(1)
+
+	cfg, err := loadUserConfig()
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	if err := setConfigValue(cfg, profileFlag, key, value); err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	if err := saveConfig(cfg); err != nil {
+		errorf("saving config: %v", err)
+		return 1
+	}
+
+	shown := value
+	if key == "api_key" {
+		shown = maskKey(value)
+	}
+	if profileFlag != "" {
+		success("Set %s = %s in profile %s", key, shown, profileFlag)
+	} else {
+		success("Set %s = %s", key, shown)
+	}
+	return 0
+}
+
+func runStyles(args []string) int {
+	fs := flag.NewFlagSet("styles", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var jsonFlag bool
+	fs.BoolVar(&jsonFlag, "json", false, "output as JSON")
+
+	if err := fs.Parse(args); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
+	}
+	jsonOutput = jsonFlag
+
+	cfg, err := loadConfig()
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	styles := styleList(cfg)
+
+	if jsonFlag {
+		json.NewEncoder(os.Stdout).Encode(styles)
+		return 0
+	}
+
+	h := helpLayout{w: os.Stdout, width: terminalWidth(os.Stdout)}
+	fmt.Fprintf(os.Stdout, "\n%snanobanana styles%s\n\n", colorBold, colorReset)
+	for _, s := range styles {
+		desc := s.Prompt
+		if s.Custom {
+			desc += " (config)"
+		}
+		h.row(14, s.Name, desc)
+	}
+	fmt.Fprintf(os.Stdout, "\n  Use with --style <name>; add your own under [styles] in %s\n\n", configPath())
+	return 0
+}
+
+type modelInfo struct {
+	Alias        string   `json:"alias,omitempty"`
+	Name         string   `json:"name"`
+	DisplayName  string   `json:"display_name,omitempty"`
+	AspectRatios []string `json:"aspect_ratios,omitempty"`
+	Sizes        []string `json:"sizes,omitempty"`
 }
 
-func run() int {
-	args := os.Args[1:]
-	if len(args) == 0 {
-		printUsage()
-		return 0
+type modelsResult struct {
+	Models        []modelInfo `json:"models"`
+	Live          []modelInfo `json:"live,omitempty"`
+	LiveCheckedAt *time.Time  `json:"live_checked_at,omitempty"` // when the live list was fetched
+}
+
+func runModels(args []string) int {
+	fs := flag.NewFlagSet("models", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var (
+		jsonFlag    bool
+		liveFlag    bool
+		refreshFlag bool
+		profileFlag string
+	)
+
+	fs.BoolVar(&jsonFlag, "json", false, "output as JSON")
+	fs.BoolVar(&liveFlag, "live", false, "also list image models available to your API key")
+	fs.BoolVar(&refreshFlag, "refresh", false, "fetch the --live list from the API even if the cache is fresh (implies --live)")
+	fs.StringVar(&profileFlag, "profile", "", "config profile to use with --live")
+
+	if err := fs.Parse(args); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
+	}
+	jsonOutput = jsonFlag
+	liveFlag = liveFlag || refreshFlag
+
+	var result modelsResult
+	for _, alias := range []string{"flash", "pro", "legacy"} {
+		name := modelAliases[alias]
+		result.Models = append(result.Models, modelInfo{
+			Alias:        alias,
+			Name:         name,
+			AspectRatios: supportedAspectRatios(name),
+			Sizes:        supportedSizes(name),
+		})
 	}
 
-	// Check for updates (skip for version/help/upgrade/readme commands)
-	skipCheck := args[0] == "version" || args[0] == "help" || args[0] == "--help" || args[0] == "-h" || args[0] == "upgrade" || args[0] == "readme"
-	if !skipCheck {
-		checkForUpdates()
+	if liveFlag {
+		cfg, err := loadCommandConfig(profileFlag)
+		if err != nil {
+			errorf("%v", err)
+			return 1
+		}
+		apiKey, err := resolveAPIKey(cfg)
+		if err != nil {
+			errorf("%v", err)
+			return exitAuth
+		}
+		live, checkedAt, err := cachedLiveModels(apiKey, refreshFlag)
+		if err != nil {
+			errorf("%v", err)
+			return exitCode(err)
+		}
+		result.Live, result.LiveCheckedAt = live, &checkedAt
 	}
 
-	switch args[0] {
-	case "generate", "gen":
-		return runGenerate(args[1:])
-	case "edit":
-		return runEdit(args[1:])
-	case "setup":
-		return runSetup()
-	case "config":
-		return runConfig()
-	case "version":
-		printVersion()
-		return 0
-	case "upgrade":
-		return runUpgrade()
-	case "readme":
-		fmt.Print(readmeContent)
-		return 0
-	case "help", "--help", "-h":
-		printUsage()
+	if jsonFlag {
+		json.NewEncoder(os.Stdout).Encode(result)
 		return 0
+	}
+
+	fmt.Fprintf(os.Stdout, "\n%snanobanana models%s\n\n", colorBold, colorReset)
+	for _, m := range result.Models {
+		fmt.Fprintf(os.Stdout, "  %s%-8s%s %s\n", colorBold, m.Alias, colorReset, m.Name)
+		fmt.Fprintf(os.Stdout, "           Sizes:  %s\n", strings.Join(m.Sizes, ", "))
+		fmt.Fprintf(os.Stdout, "           Aspect: %s\n", strings.Join(m.AspectRatios, ", "))
+	}
+	if liveFlag {
+		fmt.Fprintf(os.Stdout, "\n  %sAvailable to your API key:%s", colorBold, colorReset)
+		if age := time.Since(*result.LiveCheckedAt); age >= time.Minute {
+			fmt.Fprintf(os.Stdout, " (cached %s ago; --refresh to update)", age.Round(time.Minute))
+		}
+		fmt.Fprintln(os.Stdout)
+		if len(result.Live) == 0 {
+			fmt.Fprintf(os.Stdout, "  %s(no image models found)%s\n", colorYellow, colorReset)
+		}
+		for _, m := range result.Live {
+			fmt.Fprintf(os.Stdout, "  %s  %s\n", m.Name, m.DisplayName)
+		}
+	}
+	fmt.Fprintln(os.Stdout)
+	return 0
+}
+
+// modelsCache is the models --live list saved between runs. Source
+// fingerprints the API root and key it came from, since another key may
+// see other models.
+type modelsCache struct {
+	Source    string      `json:"source"`
+	Models    []modelInfo `json:"models"`
+	CheckedAt time.Time   `json:"checked_at"`
+}
+
+const modelsCacheTTL = 24 * time.Hour
+
+func modelsCachePath() string {
+	return filepath.Join(configDir(), "models-cache.json")
+}
+
+// modelsCacheSource fingerprints apiKey, or the ADC credentials, and the
+// API root without storing the key itself.
+func modelsCacheSource(apiKey string) string {
+	if adc != nil {
+		apiKey = "adc:" + adc.source
+	}
+	sum := sha256.Sum256([]byte(apiBaseURL + "\n" + apiKey))
+	return fmt.Sprintf("%x", sum[:8])
+}
+
+// cachedLiveModels returns the live models list and when it was fetched,
+// from the cache while it is younger than modelsCacheTTL and from the API
+// otherwise (or when refresh is set). A fresh list replaces the cache.
+func cachedLiveModels(apiKey string, refresh bool) ([]modelInfo, time.Time, error) {
+	cachePath := modelsCachePath()
+	source := modelsCacheSource(apiKey)
+	if !refresh {
+		var cache modelsCache
+		if data, err := os.ReadFile(cachePath); err == nil {
+			if err := json.Unmarshal(data, &cache); err == nil && cache.Source == source &&
+				time.Since(cache.CheckedAt) < modelsCacheTTL {
+				debugf("Using models cached at %s", cache.CheckedAt.Format(time.RFC3339))
+				return cache.Models, cache.CheckedAt, nil
+			}
+		}
+	}
+
+	live, err := listLiveModels(apiKey)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	cache := modelsCache{Source: source, Models: live, CheckedAt: time.Now()}
+	if data, err := json.Marshal(cache); err == nil {
+		os.MkdirAll(filepath.Dir(cachePath), 0755)
+		if err := os.WriteFile(cachePath, data, 0644); err != nil {
+			debugf("Could not cache models: %v", err)
+		}
+	}
+	return live, cache.CheckedAt, nil
+}
+
+// listLiveModels queries the models endpoint and returns image-capable
+// models that support generateContent.
+func listLiveModels(apiKey string) ([]modelInfo, error) {
+	client := newHTTPClient(httpTimeout)
+	var out []modelInfo
+	pageToken := ""
+	for {
+		endpoint := apiBaseURL + "/v1beta/models?pageSize=1000"
+		if pageToken != "" {
+			endpoint += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		req, err := http.NewRequest("GET", endpoint, nil)
+		if err != nil {
+			return nil, fmt.Errorf("creating request: %w", err)
+		}
+		if err := setAuth(req, apiKey); err != nil {
+			return nil, err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return nil, classify(exitNetwork, connectionError(req, err))
+		}
+		var page struct {
+			Models []struct {
+				Name                       string   `json:"name"`
+				DisplayName                string   `json:"displayName"`
+				SupportedGenerationMethods []string `json:"supportedGenerationMethods"`
+			} `json:"models"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if resp.StatusCode == 401 || resp.StatusCode == 403 {
+			return nil, classify(exitAuth, fmt.Errorf("authentication failed. Check your API key: nanobanana setup"))
+		}
+		if resp.StatusCode == 429 {
+			return nil, classify(exitRateLimit, fmt.Errorf("rate limit exceeded. Wait and try again"))
+		}
+		if resp.StatusCode != 200 {
+			return nil, fmt.Errorf("listing models failed: HTTP %d", resp.StatusCode)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parsing models response: %w", err)
+		}
+
+		for _, m := range page.Models {
+			name := strings.TrimPrefix(m.Name, "models/")
+			if !strings.Contains(name, "image") || !slices.Contains(m.SupportedGenerationMethods, "generateContent") {
+				continue
+			}
+			out = append(out, modelInfo{Name: name, DisplayName: m.DisplayName})
+		}
+		if page.NextPageToken == "" {
+			return out, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// validateCheck is one line of the validate checklist.
+type validateCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail"`
+	code   int    // exit code when the check failed
+}
+
+type validateResult struct {
+	OK     bool            `json:"ok"`
+	Checks []validateCheck `json:"checks"`
+}
+
+// runValidate checks that the config loads, an API key resolves and the
+// API accepts it. The key is tested by listing models, which is free; no
+// image is generated.
+func runValidate(args []string) int {
+	fs := flag.NewFlagSet("validate", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var (
+		jsonFlag    bool
+		profileFlag string
+	)
+	fs.BoolVar(&jsonFlag, "json", false, "output as JSON")
+	fs.StringVar(&profileFlag, "profile", "", "config profile to check")
+
+	if err := fs.Parse(args); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
+	}
+	jsonOutput = jsonFlag
+
+	result := validateResult{OK: true}
+	pass := func(name, detail string) {
+		result.Checks = append(result.Checks, validateCheck{Name: name, OK: true, Detail: detail})
+	}
+	fail := func(name string, err error) {
+		result.OK = false
+		result.Checks = append(result.Checks, validateCheck{Name: name, Detail: err.Error(), code: exitCode(err)})
+	}
+
+	cfg, err := loadCommandConfig(profileFlag)
+	switch {
+	case err != nil:
+		fail("Config", err)
+	case fileExists(configPath()):
+		pass("Config", configPath())
 	default:
-		errorf("unknown command: %s (try 'nanobanana help')", args[0])
+		pass("Config", configPath()+" (not created yet; using defaults)")
+	}
+
+	var apiKey string
+	authOK := false
+	if cfg != nil {
+		switch apiKey, err = resolveAPIKey(cfg); {
+		case err != nil:
+			fail("API key", classify(exitAuth, err))
+		case adc != nil:
+			authOK = true
+			pass("API key", "none; using Application Default Credentials from "+adc.source)
+		default:
+			authOK = true
+			pass("API key", maskKey(apiKey))
+		}
+		var f imageFlags
+		if modelName, err := f.resolve(cfg); err != nil {
+			fail("Defaults", err)
+		} else {
+			pass("Defaults", fmt.Sprintf("%s, %s, %s", modelName, f.aspect, f.size))
+		}
+	}
+
+	if authOK {
+		if live, err := listLiveModels(apiKey); err != nil {
+			fail("API", err)
+		} else {
+			pass("API", fmt.Sprintf("credentials accepted by %s (%d image models available)", apiBaseURL, len(live)))
+		}
+	}
+
+	if jsonFlag {
+		json.NewEncoder(os.Stdout).Encode(result)
+	} else {
+		fmt.Fprintf(os.Stdout, "\n%snanobanana validate%s\n\n", colorBold, colorReset)
+		for _, c := range result.Checks {
+			mark := colorGreen + "✓" + colorReset
+			if !c.OK {
+				mark = colorRed + "✗" + colorReset
+			}
+			fmt.Fprintf(os.Stdout, "  %s %s%-9s%s %s\n", mark, colorBold, c.Name, colorReset, c.Detail)
+		}
+		fmt.Fprintln(os.Stdout)
+	}
+
+	for _, c := range result.Checks {
+		if !c.OK {
+			return c.code
+		}
+	}
+	return 0
+}
+
+// describeInstruction is the prompt describe sends with each image unless
+// --instruction replaces it.
+const describeInstruction = "Describe this image so an image generator could re-create it: the subject, composition, setting, lighting, colors, style and medium. Reply with the prompt only, as a single paragraph."
+
+// describeResult is the --json output of describe.
+type describeResult struct {
+	File        string      `json:"file"`
+	Model       string      `json:"model"`
+	Description string      `json:"description,omitempty"`
+	Usage       *tokenUsage `json:"usage,omitempty"`
+	Error       string      `json:"error,omitempty"`
+	Blocked     bool        `json:"blocked,omitempty"`
+}
+
+func runDescribe(args []string) int {
+	fs := flag.NewFlagSet("describe", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var (
+		jsonFlag        bool
+		modelFlag       string
+		profileFlag     string
+		instructionFlag string
+	)
+	fs.BoolVar(&jsonFlag, "json", false, "output as JSON")
+	fs.StringVar(&modelFlag, "model", "", "model alias or name")
+	fs.StringVar(&modelFlag, "m", "", "model (shorthand)")
+	fs.StringVar(&profileFlag, "profile", "", "config profile (overrides NANOBANANA_PROFILE)")
+	fs.StringVar(&instructionFlag, "instruction", describeInstruction, "what to ask the model about each image")
+	fs.BoolVar(&mockAPI, "mock", false, "don't call the API; print a placeholder description (for testing scripts)")
+	fs.BoolVar(&verbose, "verbose", false, "log API requests and responses to stderr")
+	fs.BoolVar(&verbose, "v", false, "log API requests and responses (shorthand)")
+
+	if err := fs.Parse(args); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
+	}
+	jsonOutput = jsonFlag
+	quiet = jsonFlag
+	envMocked, err := envMock()
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	mockAPI = mockAPI || envMocked
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		errorf("usage: nanobanana describe <image> [image...] [--json]")
+		return 1
+	}
+
+	cfg, err := loadCommandConfig(profileFlag)
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	modelName, err := resolveModel(resolveModelFlag(modelFlag, cfg))
+	if err != nil {
+		errorf("%v", err)
+		return 1
+	}
+	apiKey, err := resolveAPIKey(cfg)
+	if err != nil {
+		errorf("%v", err)
+		return exitAuth
+	}
+
+	var results []describeResult
+	failCode := 0
+	for _, path := range paths {
+		result := describeResult{File: imageLabel(path), Model: modelName}
+		data, mimeType, err := readImage(path)
+		if err == nil {
+			var reply apiCandidate
+			var usage apiUsage
+			opts := genOptions{TextOnly: true, Reply: &reply, Usage: &usage}
+			stop := startSpinner(fmt.Sprintf("Describing %s...", result.File))
+			_, _, err = editImage(apiKey, modelName, instructionFlag, []inputImage{{Data: data, MIMEType: mimeType}}, opts)
+			stop()
+			result.Description, result.Usage = replyText(&reply), usage.tokens()
+		}
+		if errors.Is(err, errCanceled) {
+			errorf("%v", err)
+			return exitCode(err)
+		}
+		if err != nil {
+			result.Error, result.Blocked = err.Error(), isBlocked(err)
+			failCode = cmp.Or(failCode, exitCode(err))
+			if !jsonFlag {
+				errorf("%s: %v", result.File, err)
+			}
+		}
+		results = append(results, result)
+	}
+
+	switch {
+	case jsonFlag && len(results) == 1:
+		json.NewEncoder(os.Stdout).Encode(results[0])
+	case jsonFlag:
+		json.NewEncoder(os.Stdout).Encode(results)
+	default:
+		printed := 0
+		for _, r := range results {
+			if r.Error != "" {
+				continue
+			}
+			if len(paths) > 1 {
+				if printed > 0 {
+					fmt.Println()
+				}
+				fmt.Printf("%s%s:%s\n", colorBold, r.File, colorReset)
+			}
+			fmt.Println(r.Description)
+			printed++
+		}
+	}
+	return failCode
+}
+
+type fileInfo struct {
+	File     string         `json:"file"`
+	Format   string         `json:"format,omitempty"`
+	Width    int            `json:"width,omitempty"`
+	Height   int            `json:"height,omitempty"`
+	Bytes    int            `json:"bytes"`
+	Metadata *imageMetadata `json:"metadata,omitempty"`
+	Error    string         `json:"error,omitempty"`
+}
+
+func runInfo(args []string) int {
+	fs := flag.NewFlagSet("info", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+
+	var jsonFlag bool
+	fs.BoolVar(&jsonFlag, "json", false, "output as JSON")
+
+	if err := fs.Parse(args); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
+	}
+	jsonOutput = jsonFlag
+
+	paths := fs.Args()
+	if len(paths) == 0 {
+		errorf("usage: nanobanana info <file> [file...] [--json]")
+		return 1
+	}
+
+	var results []fileInfo
+	failed := false
+	for _, path := range paths {
+		fi := inspectFile(path)
+		if fi.Error != "" {
+			failed = true
+		}
+		results = append(results, fi)
+	}
+
+	if jsonFlag {
+		if len(results) == 1 {
+			json.NewEncoder(os.Stdout).Encode(results[0])
+		} else {
+			json.NewEncoder(os.Stdout).Encode(results)
+		}
+	} else {
+		for i, fi := range results {
+			if i > 0 {
+				fmt.Println()
+			}
+			printFileInfo(fi)
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+func inspectFile(path string) fileInfo {
+	fi := fileInfo{File: path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fi.Error = err.Error()
+		return fi
+	}
+	fi.Bytes = len(data)
+	if cfg, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		fi.Format = format
+		fi.Width = cfg.Width
+		fi.Height = cfg.Height
+	} else {
+		fi.Format = strings.TrimPrefix(detectMIMEType(path, data), "image/")
+	}
+	fi.Metadata = readMetadata(data)
+	return fi
+}
+
+func printFileInfo(fi fileInfo) {
+	fmt.Printf("%s%s%s\n", colorBold, fi.File, colorReset)
+	if fi.Error != "" {
+		fmt.Printf("  %sError:%s   %s\n", colorRed, colorReset, fi.Error)
+		return
+	}
+	if fi.Width > 0 {
+		fmt.Printf("  Format:  %s, %dx%d, %d bytes\n", fi.Format, fi.Width, fi.Height, fi.Bytes)
+	} else {
+		fmt.Printf("  Format:  %s, %d bytes\n", fi.Format, fi.Bytes)
+	}
+	m := fi.Metadata
+	if m == nil {
+		fmt.Printf("  %s(no nanobanana metadata)%s\n", colorYellow, colorReset)
+		return
+	}
+	fmt.Printf("  Prompt:  %s\n", m.Prompt)
+	fmt.Printf("  Model:   %s\n", m.Model)
+	if m.Aspect != "" || m.Size != "" {
+		fmt.Printf("  Aspect:  %s  Size: %s\n", m.Aspect, m.Size)
+	}
+	if m.Seed != nil {
+		fmt.Printf("  Seed:    %d\n", *m.Seed)
+	}
+	if !m.Created.IsZero() {
+		fmt.Printf("  Created: %s\n", m.Created.Local().Format(time.RFC1123))
+	}
+}
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name               string `json:"name"`
+		BrowserDownloadURL string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func runUpgrade() int {
+	info("Checking for updates...")
+
+	resp, err := http.Get(fmt.Sprintf("https://api.github.com/repos/%s/releases/latest", githubRepo))
+	if err != nil {
+		errorf("failed to check for updates: %v", err)
 		return 1
 	}
-}
+	defer resp.Body.Close()
 
-func runGenerate(args []string) int {
-	fs := flag.NewFlagSet("generate", flag.ContinueOnError)
-	fs.SetOutput(io.Discard)
+	if resp.StatusCode != 200 {
+		errorf("failed to check for updates: HTTP %d", resp.StatusCode)
+		return 1
+	}
 
-	var (
-		modelFlag   string
-		outputFlag  string
-		aspectFlag  string
-		sizeFlag    string
-		quietFlag   bool
-		jsonFlag    bool
-		previewFlag bool
-		countFlag   int
-	)
+	var release githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		errorf("failed to parse release info: %v", err)
+		return 1
+	}
 
-	fs.StringVar(&modelFlag, "model", "", "model: flash, pro, legacy, or full model name")
-	fs.StringVar(&modelFlag, "m", "", "model (shorthand)")
-	fs.StringVar(&outputFlag, "output", "", "output file path")
-	fs.StringVar(&outputFlag, "o", "", "output file path (shorthand)")
-	fs.StringVar(&aspectFlag, "aspect", "1:1", "aspect ratio")
-	fs.StringVar(&aspectFlag, "a", "1:1", "aspect ratio (shorthand)")
-	fs.StringVar(&sizeFlag, "size", "1K", "image size: 512px, 1K, 2K, 4K")
-	fs.StringVar(&sizeFlag, "s", "1K", "image size (shorthand)")
-	fs.BoolVar(&quietFlag, "quiet", false, "suppress output, print only file path")
-	fs.BoolVar(&quietFlag, "q", false, "suppress output (shorthand)")
-	fs.BoolVar(&jsonFlag, "json", false, "output result as JSON")
-	fs.BoolVar(&previewFlag, "preview", false, "open image after saving")
-	fs.BoolVar(&previewFlag, "p", false, "open image after saving (shorthand)")
-	fs.IntVar(&countFlag, "count", 1, "number of images to generate")
-	fs.IntVar(&countFlag, "n", 1, "number of images (shorthand)")
+	latestVersion := strings.TrimPrefix(release.TagName, "v")
+	currentVersion := strings.TrimPrefix(Version, "v")
 
-	if err := fs.Parse(args); err != nil {
-		errorf("invalid flags: %v", err)
-		return 1
+	if latestVersion == currentVersion {
+		success("Already at latest version (%s)", Version)
+		return 0
 	}
-	quiet = quietFlag || jsonFlag
 
-	remaining := fs.Args()
-	if len(remaining) == 0 {
-		errorf("usage: nanobanana generate \"prompt\" [flags]")
-		return 1
+	info("New version available: v%s (current: %s)", latestVersion, Version)
+
+	// Find the right tarball for this platform
+	assetName := fmt.Sprintf("nanobanana-%s-%s.tar.gz", runtime.GOOS, runtime.GOARCH)
+	var downloadURL string
+	for _, asset := range release.Assets {
+		if asset.Name == assetName {
+			downloadURL = asset.BrowserDownloadURL
+			break
+		}
 	}
-	prompt := strings.Join(remaining, " ")
 
-	if countFlag < 1 || countFlag > 8 {
-		errorf("--count must be between 1 and 8")
+	if downloadURL == "" {
+		errorf("no binary available for %s/%s", runtime.GOOS, runtime.GOARCH)
 		return 1
 	}
 
-	cfg, err := loadConfig()
+	info("Downloading %s...", assetName)
+	dlResp, err := http.Get(downloadURL)
 	if err != nil {
-		errorf("%v", err)
+		errorf("failed to download: %v", err)
 		return 1
 	}
+	defer dlResp.Body.Close()
 
-	modelFlag = resolveModelFlag(modelFlag, cfg)
+	if dlResp.StatusCode != 200 {
+		errorf("failed to download: HTTP %d", dlResp.StatusCode)
+		return 1
+	}
 
-	modelName, err := resolveModel(modelFlag)
+	// Extract binary from tar.gz
+	binaryData, err := extractBinaryFromTarGz(dlResp.Body, "nanobanana")
 	if err != nil {
-		errorf("%v", err)
+		errorf("failed to extract binary: %v", err)
 		return 1
 	}
 
-	// Validate
-	if err := validateAspectRatio(aspectFlag, modelName); err != nil {
-		errorf("%v", err)
+	// Get current executable path
+	execPath, err := os.Executable()
+	if err != nil {
+		errorf("failed to get executable path: %v", err)
 		return 1
 	}
-	if err := validateImageSize(sizeFlag, modelName); err != nil {
-		errorf("%v", err)
+	execPath, err = filepath.EvalSymlinks(execPath)
+	if err != nil {
+		errorf("failed to resolve executable path: %v", err)
 		return 1
 	}
 
-	apiKey, err := resolveAPIKey(cfg)
+	// Write to temp file first
+	tmpFile, err := os.CreateTemp(filepath.Dir(execPath), "nanobanana-upgrade-*")
 	if err != nil {
-		errorf("%v", err)
+		errorf("failed to create temp file: %v", err)
 		return 1
 	}
+	tmpPath := tmpFile.Name()
 
-	if countFlag > 1 && outputFlag != "" {
-		errorf("--output cannot be used with --count > 1 (files are auto-named)")
+	_, err = tmpFile.Write(binaryData)
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		errorf("failed to write binary: %v", err)
 		return 1
 	}
 
-	var results []jsonResult
+	if err := os.Chmod(tmpPath, 0755); err != nil {
+		os.Remove(tmpPath)
+		errorf("failed to chmod: %v", err)
+		return 1
+	}
 
-	for i := range countFlag {
-		if countFlag > 1 {
-			info("Generating image %d/%d with %s (%s)", i+1, countFlag, modelFlag, prompt)
-		} else {
-			info("Generating with %s (%s, %s, %s)", modelFlag, aspectFlag, sizeFlag, prompt)
-		}
-		stop := startSpinner("Generating image...")
+	if err := os.Rename(tmpPath, execPath); err != nil {
+		os.Remove(tmpPath)
+		errorf("failed to replace binary: %v", err)
+		return 1
+	}
 
-		imgData, mimeType, err := generateImage(apiKey, modelName, prompt, aspectFlag, sizeFlag)
-		stop()
+	success("Upgraded to v%s", latestVersion)
+	return 0
+}
+
+func extractBinaryFromTarGz(r io.Reader, name string) ([]byte, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompressing: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			errorf("%v", err)
-			if countFlag > 1 {
-				continue // try remaining images
-			}
-			return 1
+			return nil, fmt.Errorf("reading tar: %w", err)
+		}
+		if hdr.Name == name {
+			return io.ReadAll(tr)
 		}
+	}
+	return nil, fmt.Errorf("%q not found in archive", name)
+}
 
-		// Write output
-		if outputFlag == "-" {
-			if _, err := os.Stdout.Write(imgData); err != nil {
-				errorf("writing to stdout: %v", err)
-				return 1
-			}
-			results = append(results, jsonResult{
-				File:   "-",
-				Model:  modelName,
-				Prompt: prompt,
-				Bytes:  len(imgData),
-			})
-		} else {
-			outPath := outputFlag
-			if outPath == "" {
-				outPath = autoName("nanobanana", mimeType)
-			}
+func printVersion() {
+	fmt.Printf("%snanobanana%s %s%s%s (%s/%s)\n", colorBold, colorReset, colorCyan, Version, colorReset, runtime.GOOS, runtime.GOARCH)
+}
 
-			if err := writeImage(outPath, imgData, mimeType); err != nil {
-				errorf("writing image: %v", err)
-				return 1
-			}
+// --- Prompt auto-fix ---
 
-			results = append(results, jsonResult{
-				File:   outPath,
-				Model:  modelName,
-				Prompt: prompt,
-				Bytes:  len(imgData),
-			})
+// autoFixRule softens prompt text matching a case-insensitive regular
+// expression. Rules can be replaced with [[auto_fix]] tables in the config.
+type autoFixRule struct {
+	Match   string `toml:"match"`
+	Replace string `toml:"replace"`
 
-			if !jsonFlag {
-				if quietFlag {
-					fmt.Println(outPath)
-				} else {
-					success("Saved to %s (%d bytes)", outPath, len(imgData))
-				}
-			}
+	re *regexp.Regexp // set by compileAutoFix
+}
 
-			if previewFlag {
-				if err := openFile(outPath); err != nil {
-					warn("could not open preview: %v", err)
-				}
-			}
+// defaultAutoFixRules tone down phrasing that commonly gets prompts
+// rejected, keeping the rest of the prompt intact. They only swap wording
+// that doesn't change what the picture shows.
+var defaultAutoFixRules = mustCompileAutoFix([]autoFixRule{
+	{Match: `\b(gory|gore|bloody|blood-soaked)\b`, Replace: "dramatic"},
+	{Match: `\b(corpse|dead body)\b`, Replace: "fallen figure"},
+	{Match: `\b(gun|rifle|pistol|firearm)(s?)\b`, Replace: "prop$2"},
+})
+
+// compileAutoFix compiles each rule's pattern, so a bad [[auto_fix]] table
+// fails when the config is resolved rather than after a rejected request.
+func compileAutoFix(rules []autoFixRule) ([]autoFixRule, error) {
+	out := make([]autoFixRule, len(rules))
+	for i, r := range rules {
+		re, err := regexp.Compile("(?i)" + r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid auto_fix pattern %q: %w", r.Match, err)
 		}
+		r.re = re
+		out[i] = r
 	}
+	return out, nil
+}
 
-	if jsonFlag {
-		if countFlag == 1 && len(results) == 1 {
-			json.NewEncoder(os.Stdout).Encode(results[0])
+func mustCompileAutoFix(rules []autoFixRule) []autoFixRule {
+	out, err := compileAutoFix(rules)
+	if err != nil {
+		panic(err)
+	}
+	return out
+}
+
+// rewritePrompt applies compiled auto-fix rules in order and reports
+// whether the prompt changed.
+func rewritePrompt(prompt string, rules []autoFixRule) (string, bool) {
+	out := prompt
+	for _, r := range rules {
+		out = r.re.ReplaceAllString(out, r.Replace)
+	}
+	return out, out != prompt
+}
+
+// withAutoFix runs call with prompt, wrapped by buildPrompt, and, when
+// --auto-fix is set and the API rejects the prompt as INVALID_ARGUMENT,
+// retries once with the rewritten prompt. With --retry-on-block a safety
+// block is retried once too, with the rewritten prompt if a rule matches
+// and unchanged otherwise. It returns the prompt that produced the result.
+func (f *imageFlags) withAutoFix(prompt string, call func(prompt string) ([]byte, string, error)) ([]byte, string, string, error) {
+	if built := f.buildPrompt(prompt); built != prompt {
+		debugf("Effective prompt: %s", built)
+		prompt = built
+	}
+	data, mime, err := call(prompt)
+	if err != nil && f.retryOnBlock && isBlocked(err) {
+		fixed, changed := rewritePrompt(prompt, f.autoFixRules)
+		if changed {
+			warn("%v; retrying with altered prompt: %q", err, fixed)
 		} else {
-			json.NewEncoder(os.Stdout).Encode(results)
+			warn("%v; retrying once", err)
 		}
+		data, mime, err = call(fixed)
+		return data, mime, fixed, err
+	}
+	if err == nil || !f.autoFix || !isInvalidArgument(err) {
+		return data, mime, prompt, err
+	}
+	fixed, changed := rewritePrompt(prompt, f.autoFixRules)
+	if !changed {
+		return nil, "", prompt, fmt.Errorf("%w (--auto-fix found nothing to rewrite)", err)
 	}
+	warn("Prompt rejected (%v); retrying with altered prompt: %q", err, fixed)
+	data, mime, err = call(fixed)
+	return data, mime, fixed, err
+}
 
-	if countFlag > 1 && len(results) == 0 {
-		return 1
+// effectivePrompt returns used when it differs from the original prompt,
+// for the effective_prompt JSON field.
+func effectivePrompt(original, used string) string {
+	if used == original {
+		return ""
 	}
-	return 0
+	return used
 }
 
-func runEdit(args []string) int {
-	fs := flag.NewFlagSet("edit", flag.ContinueOnError)
-	fs.SetOutput(io.Discard)
+// --- Sessions ---
 
-	var (
-		modelFlag   string
-		outputFlag  string
-		aspectFlag  string
-		sizeFlag    string
-		quietFlag   bool
-		jsonFlag    bool
-		previewFlag bool
-	)
+// maxSessionTurns caps how many prompt/reply pairs a --session file keeps.
+// Each reply holds a base64 image, so sessions grow by megabytes per turn.
+const maxSessionTurns = 8
 
-	fs.StringVar(&modelFlag, "model", "", "model: flash, pro, legacy, or full model name")
-	fs.StringVar(&modelFlag, "m", "", "model (shorthand)")
-	fs.StringVar(&outputFlag, "output", "", "output file path")
-	fs.StringVar(&outputFlag, "o", "", "output file path (shorthand)")
-	fs.StringVar(&aspectFlag, "aspect", "1:1", "aspect ratio")
-	fs.StringVar(&aspectFlag, "a", "1:1", "aspect ratio (shorthand)")
-	fs.StringVar(&sizeFlag, "size", "1K", "image size: 512px, 1K, 2K, 4K")
-	fs.StringVar(&sizeFlag, "s", "1K", "image size (shorthand)")
-	fs.BoolVar(&quietFlag, "quiet", false, "suppress output, print only file path")
-	fs.BoolVar(&quietFlag, "q", false, "suppress output (shorthand)")
-	fs.BoolVar(&jsonFlag, "json", false, "output result as JSON")
-	fs.BoolVar(&previewFlag, "preview", false, "open image after saving")
-	fs.BoolVar(&previewFlag, "p", false, "open image after saving (shorthand)")
+// sessionFile is the on-disk form of a --session conversation.
+type sessionFile struct {
+	Contents []apiContent `json:"contents"`
+}
 
-	if err := fs.Parse(args); err != nil {
-		errorf("invalid flags: %v", err)
-		return 1
+// loadSession returns the turns stored in a session file; a missing file
+// is an empty session.
+func loadSession(path string) ([]apiContent, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading session: %w", err)
+	}
+	var sf sessionFile
+	if err := json.Unmarshal(data, &sf); err != nil {
+		return nil, fmt.Errorf("parsing session %s: %w", path, err)
 	}
-	quiet = quietFlag || jsonFlag
+	return sf.Contents, nil
+}
 
-	remaining := fs.Args()
-	if len(remaining) < 2 {
-		errorf("usage: nanobanana edit <image> \"prompt\" [flags]")
-		return 1
+// trimSession drops the oldest prompt/reply pairs beyond maxSessionTurns.
+func trimSession(contents []apiContent) []apiContent {
+	if excess := len(contents) - 2*maxSessionTurns; excess > 0 {
+		return contents[excess:]
 	}
-	imagePath := remaining[0]
-	prompt := strings.Join(remaining[1:], " ")
+	return contents
+}
 
-	cfg, err := loadConfig()
+// saveSession writes turns to a session file.
+func saveSession(path string, contents []apiContent) error {
+	data, err := json.Marshal(sessionFile{Contents: contents})
 	if err != nil {
-		errorf("%v", err)
-		return 1
+		return fmt.Errorf("encoding session: %w", err)
 	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("writing session: %w", err)
+	}
+	return nil
+}
 
-	modelFlag = resolveModelFlag(modelFlag, cfg)
-
-	modelName, err := resolveModel(modelFlag)
+// sessionOptions returns generation options carrying the --session history
+// and a slot for the model's reply.
+func (f *imageFlags) sessionOptions() (genOptions, error) {
+	opts := f.options()
+	if f.session == "" {
+		return opts, nil
+	}
+	history, err := loadSession(f.session)
 	if err != nil {
-		errorf("%v", err)
-		return 1
+		return opts, err
 	}
+	opts.History = history
+	opts.Reply = &apiCandidate{}
+	return opts, nil
+}
 
-	// Validate
-	if err := validateAspectRatio(aspectFlag, modelName); err != nil {
-		errorf("%v", err)
-		return 1
+// saveSessionTurn appends a successful prompt and the model's reply to the
+// --session file and returns the updated history. Failures are warnings;
+// the image is already saved.
+func (f *imageFlags) saveSessionTurn(opts genOptions, prompt string, images []inputImage) []apiContent {
+	if f.session == "" || opts.Reply == nil {
+		return opts.History
 	}
-	if err := validateImageSize(sizeFlag, modelName); err != nil {
-		errorf("%v", err)
-		return 1
+	turn := userContent(prompt, images)
+	turn.Role = "user"
+	contents := trimSession(append(slices.Clone(opts.History), turn, opts.Reply.Content))
+	if err := saveSession(f.session, contents); err != nil {
+		warn("%v", err)
 	}
+	return contents
+}
 
-	apiKey, err := resolveAPIKey(cfg)
+// --- History ---
+
+// historyEntry is one successful generation in the history log.
+type historyEntry struct {
+	Index   int       `json:"index,omitempty"` // 1-based position, set when reading
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Prompt  string    `json:"prompt"`
+	Model   string    `json:"model"`
+	Aspect  string    `json:"aspect"`
+	Size    string    `json:"size"`
+	Seed    *int64    `json:"seed,omitempty"`
+	System  string    `json:"system,omitempty"`
+	Inputs  []string  `json:"inputs,omitempty"`
+	Mask    string    `json:"mask,omitempty"`
+	From    string    `json:"from,omitempty"` // generate --from reference image
+	File    string    `json:"file"`
+}
+
+func historyPath() string {
+	return filepath.Join(configDir(), "history.jsonl")
+}
+
+// recordHistory appends an entry to the history log. Failures never affect
+// the generation itself and are only reported with --verbose.
+func recordHistory(entry historyEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Index = 0
+	line, err := json.Marshal(entry)
 	if err != nil {
-		errorf("%v", err)
-		return 1
+		debugf("history: %v", err)
+		return
 	}
-
-	// Read input image
-	imgData, mimeType, err := readImage(imagePath)
+	if err := os.MkdirAll(configDir(), 0700); err != nil {
+		debugf("history: %v", err)
+		return
+	}
+	file, err := os.OpenFile(historyPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
-		errorf("%v", err)
-		return 1
+		debugf("history: %v", err)
+		return
 	}
-
-	inputLabel := imagePath
-	if imagePath == "-" {
-		inputLabel = "stdin"
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		debugf("history: %v", err)
 	}
-	info("Editing %s with %s (%s)", inputLabel, modelFlag, prompt)
-	stop := startSpinner("Editing image...")
+}
 
-	resultData, resultMIME, err := editImage(apiKey, modelName, prompt, imgData, mimeType, aspectFlag, sizeFlag)
-	stop()
+// readHistory returns all logged entries, oldest first. Malformed lines are
+// skipped but still count toward the numbering.
+func readHistory() ([]historyEntry, error) {
+	data, err := os.ReadFile(historyPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
 	if err != nil {
-		errorf("%v", err)
-		return 1
+		return nil, fmt.Errorf("reading history: %w", err)
 	}
-
-	// Write output
-	if outputFlag == "-" {
-		if _, err := os.Stdout.Write(resultData); err != nil {
-			errorf("writing to stdout: %v", err)
-			return 1
+	var entries []historyEntry
+	n := 0
+	for line := range strings.Lines(string(data)) {
+		if strings.TrimSpace(line) == "" {
+			continue
 		}
-		if jsonFlag {
-			json.NewEncoder(os.Stderr).Encode(jsonResult{
-				File:   "-",
-				Model:  modelName,
-				Prompt: prompt,
-				Bytes:  len(resultData),
-			})
+		n++
+		var e historyEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			debugf("history: skipping line %d: %v", n, err)
+			continue
 		}
-	} else {
-		outPath := outputFlag
-		if outPath == "" {
-			if imagePath == "-" {
-				outPath = autoName("edited", resultMIME)
-			} else {
-				ext := filepath.Ext(imagePath)
-				base := strings.TrimSuffix(filepath.Base(imagePath), ext)
-				outPath = base + "_edited" + ext
+		e.Index = n
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// historyPaths returns paths made absolute so history entries stay
+// meaningful from any directory.
+func historyPaths(paths ...string) []string {
+	out := make([]string, len(paths))
+	for i, p := range paths {
+		out[i] = p
+		if isDataURI(p) {
+			out[i] = dataURIPlaceholder(p)
+		} else if p != "-" && !isURL(p) {
+			if abs, err := filepath.Abs(p); err == nil {
+				out[i] = abs
 			}
 		}
+	}
+	return out
+}
 
-		if err := writeImage(outPath, resultData, resultMIME); err != nil {
-			errorf("writing image: %v", err)
-			return 1
-		}
+// manifest is the sidecar JSON that --manifest writes next to an image.
+type manifest struct {
+	jsonResult
+	Command      string            `json:"command"`
+	Time         time.Time         `json:"time"`
+	FinishReason string            `json:"finish_reason,omitempty"`
+	Inputs       []string          `json:"inputs,omitempty"`
+	Flags        map[string]string `json:"flags,omitempty"`
+}
 
-		if jsonFlag {
-			json.NewEncoder(os.Stdout).Encode(jsonResult{
-				File:   outPath,
-				Model:  modelName,
-				Prompt: prompt,
-				Bytes:  len(resultData),
-			})
-		} else if quietFlag {
-			fmt.Println(outPath)
-		} else {
-			success("Saved to %s (%d bytes)", outPath, len(resultData))
-		}
+// extraImages returns the images after the first in a reply when
+// --all-parts is set.
+func (f *imageFlags) extraImages(reply *apiCandidate) []outputImage {
+	if !f.allParts || reply == nil {
+		return nil
+	}
+	images, err := candidateImages(*reply)
+	if err != nil || len(images) < 2 {
+		return nil
+	}
+	return images[1:]
+}
 
-		if previewFlag {
-			if err := openFile(outPath); err != nil {
-				warn("could not open preview: %v", err)
-			}
+// partPath numbers a further image from the same reply: out.png is
+// followed by out_part2.png, out_part3.png and so on.
+func partPath(path string, n int) string {
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s_part%d%s", strings.TrimSuffix(path, ext), n, ext)
+}
+
+// saveExtraImages writes --all-parts images next to outPath and returns
+// their paths. A failure is a warning; the main image is already saved.
+func (f *imageFlags) saveExtraImages(outPath string, extra []outputImage, prompt, model string) []string {
+	var paths []string
+	for i, img := range extra {
+		path := partPath(outPath, i+2)
+		data, mime, err := f.convert(img.Data, img.MIMEType)
+		if err == nil {
+			err = writeImageWithOptions(path, data, mime, f.writeOptions(prompt, model, img.Data))
 		}
+		if err != nil {
+			warn("image part %d: %v", i+2, err)
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// showExtraFiles reports the --all-parts images after the main one.
+func (f *imageFlags) showExtraFiles(paths []string) {
+	for _, path := range paths {
+		f.announce(path, "Saved image part to %s", path)
+	}
+}
+
+// manifestPath is the sidecar name for an image: out.png gets out.png.json.
+func manifestPath(imagePath string) string {
+	return imagePath + ".json"
+}
+
+// writeManifest saves the --manifest sidecar for a saved image. A failure
+// is a warning; the image itself is already written.
+func (f *imageFlags) writeManifest(command string, result jsonResult, finish string, inputs []string) {
+	if !f.manifest || result.File == "-" {
+		return
+	}
+	data, err := json.MarshalIndent(manifest{
+		jsonResult:   result,
+		Command:      command,
+		Time:         time.Now().UTC(),
+		FinishReason: finish,
+		Inputs:       historyPaths(inputs...),
+		Flags:        f.setFlags,
+	}, "", "  ")
+	if err == nil {
+		err = os.WriteFile(manifestPath(result.File), append(data, '\n'), 0644)
 	}
+	if err != nil {
+		warn("writing manifest: %v", err)
+	}
+}
+
+// visitedFlags returns the flags set on the command line by name, with
+// shorthands and aliases under the name that was used.
+func visitedFlags(fs *flag.FlagSet) map[string]string {
+	set := make(map[string]string)
+	fs.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = fl.Value.String()
+	})
+	return set
+}
 
-	return 0
+// record logs a successful generation made with these flags.
+func (f *imageFlags) record(command, prompt, file string, inputs []string) {
+	mask, from := f.mask, f.from
+	if mask != "" {
+		mask = historyPaths(mask)[0]
+	}
+	if from != "" {
+		from = historyPaths(from)[0]
+	}
+	recordHistory(historyEntry{
+		Command: command,
+		Prompt:  prompt,
+		Model:   f.model,
+		Aspect:  f.aspect,
+		Size:    f.size,
+		Seed:    f.seed,
+		System:  f.system,
+		Inputs:  historyPaths(inputs...),
+		Mask:    mask,
+		From:    from,
+		File:    historyPaths(file)[0],
+	})
 }
 
-func runSetup() int {
-	cfg, err := loadConfig()
-	if err != nil {
-		errorf("%v", err)
-		return 1
+func runHistory(args []string) int {
+	if len(args) > 0 && args[0] == "rerun" {
+		return runHistoryRerun(args[1:])
 	}
 
-	fmt.Fprintf(os.Stderr, "\n%snanobanana setup%s\n\n", colorBold, colorReset)
+	fs := flag.NewFlagSet("history", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
 
-	// API key
-	fmt.Fprintf(os.Stderr, "Enter your Gemini API key")
-	if cfg.APIKey != "" {
-		masked := cfg.APIKey[:4] + "..." + cfg.APIKey[len(cfg.APIKey)-4:]
-		fmt.Fprintf(os.Stderr, " (current: %s)", masked)
+	var (
+		jsonFlag  bool
+		clearFlag bool
+		limit     int
+	)
+	fs.BoolVar(&jsonFlag, "json", false, "output as JSON")
+	fs.BoolVar(&clearFlag, "clear", false, "delete the history log")
+	fs.IntVar(&limit, "n", 20, "number of entries to show (0 for all)")
+
+	if err := fs.Parse(args); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
 	}
-	fmt.Fprintf(os.Stderr, ": ")
+	jsonOutput = jsonFlag
 
-	scanner := bufio.NewScanner(os.Stdin)
-	if scanner.Scan() {
-		key := strings.TrimSpace(scanner.Text())
-		if key != "" {
-			cfg.APIKey = key
+	if clearFlag {
+		if err := os.Remove(historyPath()); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errorf("clearing history: %v", err)
+			return 1
 		}
+		success("History cleared")
+		return 0
 	}
 
-	if cfg.APIKey == "" {
-		errorf("API key is required")
+	entries, err := readHistory()
+	if err != nil {
+		errorf("%v", err)
 		return 1
 	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
 
-	// Default model
-	fmt.Fprintf(os.Stderr, "Default model [flash/pro/legacy] (current: %s): ", cfg.Model)
-	if scanner.Scan() {
-		model := strings.TrimSpace(scanner.Text())
-		if model != "" {
-			if _, ok := modelAliases[model]; !ok {
-				errorf("invalid model: %s (must be flash, pro, or legacy)", model)
-				return 1
-			}
-			cfg.Model = model
+	if jsonFlag {
+		if entries == nil {
+			entries = []historyEntry{}
 		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(entries)
+		return 0
 	}
 
-	if err := saveConfig(cfg); err != nil {
-		errorf("saving config: %v", err)
-		return 1
+	if len(entries) == 0 {
+		info("No history yet (%s)", historyPath())
+		return 0
+	}
+	for _, e := range entries {
+		fmt.Printf("%s%4d%s  %s  %s %s %s  %q\n", colorBold, e.Index, colorReset,
+			e.Time.Local().Format("2006-01-02 15:04"), e.Model, e.Aspect, e.Size, e.Prompt)
+		if len(e.Inputs) > 0 {
+			fmt.Printf("        %sedit %s%s\n", colorCyan, strings.Join(e.Inputs, ", "), colorReset)
+		}
+		fmt.Printf("        → %s\n", e.File)
 	}
-
-	success("Config saved to %s", configPath())
 	return 0
 }
 
-func runConfig() int {
-	cfg, err := loadConfig()
+// rerunArgs rebuilds the command-line arguments for a history entry, with
+// override flags placed after the recorded ones so they take precedence.
+func rerunArgs(e historyEntry, overrides []string) []string {
+	args := []string{"--model", e.Model, "--aspect", e.Aspect, "--size", e.Size}
+	if e.Seed != nil {
+		args = append(args, "--seed", strconv.FormatInt(*e.Seed, 10))
+	}
+	if e.System != "" {
+		args = append(args, "--system", e.System)
+	}
+	if e.Mask != "" {
+		args = append(args, "--mask", e.Mask)
+	}
+	if e.From != "" {
+		args = append(args, "--from", e.From)
+	}
+	args = append(args, overrides...)
+	args = append(args, e.Inputs...)
+	return append(args, e.Prompt)
+}
+
+func runHistoryRerun(args []string) int {
+	if len(args) == 0 {
+		errorf("usage: nanobanana history rerun <N> [flags]")
+		return 1
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 {
+		errorf("invalid history index %q", args[0])
+		return 1
+	}
+	overrides := args[1:]
+
+	entries, err := readHistory()
 	if err != nil {
 		errorf("%v", err)
 		return 1
 	}
-
-	fmt.Fprintf(os.Stderr, "\n%snanobanana config%s\n\n", colorBold, colorReset)
-	fmt.Fprintf(os.Stderr, "  %sConfig file:%s  %s\n", colorBold, colorReset, configPath())
-
-	if cfg.APIKey != "" {
-		masked := cfg.APIKey[:4] + "..." + cfg.APIKey[len(cfg.APIKey)-4:]
-		fmt.Fprintf(os.Stderr, "  %sAPI key:%s      %s\n", colorBold, colorReset, masked)
-	} else {
-		fmt.Fprintf(os.Stderr, "  %sAPI key:%s      %s(not set)%s\n", colorBold, colorReset, colorYellow, colorReset)
+	var entry *historyEntry
+	for i := range entries {
+		if entries[i].Index == n {
+			entry = &entries[i]
+			break
+		}
+	}
+	if entry == nil {
+		errorf("no history entry %d (see: nanobanana history)", n)
+		return 1
+	}
+	if slices.Contains(entry.Inputs, "-") || entry.From == "-" {
+		errorf("history entry %d read an image from stdin and cannot be rerun", n)
+		return 1
+	}
+	if slices.ContainsFunc(entry.Inputs, isDataURI) || isDataURI(entry.From) {
+		errorf("history entry %d read an image from a data URI and cannot be rerun", n)
+		return 1
 	}
 
-	fmt.Fprintf(os.Stderr, "  %sModel:%s        %s\n", colorBold, colorReset, cfg.Model)
+	// Overrides must be flags only; the prompt and inputs come from history
+	fs := flag.NewFlagSet("history rerun", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var f imageFlags
+	f.register(fs)
+	if entry.Command == "generate" {
+		var g generateFlags
+		g.register(fs)
+	}
+	if err := fs.Parse(overrides); err != nil {
+		errorf("invalid flags: %v", err)
+		return 1
+	}
+	if fs.NArg() > 0 {
+		errorf("unexpected argument %q (history rerun only accepts flag overrides)", fs.Arg(0))
+		return 1
+	}
+	if f.model == "" {
+		if _, err := resolveModel(entry.Model); err != nil {
+			errorf("history entry %d uses model %q, which is no longer valid (override with --model)", n, entry.Model)
+			return 1
+		}
+	}
 
-	// Show env var overrides
-	for _, env := range []string{"NANOBANANA_GEMINI_API_KEY", "GEMINI_API_KEY"} {
-		if os.Getenv(env) != "" {
-			fmt.Fprintf(os.Stderr, "\n  %s%s:%s set (overrides config)%s\n", colorYellow, env, colorReset, colorReset)
-			break
+	// Edits default to <input>_edited.<ext>, which would replace the
+	// original result; give the rerun its own file instead.
+	if entry.Command == "edit" && f.output == "" && !f.stdout {
+		out := autoName("edited", detectMIMEType(entry.File, nil))
+		if f.outputDir != "" {
+			out = filepath.Join(f.outputDir, out)
 		}
+		overrides = append([]string{"--output", out}, overrides...)
 	}
-	if envModel := os.Getenv("NANOBANANA_MODEL"); envModel != "" {
-		fmt.Fprintf(os.Stderr, "  %sNANOBANANA_MODEL:%s %s (overrides config)%s\n", colorYellow, colorReset, envModel, colorReset)
+
+	rerun := rerunArgs(*entry, overrides)
+	switch entry.Command {
+	case "generate":
+		return runGenerate(rerun)
+	case "edit":
+		return runEdit(rerun)
 	}
+	errorf("history entry %d has unknown command %q", n, entry.Command)
+	return 1
+}
 
-	fmt.Fprintln(os.Stderr)
-	return 0
+// --- Shell completion ---
+
+// completionCommand describes a subcommand for shell completion.
+type completionCommand struct {
+	name  string
+	desc  string
+	files bool // complete positional arguments as file names
 }
 
-type githubRelease struct {
-	TagName string `json:"tag_name"`
-	Assets  []struct {
-		Name               string `json:"name"`
-		BrowserDownloadURL string `json:"browser_download_url"`
-	} `json:"assets"`
+var completionCommands = []completionCommand{
+	{name: "generate", desc: "Generate an image from text"},
+	{name: "gen", desc: "Generate an image from text"},
+	{name: "edit", desc: "Edit or combine existing images", files: true},
+	{name: "repl", desc: "Interactive prompt loop"},
+	{name: "models", desc: "List models, aliases and capabilities"},
+	{name: "styles", desc: "List --style presets"},
+	{name: "describe", desc: "Describe an image as a prompt", files: true},
+	{name: "info", desc: "Show metadata stored in an image", files: true},
+	{name: "validate", desc: "Check config, API key and connectivity"},
+	{name: "doctor", desc: "Check config, API key and connectivity"},
+	{name: "history", desc: "List past generations"},
+	{name: "setup", desc: "Configure API key"},
+	{name: "config", desc: "Show or set configuration"},
+	{name: "completion", desc: "Print a shell completion script"},
+	{name: "version", desc: "Show version info"},
+	{name: "upgrade", desc: "Upgrade to latest version"},
+	{name: "readme", desc: "Print full docs as markdown"},
+	{name: "help", desc: "Show help"},
 }
 
-func runUpgrade() int {
-	info("Checking for updates...")
+// completionFlags returns a flag set describing the flags a subcommand
+// accepts. The flags are never parsed.
+func completionFlags(cmd string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ContinueOnError)
+	var (
+		f imageFlags
+		g generateFlags
+		b bool
+		s string
+	)
+	switch cmd {
+	case "generate", "gen":
+		f.register(fs)
+		g.register(fs)
+		fs.StringVar(&s, "prompt-file", "", "read the prompt from a file (- for stdin)")
+		fs.StringVar(&s, "from", "", "reference image to base the new image on (file, URL, data: URI, or - for stdin)")
+	case "edit":
+		f.register(fs)
+		fs.StringVar(&s, "mask", "", "mask image; white marks the region to edit")
+		fs.BoolVar(&b, "strip-exif", false, "remove EXIF, XMP and IPTC metadata from JPEG inputs before sending")
+		fs.StringVar(&s, "prompt-file", "", "read the prompt from a file (- for stdin)")
+		fs.StringVar(&s, "input-dir", "", "edit every image in this directory with the same prompt")
+		fs.StringVar(&s, "glob", "", "with --input-dir, only edit files matching this pattern, e.g. *.jpg")
+	case "repl":
+		f.register(fs)
+	case "models":
+		fs.BoolVar(&b, "json", false, "output as JSON")
+		fs.BoolVar(&b, "live", false, "also list image models available to your API key")
+		fs.BoolVar(&b, "refresh", false, "fetch the --live list from the API even if the cache is fresh (implies --live)")
+		fs.StringVar(&s, "profile", "", "config profile to use with --live")
+	case "info", "styles":
+		fs.BoolVar(&b, "json", false, "output as JSON")
+	case "describe":
+		fs.BoolVar(&b, "json", false, "output as JSON")
+		fs.StringVar(&s, "model", "", "model alias or name")
+		fs.StringVar(&s, "m", "", "model (shorthand)")
+		fs.StringVar(&s, "profile", "", "config profile (overrides NANOBANANA_PROFILE)")
+		fs.StringVar(&s, "instruction", "", "what to ask the model about each image")
+		fs.BoolVar(&b, "mock", false, "don't call the API; print a placeholder description (for testing scripts)")
+		fs.BoolVar(&b, "verbose", false, "log API requests and responses to stderr")
+		fs.BoolVar(&b, "v", false, "log API requests and responses (shorthand)")
+	case "history":
+		var n int
+		fs.BoolVar(&b, "json", false, "output as JSON")
+		fs.BoolVar(&b, "clear", false, "delete the history log")
+		fs.IntVar(&n, "n", 20, "number of entries to show (0 for all)")
+	case "config":
+		fs.StringVar(&s, "profile", "", "show a specific profile")
+	case "validate", "doctor":
+		fs.BoolVar(&b, "json", false, "output as JSON")
+		fs.StringVar(&s, "profile", "", "config profile to check")
+	}
+	fs.BoolVar(&b, "no-color", false, "disable colored output")
+	fs.StringVar(&s, "config", "", "config file to use")
+	fs.StringVar(&s, "log-file", "", "append JSON log lines to this file")
+	fs.StringVar(&s, "env-file", "", "load settings from a dotenv file")
+	fs.StringVar(&s, "auth", "", "authenticate with an API key (api-key) or Application Default Credentials (adc)")
+	fs.BoolVar(&b, "env-override", false, "let --env-file replace variables that are already set")
+	return fs
+}
 
-	resp, err := http.Get(fmt.Sprintf("https://api.github.com/repos/%s/releases/latest", githubRepo))
-	if err != nil {
-		errorf("failed to check for updates: %v", err)
-		return 1
+// flagNames returns a flag set's flags as command-line options, using a
+// single dash for one-letter names.
+func flagNames(fs *flag.FlagSet) []string {
+	var names []string
+	fs.VisitAll(func(fl *flag.Flag) {
+		names = append(names, flagOption(fl.Name))
+	})
+	return names
+}
+
+func flagOption(name string) string {
+	if len(name) == 1 {
+		return "-" + name
 	}
-	defer resp.Body.Close()
+	return "--" + name
+}
 
-	if resp.StatusCode != 200 {
-		errorf("failed to check for updates: HTTP %d", resp.StatusCode)
-		return 1
+// isBoolFlag reports whether a flag takes no value.
+func isBoolFlag(fl *flag.Flag) bool {
+	b, ok := fl.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// flagValues returns the fixed values a flag accepts, or "file"/"dir" for
+// path flags, or nil when any value goes.
+func flagValues(name string) (values []string, kind string) {
+	switch name {
+	case "model", "m":
+		aliases := make([]string, 0, len(modelAliases))
+		for alias := range modelAliases {
+			aliases = append(aliases, alias)
+		}
+		sort.Strings(aliases)
+		return aliases, ""
+	case "aspect", "a":
+		return aspectRatioOrder, ""
+	case "size", "s":
+		return sizeOrder, ""
+	case "style":
+		names := make([]string, 0, len(builtinStyles))
+		for name := range builtinStyles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names, ""
+	case "safety":
+		return []string{"default", "relaxed", "strict"}, ""
+	case "auth":
+		return authMethods, ""
+	case "format":
+		return []string{"png", "jpg", "webp", "gif"}, ""
+	case "output", "o", "prompts-file", "prompt-file", "mask":
+		return nil, "file"
+	case "output-dir":
+		return nil, "dir"
 	}
+	return nil, ""
+}
 
-	var release githubRelease
-	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
-		errorf("failed to parse release info: %v", err)
-		return 1
+func bashCompletion() string {
+	var b strings.Builder
+	var names []string
+	for _, c := range completionCommands {
+		names = append(names, c.name)
+	}
+	b.WriteString("# bash completion for nanobanana\n")
+	b.WriteString("# Install: nanobanana completion bash > /etc/bash_completion.d/nanobanana\n")
+	b.WriteString("#      or: source <(nanobanana completion bash)\n\n")
+	b.WriteString("_nanobanana() {\n")
+	b.WriteString("    local cur prev cword words\n")
+	b.WriteString("    if declare -F _get_comp_words_by_ref >/dev/null 2>&1; then\n")
+	b.WriteString("        _get_comp_words_by_ref -n : cur prev cword words\n")
+	b.WriteString("    else\n")
+	b.WriteString("        cur=\"${COMP_WORDS[COMP_CWORD]}\"\n")
+	b.WriteString("        prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n")
+	b.WriteString("        cword=$COMP_CWORD\n")
+	b.WriteString("        words=(\"${COMP_WORDS[@]}\")\n")
+	b.WriteString("    fi\n\n")
+	fmt.Fprintf(&b, "    if [[ $cword -eq 1 ]]; then\n        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n        return\n    fi\n\n", strings.Join(names, " "))
+
+	// Values for flags that take an argument
+	b.WriteString("    case \"$prev\" in\n")
+	fs := completionFlags("generate")
+	var valueCases []string
+	fs.VisitAll(func(fl *flag.Flag) {
+		if isBoolFlag(fl) {
+			return
+		}
+		values, kind := flagValues(fl.Name)
+		var action string
+		switch {
+		case values != nil:
+			action = fmt.Sprintf("COMPREPLY=($(compgen -W %q -- \"$cur\"))", strings.Join(values, " "))
+			if fl.Name == "aspect" || fl.Name == "a" {
+				action += "\n            declare -F __ltrim_colon_completions >/dev/null 2>&1 && __ltrim_colon_completions \"$cur\""
+			}
+		case kind == "file":
+			action = "COMPREPLY=($(compgen -f -- \"$cur\"))"
+		case kind == "dir":
+			action = "COMPREPLY=($(compgen -d -- \"$cur\"))"
+		default:
+			action = "COMPREPLY=()"
+		}
+		valueCases = append(valueCases, fmt.Sprintf("        %s)\n            %s\n            return\n            ;;\n", flagOption(fl.Name), action))
+	})
+	b.WriteString(strings.Join(valueCases, ""))
+	b.WriteString("    esac\n\n")
+
+	// Flags per subcommand
+	b.WriteString("    local flags=\"\"\n")
+	b.WriteString("    case \"${words[1]}\" in\n")
+	for _, c := range completionCommands {
+		flags := flagNames(completionFlags(c.name))
+		if len(flags) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "        %s) flags=%q ;;\n", c.name, strings.Join(flags, " "))
+	}
+	b.WriteString("    esac\n\n")
+	b.WriteString("    if [[ \"$cur\" == -* ]]; then\n")
+	b.WriteString("        COMPREPLY=($(compgen -W \"$flags\" -- \"$cur\"))\n")
+	b.WriteString("        return\n")
+	b.WriteString("    fi\n")
+	b.WriteString("    case \"${words[1]}\" in\n")
+	for _, c := range completionCommands {
+		if c.files {
+			fmt.Fprintf(&b, "        %s) COMPREPLY=($(compgen -f -- \"$cur\")) ;;\n", c.name)
+		}
 	}
+	b.WriteString("        completion) COMPREPLY=($(compgen -W \"bash zsh fish\" -- \"$cur\")) ;;\n")
+	b.WriteString("        config) [[ $cword -eq 2 ]] && COMPREPLY=($(compgen -W \"set\" -- \"$cur\")) ;;\n")
+	b.WriteString("    esac\n")
+	b.WriteString("}\n\n")
+	b.WriteString("complete -o filenames -F _nanobanana nanobanana\n")
+	return b.String()
+}
 
-	latestVersion := strings.TrimPrefix(release.TagName, "v")
-	currentVersion := strings.TrimPrefix(Version, "v")
+// zshQuote escapes a description or value for an _arguments spec.
+func zshQuote(s string) string {
+	r := strings.NewReplacer("'", "'\\''", "[", "\\[", "]", "\\]", ":", "\\:")
+	return r.Replace(s)
+}
 
-	if latestVersion == currentVersion {
-		success("Already at latest version (%s)", Version)
-		return 0
+func zshCompletion() string {
+	var b strings.Builder
+	b.WriteString("#compdef nanobanana\n")
+	b.WriteString("# zsh completion for nanobanana\n")
+	b.WriteString("# Install: nanobanana completion zsh > \"${fpath[1]}/_nanobanana\"\n\n")
+	b.WriteString("_nanobanana() {\n")
+	b.WriteString("    local -a commands\n")
+	b.WriteString("    commands=(\n")
+	for _, c := range completionCommands {
+		fmt.Fprintf(&b, "        '%s:%s'\n", c.name, zshQuote(c.desc))
+	}
+	b.WriteString("    )\n\n")
+	b.WriteString("    if (( CURRENT == 2 )); then\n")
+	b.WriteString("        _describe 'command' commands\n")
+	b.WriteString("        return\n")
+	b.WriteString("    fi\n\n")
+	b.WriteString("    shift words\n")
+	b.WriteString("    (( CURRENT-- ))\n\n")
+	b.WriteString("    case \"${words[1]}\" in\n")
+	for _, c := range completionCommands {
+		fmt.Fprintf(&b, "        %s)\n            _arguments -s", c.name)
+		completionFlags(c.name).VisitAll(func(fl *flag.Flag) {
+			spec := fmt.Sprintf("%s[%s]", flagOption(fl.Name), zshQuote(fl.Usage))
+			if !isBoolFlag(fl) {
+				values, kind := flagValues(fl.Name)
+				switch {
+				case values != nil:
+					quoted := make([]string, len(values))
+					for i, v := range values {
+						quoted[i] = zshQuote(v)
+					}
+					spec += fmt.Sprintf(":%s:(%s)", fl.Name, strings.Join(quoted, " "))
+				case kind == "file":
+					spec += ":file:_files"
+				case kind == "dir":
+					spec += ":directory:_files -/"
+				default:
+					spec += fmt.Sprintf(":%s: ", fl.Name)
+				}
+			}
+			fmt.Fprintf(&b, " \\\n                '%s'", spec)
+		})
+		switch {
+		case c.files:
+			b.WriteString(" \\\n                '*:file:_files'")
+		case c.name == "completion":
+			b.WriteString(" \\\n                '1:shell:(bash zsh fish)'")
+		case c.name == "config":
+			b.WriteString(" \\\n                '1:action:(set)'")
+		}
+		b.WriteString("\n            ;;\n")
 	}
+	b.WriteString("    esac\n")
+	b.WriteString("}\n\n")
+	b.WriteString("_nanobanana \"$@\"\n")
+	return b.String()
+}
 
-	info("New version available: v%s (current: %s)", latestVersion, Version)
+// fishQuote escapes a string for a single-quoted fish argument.
+func fishQuote(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s)
+}
 
-	// Find the right tarball for this platform
-	assetName := fmt.Sprintf("nanobanana-%s-%s.tar.gz", runtime.GOOS, runtime.GOARCH)
-	var downloadURL string
-	for _, asset := range release.Assets {
-		if asset.Name == assetName {
-			downloadURL = asset.BrowserDownloadURL
-			break
+func fishCompletion() string {
+	var b strings.Builder
+	var names []string
+	for _, c := range completionCommands {
+		names = append(names, c.name)
+	}
+	b.WriteString("# fish completion for nanobanana\n")
+	b.WriteString("# Install: nanobanana completion fish > ~/.config/fish/completions/nanobanana.fish\n\n")
+	b.WriteString("complete -c nanobanana -f\n")
+	for _, c := range completionCommands {
+		fmt.Fprintf(&b, "complete -c nanobanana -n '__fish_use_subcommand' -a %s -d '%s'\n", c.name, fishQuote(c.desc))
+	}
+	for _, c := range completionCommands {
+		cond := fmt.Sprintf("__fish_seen_subcommand_from %s", c.name)
+		completionFlags(c.name).VisitAll(func(fl *flag.Flag) {
+			opt := "-l " + fl.Name
+			if len(fl.Name) == 1 {
+				opt = "-s " + fl.Name
+			}
+			line := fmt.Sprintf("complete -c nanobanana -n '%s' %s", cond, opt)
+			if !isBoolFlag(fl) {
+				values, kind := flagValues(fl.Name)
+				switch {
+				case values != nil:
+					line += fmt.Sprintf(" -x -a '%s'", strings.Join(values, " "))
+				case kind == "file":
+					line += " -r -F"
+				case kind == "dir":
+					line += " -x -a '(__fish_complete_directories)'"
+				default:
+					line += " -x"
+				}
+			}
+			fmt.Fprintf(&b, "%s -d '%s'\n", line, fishQuote(fl.Usage))
+		})
+		switch {
+		case c.files:
+			fmt.Fprintf(&b, "complete -c nanobanana -n '%s' -F\n", cond)
+		case c.name == "completion":
+			fmt.Fprintf(&b, "complete -c nanobanana -n '%s' -a 'bash zsh fish'\n", cond)
+		case c.name == "config":
+			fmt.Fprintf(&b, "complete -c nanobanana -n '%s' -a set -d 'Set a config value'\n", cond)
 		}
 	}
+	return b.String()
+}
 
-	if downloadURL == "" {
-		errorf("no binary available for %s/%s", runtime.GOOS, runtime.GOARCH)
+func runCompletion(args []string) int {
+	if len(args) != 1 {
+		errorf("usage: nanobanana completion [bash|zsh|fish]")
 		return 1
 	}
-
-	info("Downloading %s...", assetName)
-	dlResp, err := http.Get(downloadURL)
-	if err != nil {
-		errorf("failed to download: %v", err)
+	var script string
+	switch args[0] {
+	case "bash":
+		script = bashCompletion()
+	case "zsh":
+		script = zshCompletion()
+	case "fish":
+		script = fishCompletion()
+	default:
+		errorf("unsupported shell %q (valid: bash, zsh, fish)", args[0])
 		return 1
 	}
-	defer dlResp.Body.Close()
+	fmt.Print(script)
+	return 0
+}
 
-	if dlResp.StatusCode != 200 {
-		errorf("failed to download: HTTP %d", dlResp.StatusCode)
-		return 1
-	}
+// --- Help layout ---
 
-	// Extract binary from tar.gz
-	binaryData, err := extractBinaryFromTarGz(dlResp.Body, "nanobanana")
-	if err != nil {
-		errorf("failed to extract binary: %v", err)
-		return 1
-	}
+// minDescWidth is the narrowest description column worth keeping beside
+// its term; in a narrower terminal each term gets a line of its own.
+const minDescWidth = 30
 
-	// Get current executable path
-	execPath, err := os.Executable()
-	if err != nil {
-		errorf("failed to get executable path: %v", err)
-		return 1
+// configColumn is where the config command lines up its values.
+const configColumn = 16
+
+// ansiEscape matches the color codes, which take no room on screen.
+var ansiEscape = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// terminalWidth returns the width of the terminal on file, or 0 when file
+// isn't a terminal.
+func terminalWidth(file *os.File) int {
+	fd := int(file.Fd())
+	if !term.IsTerminal(fd) {
+		return 0
 	}
-	execPath, err = filepath.EvalSymlinks(execPath)
+	width, _, err := term.GetSize(fd)
 	if err != nil {
-		errorf("failed to resolve executable path: %v", err)
-		return 1
+		return 0
 	}
+	return width
+}
 
-	// Write to temp file first
-	tmpFile, err := os.CreateTemp(filepath.Dir(execPath), "nanobanana-upgrade-*")
-	if err != nil {
-		errorf("failed to create temp file: %v", err)
-		return 1
-	}
-	tmpPath := tmpFile.Name()
+// helpLayout writes two-column text, such as a flag and its description,
+// fitted to the terminal: descriptions wrap at the terminal width, and when
+// there's no room for two columns (or stderr isn't a terminal, width 0) each
+// term is printed on its own line with its description indented below.
+type helpLayout struct {
+	w     io.Writer
+	width int
+}
 
-	_, err = tmpFile.Write(binaryData)
-	tmpFile.Close()
-	if err != nil {
-		os.Remove(tmpPath)
-		errorf("failed to write binary: %v", err)
-		return 1
+// row writes term indented by two spaces and desc from column col. A term
+// that reaches col is followed by a single space instead. Each line of
+// desc starts a new line at col.
+func (h helpLayout) row(col int, term, desc string) {
+	lead := "  " + term
+	if h.width == 0 || h.width-col < minDescWidth {
+		fmt.Fprintln(h.w, lead)
+		for line := range strings.SplitSeq(desc, "\n") {
+			h.wrap("      ", line, "      ")
+		}
+		return
 	}
-
-	if err := os.Chmod(tmpPath, 0755); err != nil {
-		os.Remove(tmpPath)
-		errorf("failed to chmod: %v", err)
-		return 1
+	indent := strings.Repeat(" ", col)
+	for line := range strings.SplitSeq(desc, "\n") {
+		if n := visibleLen(lead); n < col {
+			lead += indent[n:]
+		} else {
+			lead += " "
+		}
+		h.wrap(lead, line, indent)
+		lead = ""
 	}
+}
 
-	if err := os.Rename(tmpPath, execPath); err != nil {
-		os.Remove(tmpPath)
-		errorf("failed to replace binary: %v", err)
-		return 1
+// field writes a config label and its value: aligned like a row in a
+// terminal, and as a plain "label: value" line otherwise.
+func (h helpLayout) field(label, value string) {
+	label = colorBold + label + ":" + colorReset
+	if h.width == 0 {
+		fmt.Fprintf(h.w, "  %s %s\n", label, value)
+		return
 	}
+	h.row(configColumn, label, value)
+}
 
-	success("Upgraded to v%s", latestVersion)
-	return 0
+// text writes a line of prose, wrapping it in a narrow terminal with
+// continuation lines indented two more spaces than the first.
+func (h helpLayout) text(line string) {
+	body := strings.TrimLeft(line, " ")
+	indent := line[:len(line)-len(body)]
+	h.wrap(indent, body, indent+"  ")
 }
 
-func extractBinaryFromTarGz(r io.Reader, name string) ([]byte, error) {
-	gz, err := gzip.NewReader(r)
-	if err != nil {
-		return nil, fmt.Errorf("decompressing: %w", err)
+// wrap writes lead followed by text, breaking lines before they pass the
+// terminal width and starting each continuation with indent. Text that
+// fits, or any text when there is no terminal, is written unchanged.
+func (h helpLayout) wrap(lead, text, indent string) {
+	if h.width == 0 || visibleLen(lead)+visibleLen(text) <= h.width {
+		fmt.Fprintln(h.w, lead+text)
+		return
 	}
-	defer gz.Close()
-
-	tr := tar.NewReader(gz)
-	for {
-		hdr, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("reading tar: %w", err)
+	line, n, empty := lead, visibleLen(lead), true
+	for _, word := range strings.Fields(text) {
+		wn := visibleLen(word)
+		if !empty && n+1+wn > h.width {
+			fmt.Fprintln(h.w, line)
+			line, n, empty = indent, len(indent), true
 		}
-		if hdr.Name == name {
-			return io.ReadAll(tr)
+		if !empty {
+			line += " "
+			n++
 		}
+		line += word
+		n += wn
+		empty = false
 	}
-	return nil, fmt.Errorf("%q not found in archive", name)
+	fmt.Fprintln(h.w, line)
 }
 
-func printVersion() {
-	fmt.Printf("%snanobanana%s %s%s%s (%s/%s)\n", colorBold, colorReset, colorCyan, Version, colorReset, runtime.GOOS, runtime.GOARCH)
+// visibleLen is the number of columns s takes on screen.
+func visibleLen(s string) int {
+	return utf8.RuneCountInString(ansiEscape.ReplaceAllString(s, ""))
 }
 
 func printUsage() {
+	h := helpLayout{w: os.Stderr, width: terminalWidth(os.Stderr)}
 	fmt.Fprintf(os.Stderr, "\n  %snanobanana%s — generate and edit images with Gemini\n\n", colorBold, colorReset)
 	fmt.Fprintf(os.Stderr, "  %sVersion:%s %s\n\n", colorBold, colorReset, Version)
 	fmt.Fprintf(os.Stderr, "%sUSAGE:%s\n", colorBold, colorReset)
-	fmt.Fprintln(os.Stderr, "  nanobanana generate \"prompt\"      Generate an image from text (alias: gen)")
-	fmt.Fprintln(os.Stderr, "  nanobanana edit <image> \"prompt\"   Edit an existing image (use - for stdin)")
-	fmt.Fprintln(os.Stderr, "  nanobanana setup                  Configure API key")
-	fmt.Fprintln(os.Stderr, "  nanobanana config                 Show current configuration")
-	fmt.Fprintln(os.Stderr, "  nanobanana version                Show version info")
-	fmt.Fprintln(os.Stderr, "  nanobanana upgrade                Upgrade to latest version")
-	fmt.Fprintln(os.Stderr, "  nanobanana readme                 Print full docs as markdown (for LLMs/agents)")
-	fmt.Fprintln(os.Stderr, "  nanobanana help                   Show this help")
+	h.row(36, "nanobanana generate \"prompt\"", "Generate an image from text (alias: gen)")
+	h.row(36, "nanobanana edit <img>... \"prompt\"", "Edit or combine images (file, URL, data: URI, or - for stdin)")
+	h.row(36, "nanobanana repl", "Interactive prompt loop (:model, :aspect, :size)")
+	h.row(36, "nanobanana models", "List models, aliases and capabilities")
+	h.row(36, "nanobanana styles", "List --style presets, built-in and from config")
+	h.row(36, "nanobanana describe <img>", "Describe an image as a prompt to re-create it (--json)")
+	h.row(36, "nanobanana info <file>", "Show prompt/model metadata stored in an image")
+	h.row(36, "nanobanana validate", "Check config, API key and connectivity (alias: doctor)")
+	h.row(36, "nanobanana history [-n N]", "List recent generations (--json, --clear)")
+	h.row(36, "nanobanana history rerun <N>", "Replay entry N; extra flags override (e.g. --size 4K)")
+	h.row(36, "nanobanana setup", "Configure API key")
+	h.row(36, "nanobanana config [--profile p]", "Show current configuration")
+	h.row(36, "nanobanana config set <key> <val>", "Set a single config value (e.g. model pro)")
+	h.row(36, "nanobanana completion <shell>", "Print bash, zsh or fish completion script")
+	h.row(36, "nanobanana version", "Show version info")
+	h.row(36, "nanobanana upgrade", "Upgrade to latest version")
+	h.row(36, "nanobanana readme", "Print full docs as markdown (for LLMs/agents)")
+	h.row(36, "nanobanana help", "Show this help")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintf(os.Stderr, "%sFLAGS:%s\n", colorBold, colorReset)
-	fmt.Fprintln(os.Stderr, "  -m, --model <name>    Model: flash, pro, legacy, or a full model name")
-	fmt.Fprintln(os.Stderr, "  -o, --output <path>   Output file path (default: auto-generated, - for stdout)")
-	fmt.Fprintln(os.Stderr, "  -a, --aspect <ratio>  Aspect ratio: 1:1, 2:3, 3:2, 3:4, 4:3, 4:5, 5:4, 9:16, 16:9, 21:9")
-	fmt.Fprintln(os.Stderr, "                       + flash-only: 1:4, 1:8, 4:1, 8:1 (default: 1:1)")
-	fmt.Fprintln(os.Stderr, "  -s, --size <size>     Size: 1K, 2K, 4K (+ 512px for flash; legacy only supports 1K)")
-	fmt.Fprintln(os.Stderr, "  -n, --count <N>       Generate N image variations (1-8, generate only)")
-	fmt.Fprintln(os.Stderr, "  -q, --quiet           Suppress output, print only file path to stdout")
-	fmt.Fprintln(os.Stderr, "      --json            Output result as JSON to stdout")
-	fmt.Fprintln(os.Stderr, "  -p, --preview         Open image after saving")
+	h.row(24, "-m, --model <name>", "Model: flash, pro, legacy, or a full model name")
+	h.row(24, "-o, --output <path>", "Output file path (default: auto-generated, - for stdout)")
+	h.row(24, "-a, --aspect <ratio>", "Aspect ratio: 1:1, 2:3, 3:2, 3:4, 4:3, 4:5, 5:4, 9:16, 16:9, 21:9\n+ flash-only: 1:4, 1:8, 4:1, 8:1; edit: auto (default: config or 1:1)\nOther ratios (2.35:1) or pixel sizes (1920x1080) snap to the nearest")
+	h.row(24, "-s, --size <size>", "Size: 1K, 2K, 4K (+ 512px for flash; legacy only supports 1K)")
+	h.row(24, "-n, --count <N>", "Generate N image variations (1-8, generate only)")
+	h.row(24, "    --mask <file>", "Edit only the white region of a mask image (edit only)")
+	h.row(24, "    --strip-exif", "Remove EXIF/GPS metadata from JPEG inputs (edit only)")
+	h.row(24, "    --input-dir <dir>", "Edit every image in dir with one prompt (edit only)")
+	h.row(24, "    --glob <pattern>", "With --input-dir, only files matching pattern, e.g. '*.jpg'")
+	h.row(24, "    --prompt-file <f>", "Read the prompt from a file, - for stdin (generate, edit)")
+	h.row(24, "    --from <img>", "Base a new image on a reference image (generate only)")
+	h.row(24, "    --prompts-file", "Generate one image per line of a file (generate only)")
+	h.row(24, "    --concurrency <N>", "Requests to run at once for batches (default: 3, generate only)")
+	h.row(24, "    --matrix <spec>", "Every aspect/size combination, e.g. \"aspect=1:1,16:9 size=1K,2K\"")
+	h.row(24, "    --compare", "Generate with flash and pro (name-flash.png, name-pro.png) and compare cost")
+	h.row(24, "    --skip-existing", "Skip images whose output file already exists (generate only)")
+	h.row(24, "    --output-dir", "Directory for auto-named outputs (ignored with --output)")
+	h.row(24, "    --estimate", "Print estimated cost and confirm before generating")
+	h.row(24, "-q, --quiet", "Suppress output, print only file path to stdout")
+	h.row(24, "    --no-spinner", "Print a static progress line instead of the spinner")
+	h.row(24, "    --json", "Output result as JSON to stdout")
+	h.row(24, "-p, --preview, --open", "Open image after saving")
+	h.row(24, "    --format <fmt>", "Force output format: png, jpg, webp, gif (sets extension)")
+	h.row(24, "    --response-format", "Ask the API for png or jpg directly instead of converting locally")
+	h.row(24, "    --quality <N>", "JPEG quality when saving as .jpg (1-100, default: 95)")
+	h.row(24, "    --max-bytes <N>", "Don't save images larger than N, e.g. 15MB")
+	h.row(24, "    --crop <spec>", "Crop the result: centered ratio (16:9) or box x,y,w,h")
+	h.row(24, "    --thumbnail <WxH>", "Also save a copy scaled to fit WxH as name_thumb.ext")
+	h.row(24, "    --target-size <N>", "Pick the JPEG quality that keeps the file under N, e.g. 200KB")
+	h.row(24, "    --no-metadata", "Don't embed prompt/model metadata in PNG/JPEG output")
+	h.row(24, "    --name-from-prompt", "Name auto-generated files after the prompt")
+	h.row(24, "    --name-template", "Template for auto-generated names, e.g. '{{.Slug}}-{{.Model}}{{.Ext}}'")
+	h.row(24, "    --disclose", "Note the invisible SynthID watermark on outputs")
+	h.row(24, "    --with-text", "Ask for text alongside the image and print it to stderr")
+	h.row(24, "    --manifest", "Write out.png.json with prompt, settings and finish reason")
+	h.row(24, "    --all-parts", "Save every image in the reply (out_part2.png, ...), not just the first")
+	h.row(24, "    --show-usage", "Print prompt, candidate and total token counts after each image")
+	h.row(24, "    --confirm", "Show model, size and estimated cost and ask before calling the API")
+	h.row(24, "    --overwrite", "Replace an existing --output file (refused by default)")
+	h.row(24, "    --no-clobber", "Save as out-1.png, out-2.png... if --output exists")
+	h.row(24, "    --stdout", "Write image bytes to stdout (same as -o -, implies --quiet)")
+	h.row(24, "    --seed <N>", "Seed for reproducible output (if the model honors it)\nwith --count, images use seed, seed+1, ...")
+	h.row(24, "    --profile <name>", "Use a [profiles.<name>] config section")
+	h.row(24, "    --auto-fix", "Retry once with a softened prompt if the API rejects it")
+	h.row(24, "    --retry-on-block", "Retry once (softened by the auto-fix rules) if safety blocks the image")
+	h.row(24, "    --exit-on-block", "Stop a batch at the first blocked image (exit code 7)")
+	h.row(24, "    --session <file>", "Continue a multi-turn conversation stored in file")
+	h.row(24, "    --system <text>", "System instruction, e.g. a house style (config: system)")
+	h.row(24, "    --prompt-prefix", "Text put before every prompt (config: prompt_prefix)")
+	h.row(24, "    --prompt-suffix", "Text put after every prompt, e.g. ', studio lighting' (config: prompt_suffix)")
+	h.row(24, "    --on-success <cmd>", "Run cmd after each save; {} is the path (--fail-on-hook to fail the run)")
+	h.row(24, "    --style <name>", "Append a style preset, e.g. anime, photoreal, pixel-art")
+	h.row(24, "    --safety <level>", "Safety filters: default, relaxed, strict")
+	h.row(24, "    --stream", "Stream the response and show bytes received")
+	h.row(24, "-v, --verbose", "Log API requests/responses to stderr (alias: --debug)")
+	h.row(24, "    --save-request", "Write the request JSON (image data truncated) to a file")
+	h.row(24, "    --save-response", "Write the raw response body to a file")
+	h.row(24, "    --proxy <url>", "Proxy URL (default: HTTP_PROXY/HTTPS_PROXY from env)")
+	h.row(24, "    --retries <N>", "Retries on rate limit (429), server errors or corrupt replies (default: 3)")
+	h.row(24, "    --retry-max-wait", "Maximum wait between retries, e.g. 10s (default: 30s)")
+	h.row(24, "    --rps <N>", "Send at most N requests per second, e.g. 0.5 (all workers)")
+	h.row(24, "    --timeout <dur>", "Give up on a request after this long, retries included")
+	h.row(24, "    --mock", "Don't call the API; save placeholder images (also NANOBANANA_MOCK=1)")
+	h.row(24, "    --timeout-per-retry", "Abandon and retry any single attempt that takes longer than this")
+	h.row(24, "    --no-color", "Disable colored output (any command; also NO_COLOR)")
+	h.row(24, "    --config <file>", "Use this config file (any command; also NANOBANANA_CONFIG)")
+	h.row(24, "    --log-file <file>", "Append JSON log lines to file, even with --quiet (any command)")
+	h.row(24, "    --env-file <file>", "Load NANOBANANA_* and GEMINI_API_KEY from a .env file (any command)")
+	h.row(24, "    --env-override", "Let --env-file replace variables already set in the environment")
+	h.row(24, "    --auth <method>", "api-key (default) or adc for gcloud Application Default Credentials (config: auth)")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintf(os.Stderr, "%sMODELS:%s\n", colorBold, colorReset)
-	fmt.Fprintf(os.Stderr, "  flash                 %s (Nano Banana 2, default)\n", modelFlash)
-	fmt.Fprintf(os.Stderr, "  pro                   %s (Nano Banana Pro)\n", modelPro)
-	fmt.Fprintf(os.Stderr, "  legacy                %s\n", modelLegacy)
-	fmt.Fprintf(os.Stderr, "  <full-name>           Any Gemini model name (e.g., %s)\n", modelFlash)
+	h.row(24, "flash", fmt.Sprintf("%s (Nano Banana 2, default, ~$0.04/image)", modelFlash))
+	h.row(24, "pro", fmt.Sprintf("%s (Nano Banana Pro, ~$0.13/image, ~$0.24 at 4K)", modelPro))
+	h.row(24, "legacy", fmt.Sprintf("%s (~$0.04/image)", modelLegacy))
+	h.row(24, "<full-name>", fmt.Sprintf("Any Gemini model name (e.g., %s)", modelFlash))
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintf(os.Stderr, "%sCONFIG:%s\n", colorBold, colorReset)
-	fmt.Fprintf(os.Stderr, "  File: %s\n", configPath())
-	fmt.Fprintln(os.Stderr, "  Env:  NANOBANANA_GEMINI_API_KEY (or GEMINI_API_KEY)")
-	fmt.Fprintln(os.Stderr, "  Env:  NANOBANANA_MODEL (overrides config default model)")
+	h.row(8, "File:", configPath())
+	h.row(8, "Env:", "NANOBANANA_CONFIG (use a different config file; --config overrides it)")
+	h.row(8, "Env:", "NANOBANANA_GEMINI_API_KEY (or GEMINI_API_KEY)")
+	h.row(8, "Env:", "NANOBANANA_GEMINI_API_KEY_FILE (file containing the key, or keychain:<service>)")
+	h.row(8, "Env:", "NANOBANANA_MODEL (overrides config default model)")
+	h.row(8, "Env:", "NANOBANANA_NO_SPINNER (same as --no-spinner)")
+	h.row(8, "Env:", "NANOBANANA_ASPECT, NANOBANANA_SIZE (override config default aspect and size)")
+	h.row(8, "Env:", "NANOBANANA_API_BASE_URL (API root for proxies/gateways)")
+	h.row(8, "Env:", "NANOBANANA_PROFILE (config profile, same as --profile)")
+	h.row(8, "Env:", "NO_COLOR (disable colored output)")
+	fmt.Fprintln(os.Stderr, "")
+	fmt.Fprintf(os.Stderr, "%sEXIT CODES:%s\n", colorBold, colorReset)
+	h.text("  0 success, 1 other error, 2 authentication/API key, 3 rate limited,")
+	h.text("  4 bad request, 5 network or timeout, 6 file I/O, 7 blocked by safety filters,")
+	h.text("  8 --on-success command failed (with --fail-on-hook), 130 canceled (Ctrl-C)")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintf(os.Stderr, "%sEXAMPLES:%s\n", colorBold, colorReset)
-	fmt.Fprintln(os.Stderr, "  nanobanana generate \"a cat in space\"")
-	fmt.Fprintln(os.Stderr, "  nanobanana gen \"sunset\" --aspect 16:9 --output sunset.png")
-	fmt.Fprintln(os.Stderr, "  nanobanana generate \"4K wallpaper\" --size 4K")
-	fmt.Fprintln(os.Stderr, "  nanobanana generate \"icon\" --size 512px")
-	fmt.Fprintln(os.Stderr, "  nanobanana generate \"logo ideas\" --count 4    # 4 variations")
-	fmt.Fprintln(os.Stderr, "  nanobanana generate \"icon\" --json              # JSON for scripts")
-	fmt.Fprintln(os.Stderr, "  nanobanana edit --preview photo.jpg \"make it cartoon\"")
-	fmt.Fprintln(os.Stderr, "  nanobanana edit photo.jpg \"watercolor style\" -o result.png")
-	fmt.Fprintln(os.Stderr, "  cat photo.jpg | nanobanana edit - \"fix it\" -o -  # stdin/stdout")
+	h.text("  nanobanana generate \"a cat in space\"")
+	h.text("  nanobanana gen \"sunset\" --aspect 16:9 --output sunset.png")
+	h.text("  nanobanana generate \"4K wallpaper\" --size 4K")
+	h.text("  nanobanana generate \"icon\" --size 512px")
+	h.text("  nanobanana generate \"logo ideas\" --count 4    # 4 variations")
+	h.text("  nanobanana generate \"icon\" --json              # JSON for scripts")
+	h.text("  nanobanana edit --preview photo.jpg \"make it cartoon\"")
+	h.text("  nanobanana edit photo.jpg \"watercolor style\" -o result.png")
+	h.text("  nanobanana edit a.jpg b.jpg \"put the subject of the first image into the second\"")
+	h.text("  cat photo.jpg | nanobanana edit - \"fix it\" -o -  # stdin/stdout")
+	h.text("  nanobanana edit --input-dir photos --glob '*.jpg' --output-dir out \"convert to line art\"")
 	fmt.Fprintln(os.Stderr, "")
 }
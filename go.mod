@@ -4,7 +4,6 @@ go 1.25.6
 
 require (
 	github.com/BurntSushi/toml v1.6.0
+	golang.org/x/sys v0.41.0
 	golang.org/x/term v0.40.0
 )
-
-require golang.org/x/sys v0.41.0 // indirect